@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// writeFileAtomic replaces filename with what write produces, so that after
+// a crash the file holds either its old or its new content, never a mix.
+// The content goes into a temporary file in the same directory, which is
+// synced, given perm and the owner of the file it replaces, and renamed over
+// filename; the directory is then synced so the rename itself survives a
+// power loss. If filename is a symbolic link, the file it points to is
+// replaced.
+func writeFileAtomic(filename string, perm fs.FileMode, write func(w io.Writer) error) error {
+	filename, err := resolveSymlinks(filename)
+	if err != nil {
+		return err
+	}
+	old, statErr := fsys.Stat(filename)
+
+	tmp, err := fsys.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	bw := bufio.NewWriter(tmp)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && statErr == nil {
+		err = keepOwner(tmp.Name(), old)
+	}
+	// Chmod comes after chown, which clears the setuid and setgid bits.
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fsys.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		fsys.Remove(tmp.Name())
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(filename)); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// keepOwner gives name the owner and group recorded in info. Ownership that
+// may not be given away is left to the current user, as copyMetadata does.
+func keepOwner(name string, info fs.FileInfo) error {
+	uid, gid, ok := fsys.Owner(info)
+	if !ok {
+		return nil
+	}
+	if err := fsys.Chown(name, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("failed to keep file owner: %w", err)
+	}
+
+	return nil
+}
+
+// writeDataAtomic replaces filename with data, like writeFileAtomic.
+func writeDataAtomic(filename string, data []byte, perm fs.FileMode) error {
+	return writeFileAtomic(filename, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// filePerm returns the permissions of the named file, or perm if it does
+// not exist yet, so that rewriting a file keeps its mode.
+func filePerm(name string, perm fs.FileMode) fs.FileMode {
+	if info, err := fsys.Stat(name); err == nil {
+		return info.Mode().Perm()
+	}
+
+	return perm
+}
+
+// resolveSymlinks follows name through symbolic links to the file they
+// point to, which need not exist.
+func resolveSymlinks(name string) (string, error) {
+	for links := 0; ; links++ {
+		info, err := fsys.Lstat(name)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			return name, nil
+		}
+		if links == maxSymlinks {
+			return "", &fs.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+		}
+
+		target, err := fsys.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+	}
+}
+
+// syncDir flushes the entries of a directory to disk. Directories cannot
+// be synced on Windows, so there the rename is left to the file system.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := fsys.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		// Some file systems, such as certain FUSE ones, do not support it.
+		return nil
+	}
+
+	return err
+}
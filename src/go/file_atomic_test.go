@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomicSurvivesInterruption(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/dir", 0755)
+	mem.WriteFile("/dir/file", []byte("old content"), 0600)
+
+	// A crash at any point of the write leaves the old content in place.
+	err := writeFileAtomic("/dir/file", 0600, func(w io.Writer) error {
+		io.WriteString(w, "new")
+		assertUnchanged(t, mem, "/dir/file", "old content")
+		_, err := io.WriteString(w, " content")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/dir/file", "new content")
+
+	// A failing writer, such as a process being stopped, leaves nothing behind.
+	interrupted := errors.New("interrupted")
+	err = writeFileAtomic("/dir/file", 0600, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return interrupted
+	})
+	if !errors.Is(err, interrupted) {
+		t.Fatalf("error = %v", err)
+	}
+	assertUnchanged(t, mem, "/dir/file", "new content")
+	assertNoTempFiles(t, mem, "/dir")
+}
+
+func TestWriteCommandsUnderFaults(t *testing.T) {
+	commands := map[string]func(name, content string) error{
+		"write":     FileOpWrite,
+		"writeFile": func(name, content string) error { return WriteFile(name, []byte(content)) },
+		"save": func(name, content string) error {
+			file := NewFile(name)
+			file.Content = content
+			return file.Save()
+		},
+	}
+
+	for command, write := range commands {
+		for _, c := range faultCases {
+			t.Run(command+"/"+c.name, func(t *testing.T) {
+				faults, mem := useFaultFileSystem(t)
+				mem.WriteFile("/file", []byte("old content"), 0600)
+
+				fault := c.fault
+				fault.Path = ".file.tmp-*"
+				if c.fault.Op == FaultRename {
+					fault.Path = "file"
+				}
+				faults.Inject(fault)
+				if err := write("/file", "new content"); err == nil {
+					t.Fatal("write succeeded under the fault")
+				}
+				faults.Reset()
+				assertUnchanged(t, mem, "/file", "old content")
+				assertNoTempFiles(t, mem, "/")
+
+				if err := write("/file", "new content"); err != nil {
+					t.Fatal(err)
+				}
+				assertUnchanged(t, mem, "/file", "new content")
+				if info, _ := mem.Stat("/file"); info.Mode().Perm() != 0600 {
+					t.Errorf("mode changed to %v", info.Mode().Perm())
+				}
+			})
+		}
+	}
+}
+
+func TestWriteFileAtomicSyncsDirectory(t *testing.T) {
+	faults, mem := useFaultFileSystem(t)
+	mem.MkdirAll("/dir", 0755)
+	fault := faults.Inject(Fault{Op: FaultSync, Path: "/dir", Err: syscall.EIO})
+
+	if err := writeDataAtomic("/dir/file", []byte("data"), 0644); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("error = %v", err)
+	}
+	if fault.Injected() != 1 {
+		t.Error("directory was not synced")
+	}
+	// The rename happened; only its durability is in doubt.
+	assertUnchanged(t, mem, "/dir/file", "data")
+}
+
+func TestWriteFileAtomicFollowsSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	os.WriteFile(target, []byte("old"), 0644)
+	if err := os.Symlink("target", link); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	if err := FileOpWrite(link, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("link replaced by a file: %v, %v", info, err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "new" {
+		t.Errorf("target = %q", data)
+	}
+}
+
+func TestRewrittenFilesKeepOwner(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.WriteFile("/file", []byte("plain"), 0640)
+	mem.Chown("/file", 1000, 100)
+	encryptKeys, decryptKeys := identityKeys(t)
+
+	assertOwner := func(step string) {
+		t.Helper()
+		info, err := mem.Stat("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid, _ := fsys.Owner(info); uid != 1000 || gid != 100 || info.Mode().Perm() != 0640 {
+			t.Errorf("after %s: owner %d:%d, mode %v", step, uid, gid, info.Mode().Perm())
+		}
+	}
+
+	if err := CompressAndEncryptFile("/file", encryptKeys, CompressionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertOwner("encrypting")
+	if err := DecryptAndDecompressFile("/file", decryptKeys); err != nil {
+		t.Fatal(err)
+	}
+	assertOwner("decrypting")
+	if err := writeDataAtomic("/file", []byte("new"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	assertOwner("writing")
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -16,71 +18,155 @@ const BackupDir = "backups"
 // BackupSuffix is the suffix that will be added to the file names to create backups.
 const BackupSuffix = "_backup"
 
-// backupFile creates a backup copy of the file with the given path.
-func BackupFile(path string) error {
-	file, err := os.Open(path)
+// BackupOptions controls how BackupFile stores a backup.
+type BackupOptions struct {
+	Tags         []string // tags recorded in the catalog
+	ParityShards int      // Reed-Solomon parity shards per stripe; 0 disables parity
+	DataShards   int      // data shards per stripe; 0 means DefaultDataShards
+
+	// SigningKey, when set, signs the manifest of the backup in the catalog.
+	SigningKey ed25519.PrivateKey
+}
+
+// RestoreOptions controls which backups RestoreBackup accepts. Signed
+// backups are always verified; unsigned ones are refused only when
+// RequireSignature is set, which also needs TrustedKeys.
+type RestoreOptions struct {
+	RequireSignature bool
+	TrustedKeys      []ed25519.PublicKey // if set, signatures must be made by one of these keys
+}
+
+// backupFile creates a backup copy of the file with the given path and records it in the catalog.
+func BackupFile(path string, opts BackupOptions) error {
+	file, err := fsys.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open the file for backup: %w", err)
 	}
 	defer file.Close()
 
-	// Ensure the backup directory exists.
-	err = os.MkdirAll(BackupDir, os.ModePerm)
+	source, err := fsys.Abs(path)
 	if err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
+		return fmt.Errorf("failed to resolve the file path: %w", err)
 	}
 
-	// Append a timestamp to the backup filename to avoid overwriting previous backups.
-	timestamp := time.Now().Format("20060102150405")
-	backupPath := filepath.Join(BackupDir, filepath.Base(path)+BackupSuffix+"_"+timestamp)
-	backupFile, err := os.Create(backupPath)
+	lock, err := lockCatalog()
 	if err != nil {
-		return fmt.Errorf("failed to create backup file: %w", err)
+		return err
 	}
-	defer backupFile.Close()
+	defer lock.Close()
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return err
+	}
+
+	// The backup ID carries a nanosecond timestamp and a random suffix, so
+	// two backups taken within the same second never overwrite each other.
+	createdAt := time.Now()
+	id, err := newBackupID(createdAt)
+	if err != nil {
+		return err
+	}
+	object := filepath.Base(path) + BackupSuffix + "_" + id
+	backupPath := filepath.Join(BackupDir, object)
 
-	_, err = io.Copy(backupFile, file)
+	// Write atomically so an interrupted backup never leaves a partial object behind.
+	hash := sha256.New()
+	var size int64
+	err = writeFileAtomic(backupPath, 0644, func(w io.Writer) error {
+		size, err = io.Copy(io.MultiWriter(w, hash), file)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to write to backup file: %w", err)
 	}
 
-	fmt.Printf("Backup of %s created at %s\n", path, backupPath)
+	var parity *ParityInfo
+	if opts.ParityShards > 0 {
+		dataShards := opts.DataShards
+		if dataShards == 0 {
+			dataShards = DefaultDataShards
+		}
+		parity, err = WriteParity(backupPath, backupPath+ParitySuffix, dataShards, opts.ParityShards)
+		if err != nil {
+			fsys.Remove(backupPath)
+			return err
+		}
+		parity.Object = object + ParitySuffix
+	}
+
+	host, _ := os.Hostname()
+	entry := BackupEntry{
+		ID:        id,
+		Source:    source,
+		Object:    object,
+		Size:      size,
+		SHA256:    fmt.Sprintf("%x", hash.Sum(nil)),
+		CreatedAt: createdAt,
+		Host:      host,
+		User:      currentUser(),
+		Tags:      opts.Tags,
+		Parity:    parity,
+	}
+	if opts.SigningKey != nil {
+		entry.signManifest(opts.SigningKey)
+	}
+	catalog.Add(entry)
+	if err := catalog.Save(); err != nil {
+		fsys.Remove(backupPath)
+		fsys.Remove(backupPath + ParitySuffix)
+		return err
+	}
+
+	fmt.Printf("Backup %s of %s created at %s\n", id, path, backupPath)
 	return nil
 }
 
 // restoreBackup restores the latest backup of the file with the given path, if it exists.
-func RestoreBackup(path string) error {
-	// Find the latest backup file.
-	files, err := os.ReadDir(BackupDir)
+// The backup is checked against its recorded checksum and, if signed, its
+// signature before the file is replaced.
+func RestoreBackup(path string, opts RestoreOptions) error {
+	entry, found, err := latestBackup(path)
 	if err != nil {
-		return fmt.Errorf("failed to read backup directory: %w", err)
+		return err
 	}
 
-	var backupPath string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), filepath.Base(path)+BackupSuffix) {
-			backupPath = filepath.Join(BackupDir, file.Name())
+	if !found {
+		fmt.Println("No backup found for the given file.")
+		return nil
+	}
+
+	if opts.RequireSignature && len(opts.TrustedKeys) == 0 {
+		return fmt.Errorf("refusing to restore %s: %w", path, ErrNoTrustedSigners)
+	}
+	if entry.Signature != nil || opts.RequireSignature || len(opts.TrustedKeys) > 0 {
+		if err := entry.verifyManifest(opts.TrustedKeys); err != nil {
+			return fmt.Errorf("refusing to restore %s: %w", path, err)
 		}
 	}
 
-	if backupPath == "" {
-		fmt.Println("No backup found for the given file.")
-		return nil
+	// A tampered catalog must not make the restore read from outside the backup directory.
+	if entry.Object != filepath.Base(entry.Object) || entry.Object == ".." {
+		return fmt.Errorf("refusing to restore %s: invalid backup object name %q", path, entry.Object)
 	}
 
-	backupFile, err := os.Open(backupPath)
+	backupPath := filepath.Join(BackupDir, entry.Object)
+	backupFile, err := fsys.Open(backupPath)
 	if err != nil {
 		return fmt.Errorf("failed to open the backup file: %w", err)
 	}
 	defer backupFile.Close()
 
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create the original file from backup: %w", err)
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, backupFile)
+	err = writeFileAtomic(path, filePerm(path, 0644), func(w io.Writer) error {
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, hash), backupFile); err != nil {
+			return err
+		}
+		if sum := fmt.Sprintf("%x", hash.Sum(nil)); entry.SHA256 != "" && sum != entry.SHA256 {
+			return fmt.Errorf("backup %s does not match its recorded checksum; run -verify-backups", entry.Object)
+		}
+		return nil
+	})
 	if err != nil {
 		return fmt.Errorf("failed to restore the file from backup: %w", err)
 	}
@@ -89,18 +175,116 @@ func RestoreBackup(path string) error {
 	return nil
 }
 
-// listBackups prints a list of all existing backups for the file with the given path.
-func ListBackups(path string) error {
-	files, err := os.ReadDir(BackupDir)
+// latestBackup finds the latest backup of the file with the given path.
+// Backups recorded in the catalog take precedence over legacy backups.
+func latestBackup(path string) (BackupEntry, bool, error) {
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return BackupEntry{}, false, err
+	}
+
+	source, err := fsys.Abs(path)
 	if err != nil {
-		return fmt.Errorf("failed to read backup directory: %w", err)
+		return BackupEntry{}, false, fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+	if entry, ok := catalog.Latest(source); ok {
+		return entry, true, nil
 	}
 
-	fmt.Printf("Existing backups for %s:\n", path)
+	files, err := fsys.ReadDir(BackupDir)
+	if err != nil {
+		return BackupEntry{}, false, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var latest BackupEntry
+	var found bool
 	for _, file := range files {
-		if strings.HasPrefix(file.Name(), filepath.Base(path)+BackupSuffix) {
-			fmt.Println(file.Name())
+		if entry, ok := legacyEntry(file.Name()); ok && entry.Source == filepath.Base(path) {
+			latest, found = entry, true
+		}
+	}
+
+	return latest, found, nil
+}
+
+// PruneBackups deletes all but the newest keep backups of the file with the
+// given path and returns the backups that were removed.
+func PruneBackups(path string, keep int) ([]BackupEntry, error) {
+	lock, err := lockCatalog()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := filterBackups(catalog.Backups, path, ListOptions{SortBy: "time", Reverse: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) <= keep {
+		return nil, nil
+	}
+
+	removed := entries[keep:]
+	for _, entry := range removed {
+		catalog.Remove(entry.ID)
+	}
+	if err := catalog.Save(); err != nil {
+		return nil, err
+	}
+
+	// Objects are only deleted once the catalog no longer references them.
+	for _, entry := range removed {
+		if catalog.references(entry.Object) > 0 {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(BackupDir, entry.Object)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("failed to delete backup object: %w", err)
+		}
+		if entry.Parity != nil {
+			fsys.Remove(filepath.Join(BackupDir, entry.Parity.Object))
+		}
+	}
+
+	return removed, nil
+}
+
+// listBackups prints the backups for the file with the given path, or for every file when path is "*".
+func ListBackups(path string, opts ListOptions) error {
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return err
+	}
+
+	entries, err := catalog.entries()
+	if err != nil {
+		return err
+	}
+
+	entries, err = filterBackups(entries, path, opts)
+	if err != nil {
+		return err
+	}
+
+	switch opts.Format {
+	case "", "table":
+		fmt.Printf("Existing backups for %s:\n", path)
+		printBackupTable(entries)
+	case "json":
+		if entries == nil {
+			entries = []BackupEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode backups: %w", err)
 		}
+		fmt.Println(string(data))
+	default:
+		return fmt.Errorf("unknown format %q; use table or json", opts.Format)
 	}
 
 	return nil
@@ -128,7 +312,7 @@ func CheckFileIntegrity(originalPath, backupPath string) error {
 
 // calculateChecksum calculates a SHA-256 checksum for the file.
 func CalculateChecksum(path string) (string, error) {
-	file, err := os.Open(path)
+	file, err := fsys.Open(path)
 	if err != nil {
 			return "", fmt.Errorf("failed to open the file: %w", err)
 	}
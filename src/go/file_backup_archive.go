@@ -0,0 +1,446 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ArchiveFormat identifies GoFiler backup archives in their manifest.
+const ArchiveFormat = "gofiler-backup-archive"
+
+// archiveVersion is the current version of the archive format.
+const archiveVersion = 1
+
+// archiveManifestName is the first member of every archive.
+const archiveManifestName = "manifest.json"
+
+// archiveObjectDir holds the backup objects and parity files inside an archive.
+const archiveObjectDir = "objects"
+
+// ArchiveFile is a file stored in an archive together with its checksum.
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveManifest describes the contents of a backup archive.
+type ArchiveManifest struct {
+	Format    string        `json:"format"`
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	Host      string        `json:"host"`
+	User      string        `json:"user"`
+	Backups   []BackupEntry `json:"backups"`
+	Files     []ArchiveFile `json:"files"`
+}
+
+// ExportBackups writes the selected backups into a single gzip-compressed tar
+// archive. When ids is empty every backup matching opts is exported.
+func ExportBackups(archivePath string, ids []string, opts ListOptions) error {
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return err
+	}
+
+	entries, err := catalog.entries()
+	if err != nil {
+		return err
+	}
+	entries, err = selectBackups(entries, ids, opts)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no backups selected for export")
+	}
+
+	host, _ := os.Hostname()
+	manifest := ArchiveManifest{
+		Format:    ArchiveFormat,
+		Version:   archiveVersion,
+		CreatedAt: time.Now(),
+		Host:      host,
+		User:      currentUser(),
+	}
+
+	// Checksums go into the manifest before the objects are written, so they
+	// are taken from the catalog and checked again while each object is copied.
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.SHA256 == "" {
+			entry.SHA256, err = CalculateChecksum(filepath.Join(BackupDir, entry.Object))
+			if err != nil {
+				return err
+			}
+		}
+		if !seen[entry.Object] {
+			seen[entry.Object] = true
+			manifest.Files = append(manifest.Files, ArchiveFile{Name: entry.Object, Size: entry.Size, SHA256: entry.SHA256})
+		}
+		if entry.Parity != nil && !seen[entry.Parity.Object] {
+			seen[entry.Parity.Object] = true
+			file, err := describeArchiveFile(entry.Parity.Object)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+		manifest.Backups = append(manifest.Backups, *entry)
+	}
+
+	err = writeFileAtomic(archivePath, filePerm(archivePath, 0644), func(w io.Writer) error {
+		return writeArchive(w, manifest)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	fmt.Printf("Exported %d backups to %s\n", len(manifest.Backups), archivePath)
+	return nil
+}
+
+// selectBackups picks the backups with the given IDs, or every backup matching opts when ids is empty.
+func selectBackups(entries []BackupEntry, ids []string, opts ListOptions) ([]BackupEntry, error) {
+	entries, err := filterBackups(entries, "*", opts)
+	if err != nil || len(ids) == 0 {
+		return entries, err
+	}
+
+	byID := make(map[string]BackupEntry, len(entries))
+	for _, entry := range entries {
+		byID[entry.ID] = entry
+	}
+
+	var selected []BackupEntry
+	for _, id := range ids {
+		entry, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("backup %s not found", id)
+		}
+		selected = append(selected, entry)
+	}
+
+	return selected, nil
+}
+
+// describeArchiveFile returns the size and checksum of a file in BackupDir.
+func describeArchiveFile(name string) (ArchiveFile, error) {
+	info, err := fsys.Stat(filepath.Join(BackupDir, name))
+	if err != nil {
+		return ArchiveFile{}, fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+
+	checksum, err := CalculateChecksum(filepath.Join(BackupDir, name))
+	if err != nil {
+		return ArchiveFile{}, err
+	}
+
+	return ArchiveFile{Name: name, Size: info.Size(), SHA256: checksum}, nil
+}
+
+// writeArchive writes the manifest followed by every file it lists.
+func writeArchive(w io.Writer, manifest ArchiveManifest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode archive manifest: %w", err)
+	}
+	header := &tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+
+	for _, file := range manifest.Files {
+		if err := writeArchiveFile(tw, file, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+
+	return nil
+}
+
+// writeArchiveFile copies one file from BackupDir into the archive, refusing
+// to export it if it no longer matches its recorded checksum.
+func writeArchiveFile(tw *tar.Writer, file ArchiveFile, modTime time.Time) error {
+	src, err := fsys.Open(filepath.Join(BackupDir, file.Name))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", file.Name, err)
+	}
+	defer src.Close()
+
+	header := &tar.Header{Name: path.Join(archiveObjectDir, file.Name), Mode: 0644, Size: file.Size, ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s to archive: %w", file.Name, err)
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), src, file.Size); err != nil {
+		return fmt.Errorf("failed to write %s to archive: %w", file.Name, err)
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != file.SHA256 {
+		return fmt.Errorf("%s does not match its recorded checksum; run -verify-backups", file.Name)
+	}
+
+	return nil
+}
+
+// ImportBackups imports the backups of an archive into BackupDir. Every file
+// is checked against the manifest before anything is added to the catalog.
+// Backups that are already present are skipped, and objects whose content is
+// already stored are shared rather than copied again.
+func ImportBackups(archivePath string) error {
+	in, err := fsys.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	manifest, err := readArchiveManifest(tr)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockCatalog()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return err
+	}
+
+	// Extract every file to a temporary name and verify it first.
+	files := make(map[string]ArchiveFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		files[file.Name] = file
+	}
+	extracted := make(map[string]string)
+	defer func() {
+		for _, tmp := range extracted {
+			fsys.Remove(tmp)
+		}
+	}()
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		dir, name := path.Split(header.Name)
+		file, ok := files[name]
+		if path.Clean(dir) != archiveObjectDir || !ok {
+			return fmt.Errorf("archive member %s is not listed in the manifest", header.Name)
+		}
+		if _, dup := extracted[name]; dup {
+			return fmt.Errorf("archive member %s appears twice", header.Name)
+		}
+
+		tmp, err := extractArchiveFile(tr, file)
+		if err != nil {
+			return err
+		}
+		extracted[name] = tmp
+	}
+
+	for _, file := range manifest.Files {
+		if _, ok := extracted[file.Name]; !ok {
+			return fmt.Errorf("archive is missing %s listed in the manifest", file.Name)
+		}
+	}
+
+	// Files moved into BackupDir are removed again unless the catalog that
+	// refers to them is saved.
+	var stored []string
+	committed := false
+	defer func() {
+		if !committed {
+			for _, target := range stored {
+				fsys.Remove(target)
+			}
+		}
+	}()
+	store := func(name string) error {
+		target, err := moveExtracted(extracted, name)
+		if target != "" {
+			stored = append(stored, target)
+		}
+		return err
+	}
+
+	imported, skipped, shared := 0, 0, 0
+	for _, entry := range manifest.Backups {
+		if catalogHas(catalog, entry.ID) {
+			skipped++
+			continue
+		}
+
+		existing, found := catalogObject(catalog, entry.SHA256, entry.Size)
+		if found {
+			entry.Object = existing.Object
+			shared++
+		} else if err := store(entry.Object); err != nil {
+			return err
+		}
+		// The parity of the stored object is shared if it has one; otherwise
+		// the parity from the archive, computed over the same content, is kept.
+		if found && existing.Parity != nil {
+			entry.Parity = existing.Parity
+		} else if entry.Parity != nil {
+			if err := store(entry.Parity.Object); err != nil {
+				return err
+			}
+		}
+
+		catalog.Add(entry)
+		imported++
+	}
+
+	if err := catalog.Save(); err != nil {
+		return err
+	}
+	committed = true
+
+	fmt.Printf("Imported %d backups from %s (%d already present, %d sharing existing objects)\n",
+		imported, archivePath, skipped, shared)
+	return nil
+}
+
+// readArchiveManifest reads and validates the first member of an archive.
+func readArchiveManifest(tr *tar.Reader) (*ArchiveManifest, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if header.Name != archiveManifestName {
+		return nil, fmt.Errorf("not a GoFiler backup archive: first member is %s", header.Name)
+	}
+
+	manifest := &ArchiveManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse archive manifest: %w", err)
+	}
+	if manifest.Format != ArchiveFormat {
+		return nil, fmt.Errorf("not a GoFiler backup archive: format %q", manifest.Format)
+	}
+	if manifest.Version > archiveVersion {
+		return nil, fmt.Errorf("archive version %d is newer than supported version %d", manifest.Version, archiveVersion)
+	}
+
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		if file.Name != filepath.Base(file.Name) || file.Name == "." || file.Name == ".." || file.Name == CatalogFile {
+			return nil, fmt.Errorf("archive manifest lists invalid file name %q", file.Name)
+		}
+		listed[file.Name] = true
+	}
+	for _, entry := range manifest.Backups {
+		if !listed[entry.Object] || (entry.Parity != nil && !listed[entry.Parity.Object]) {
+			return nil, fmt.Errorf("archive manifest backup %s refers to a file that is not in the archive", entry.ID)
+		}
+	}
+
+	return manifest, nil
+}
+
+// extractArchiveFile writes the current archive member to a temporary file
+// in BackupDir and checks its size and checksum against the manifest.
+func extractArchiveFile(tr *tar.Reader, file ArchiveFile) (string, error) {
+	tmp, err := fsys.CreateTemp(BackupDir, ".import-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), tr)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to extract %s: %w", file.Name, err)
+	}
+
+	if size != file.Size || fmt.Sprintf("%x", hash.Sum(nil)) != file.SHA256 {
+		fsys.Remove(tmp.Name())
+		return "", fmt.Errorf("%s does not match the checksum in the archive manifest", file.Name)
+	}
+
+	return tmp.Name(), nil
+}
+
+// moveExtracted moves a verified file into place under its object name and
+// returns where it went, or "" if it was already moved for an earlier backup.
+func moveExtracted(extracted map[string]string, name string) (string, error) {
+	tmp, ok := extracted[name]
+	if !ok {
+		return "", nil
+	}
+
+	target := filepath.Join(BackupDir, name)
+	if _, err := fsys.Lstat(target); err == nil {
+		return "", fmt.Errorf("refusing to overwrite existing backup object %s", name)
+	}
+	if err := fsys.Rename(tmp, target); err != nil {
+		return "", fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	delete(extracted, name)
+
+	return target, nil
+}
+
+// catalogHas reports whether the catalog already holds a backup with the given ID.
+func catalogHas(c *BackupCatalog, id string) bool {
+	for _, entry := range c.Backups {
+		if entry.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// catalogObject finds a stored backup with the given content.
+func catalogObject(c *BackupCatalog, checksum string, size int64) (BackupEntry, bool) {
+	for _, entry := range c.Backups {
+		if entry.SHA256 == checksum && entry.Size == size {
+			return entry, true
+		}
+	}
+
+	return BackupEntry{}, false
+}
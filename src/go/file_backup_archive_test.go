@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// exportTestBackups backs up /a and /b, the latter with parity, and exports
+// both to /archive.tgz. It returns the backed up entries.
+func exportTestBackups(t *testing.T, mem *MemFileSystem) []BackupEntry {
+	t.Helper()
+
+	mem.WriteFile("/a", []byte("first file"), 0644)
+	mem.WriteFile("/b", bytes.Repeat([]byte("second file "), 1000), 0644)
+	if err := BackupFile("/a", BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := BackupFile("/b", BackupOptions{ParityShards: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportBackups("/archive.tgz", nil, ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog.Backups
+}
+
+// moveToNewFileSystem copies the archive to a new, empty in-memory file system.
+func moveToNewFileSystem(t *testing.T, mem *MemFileSystem) *MemFileSystem {
+	t.Helper()
+
+	data, err := mem.ReadFile("/archive.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem = useMemFileSystem(t)
+	mem.WriteFile("/archive.tgz", data, 0644)
+
+	return mem
+}
+
+// rewriteArchive passes every member of /archive.tgz through change, which
+// returns the new content or false to drop the member, and appends extra.
+func rewriteArchive(t *testing.T, mem *MemFileSystem, change func(name string, data []byte) ([]byte, bool), extra map[string][]byte) {
+	t.Helper()
+
+	data, _ := mem.ReadFile("/archive.tgz")
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	var out bytes.Buffer
+	gzw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gzw)
+	add := func(name string, data []byte) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		member, _ := io.ReadAll(tr)
+		if member, keep := change(header.Name, member); keep {
+			add(header.Name, member)
+		}
+	}
+	for name, data := range extra {
+		add(name, data)
+	}
+	tw.Close()
+	gzw.Close()
+
+	mem.WriteFile("/archive.tgz", out.Bytes(), 0644)
+}
+
+// backupDirNames returns the sorted names in BackupDir.
+func backupDirNames(t *testing.T, mem *MemFileSystem) []string {
+	t.Helper()
+
+	entries, err := mem.ReadDir(BackupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	mem := useMemFileSystem(t)
+	exported := exportTestBackups(t, mem)
+	mem = moveToNewFileSystem(t, mem)
+
+	if err := ImportBackups("/archive.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Backups) != len(exported) {
+		t.Fatalf("imported %d of %d backups", len(catalog.Backups), len(exported))
+	}
+	for i, entry := range catalog.Backups {
+		if entry.ID != exported[i].ID || entry.SHA256 != exported[i].SHA256 || (entry.Parity == nil) != (exported[i].Parity == nil) {
+			t.Errorf("imported %+v, exported %+v", entry, exported[i])
+		}
+	}
+	if err := VerifyBackups(); err != nil {
+		t.Errorf("imported backups do not verify: %v", err)
+	}
+	if err := RestoreBackup("/a", RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/a", "first file")
+
+	// Importing again adds nothing.
+	before := backupDirNames(t, mem)
+	if err := ImportBackups("/archive.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	if catalog, _ := LoadCatalog(); len(catalog.Backups) != len(exported) {
+		t.Errorf("second import added backups: %d", len(catalog.Backups))
+	}
+	if after := backupDirNames(t, mem); len(after) != len(before) {
+		t.Errorf("second import added files: %v", after)
+	}
+}
+
+func TestImportRejectsBadArchives(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(name string, data []byte) ([]byte, bool)
+		extra  map[string][]byte
+	}{
+		{
+			name: "tampered member",
+			change: func(name string, data []byte) ([]byte, bool) {
+				if name != archiveManifestName {
+					data[len(data)/2] ^= 1
+				}
+				return data, true
+			},
+		},
+		{
+			name:   "unlisted member",
+			change: func(name string, data []byte) ([]byte, bool) { return data, true },
+			extra:  map[string][]byte{archiveObjectDir + "/unlisted": []byte("x")},
+		},
+		{
+			name: "missing member",
+			change: func(name string, data []byte) ([]byte, bool) {
+				return data, name == archiveManifestName
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := useMemFileSystem(t)
+			exportTestBackups(t, mem)
+			mem = moveToNewFileSystem(t, mem)
+			rewriteArchive(t, mem, tt.change, tt.extra)
+
+			if err := ImportBackups("/archive.tgz"); err == nil {
+				t.Fatal("import succeeded")
+			}
+			if names := backupDirNames(t, mem); len(names) != 1 || names[0] != CatalogLockFile {
+				t.Errorf("failed import left %v", names)
+			}
+		})
+	}
+}
+
+func TestImportRollsBackStoredObjects(t *testing.T) {
+	mem := useMemFileSystem(t)
+	exportTestBackups(t, mem)
+	data, _ := mem.ReadFile("/archive.tgz")
+
+	faults, mem := useFaultFileSystem(t)
+	mem.WriteFile("/archive.tgz", data, 0644)
+	faults.Inject(Fault{Op: FaultRename, Path: BackupDir + "/b_backup_*", Err: syscall.EIO})
+
+	if err := ImportBackups("/archive.tgz"); err == nil {
+		t.Fatal("import succeeded")
+	}
+	if names := backupDirNames(t, mem); len(names) != 1 || names[0] != CatalogLockFile {
+		t.Errorf("failed import left %v", names)
+	}
+}
+
+func TestImportSharesObjectsAndKeepsParity(t *testing.T) {
+	mem := useMemFileSystem(t)
+	exported := exportTestBackups(t, mem)
+	content, _ := mem.ReadFile("/b")
+	mem = moveToNewFileSystem(t, mem)
+
+	// The same content is already stored, without parity.
+	mem.WriteFile("/copy-of-b", content, 0644)
+	if err := BackupFile("/copy-of-b", BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportBackups("/archive.tgz"); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, _ := LoadCatalog()
+	local, imported := catalog.Backups[0], catalog.Backups[len(catalog.Backups)-1]
+	if imported.ID != exported[1].ID || imported.Object != local.Object {
+		t.Fatalf("imported %+v does not share %s", imported, local.Object)
+	}
+	if imported.Parity == nil {
+		t.Fatal("parity from the archive was dropped")
+	}
+	if _, err := mem.Stat(BackupDir + "/" + imported.Parity.Object); err != nil {
+		t.Errorf("parity file not stored: %v", err)
+	}
+	if err := VerifyBackups(); err != nil {
+		t.Errorf("shared backups do not verify: %v", err)
+	}
+}
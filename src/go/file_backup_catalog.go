@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CatalogFile is the name of the backup catalog inside BackupDir.
+const CatalogFile = "catalog.json"
+
+// CatalogLockFile is the lock file inside BackupDir that is held while the
+// catalog is read, changed and saved.
+const CatalogLockFile = "catalog.lock"
+
+// catalogVersion is the current version of the catalog format.
+const catalogVersion = 1
+
+// legacyTimestampFormat is the timestamp embedded in backup names created before the catalog existed.
+const legacyTimestampFormat = "20060102150405"
+
+// BackupEntry describes a single backup recorded in the catalog.
+type BackupEntry struct {
+	ID        string           `json:"id"`
+	Source    string           `json:"source"`
+	Object    string           `json:"object"`
+	Size      int64            `json:"size"`
+	SHA256    string           `json:"sha256"`
+	CreatedAt time.Time        `json:"created_at"`
+	Host      string           `json:"host"`
+	User      string           `json:"user"`
+	Tags      []string         `json:"tags,omitempty"`
+	Parity    *ParityInfo      `json:"parity,omitempty"`
+	Signature *BackupSignature `json:"signature,omitempty"`
+	Legacy    bool             `json:"legacy,omitempty"`
+}
+
+// BackupCatalog is the list of backups stored in BackupDir.
+type BackupCatalog struct {
+	Version int           `json:"version"`
+	Backups []BackupEntry `json:"backups"`
+}
+
+// ListOptions controls how ListBackups filters, sorts and prints backups.
+type ListOptions struct {
+	Format  string    // "table" or "json"
+	SortBy  string    // "time", "size", "source" or "id"
+	Reverse bool      // reverse the sort order
+	Tags    []string  // only include backups carrying all of these tags
+	Since   time.Time // only include backups created at or after this time
+}
+
+// LoadCatalog reads the backup catalog. A missing catalog yields an empty one.
+func LoadCatalog() (*BackupCatalog, error) {
+	catalog := &BackupCatalog{Version: catalogVersion}
+
+	data, err := fsys.ReadFile(filepath.Join(BackupDir, CatalogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup catalog: %w", err)
+	}
+
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse backup catalog: %w", err)
+	}
+	if catalog.Version > catalogVersion {
+		return nil, fmt.Errorf("backup catalog version %d is newer than supported version %d", catalog.Version, catalogVersion)
+	}
+
+	return catalog, nil
+}
+
+// lockCatalog waits for and takes the catalog lock, so that runs at the same
+// time, such as the daemon and a command, do not lose each other's changes.
+// Take it before LoadCatalog and close it after Save.
+func lockCatalog() (io.Closer, error) {
+	if err := fsys.MkdirAll(BackupDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	lock, err := fsys.Lock(filepath.Join(BackupDir, CatalogLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock backup catalog: %w", err)
+	}
+
+	return lock, nil
+}
+
+// Save writes the catalog to BackupDir, replacing the previous one atomically.
+func (c *BackupCatalog) Save() error {
+	if err := fsys.MkdirAll(BackupDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	if err := writeJSONFile(filepath.Join(BackupDir, CatalogFile), c); err != nil {
+		return fmt.Errorf("failed to save backup catalog: %w", err)
+	}
+
+	return nil
+}
+
+// writeJSONFile encodes v as indented JSON and replaces path with it atomically.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeDataAtomic(path, data, 0644)
+}
+
+// Add records a new backup in the catalog.
+func (c *BackupCatalog) Add(entry BackupEntry) {
+	c.Backups = append(c.Backups, entry)
+}
+
+// Remove drops the backup with the given ID from the catalog.
+func (c *BackupCatalog) Remove(id string) {
+	kept := c.Backups[:0]
+	for _, entry := range c.Backups {
+		if entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	c.Backups = kept
+}
+
+// references counts the catalog entries that store their data in object.
+func (c *BackupCatalog) references(object string) int {
+	n := 0
+	for _, entry := range c.Backups {
+		if entry.Object == object {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Latest returns the most recent backup of the given source, if any.
+func (c *BackupCatalog) Latest(source string) (BackupEntry, bool) {
+	var latest BackupEntry
+	found := false
+	for _, entry := range c.Backups {
+		if entry.Source != source {
+			continue
+		}
+		if !found || entry.CreatedAt.After(latest.CreatedAt) {
+			latest = entry
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+// entries returns the catalog entries together with legacy backups found in
+// BackupDir that were created before the catalog existed.
+func (c *BackupCatalog) entries() ([]BackupEntry, error) {
+	entries := append([]BackupEntry(nil), c.Backups...)
+
+	known := make(map[string]bool, len(c.Backups))
+	for _, entry := range c.Backups {
+		known[entry.Object] = true
+	}
+
+	files, err := fsys.ReadDir(BackupDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || known[file.Name()] {
+			continue
+		}
+		entry, ok := legacyEntry(file.Name())
+		if !ok {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// legacyEntry builds a catalog entry from a backup name of the form name_backup_YYYYMMDDhhmmss.
+func legacyEntry(name string) (BackupEntry, bool) {
+	i := strings.LastIndex(name, BackupSuffix+"_")
+	if i <= 0 {
+		return BackupEntry{}, false
+	}
+
+	created, err := time.ParseInLocation(legacyTimestampFormat, name[i+len(BackupSuffix)+1:], time.Local)
+	if err != nil {
+		return BackupEntry{}, false
+	}
+
+	return BackupEntry{
+		ID:        name,
+		Source:    name[:i],
+		Object:    name,
+		CreatedAt: created,
+		Legacy:    true,
+	}, true
+}
+
+// newBackupID returns a unique, sortable backup identifier.
+func newBackupID(t time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate backup id: %w", err)
+	}
+
+	return t.UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// currentUser returns the name of the user running GoFiler.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// matchesSource reports whether the entry belongs to the file with the given path.
+// Legacy entries only know the base name of the file they were created from.
+func (e BackupEntry) matchesSource(path string) bool {
+	if path == "*" {
+		return true
+	}
+	if e.Legacy {
+		return e.Source == filepath.Base(path)
+	}
+
+	abs, err := fsys.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	return e.Source == abs
+}
+
+// hasTags reports whether the entry carries every one of the given tags.
+func (e BackupEntry) hasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range e.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterBackups returns the entries of path that satisfy opts, sorted as requested.
+func filterBackups(entries []BackupEntry, path string, opts ListOptions) ([]BackupEntry, error) {
+	var result []BackupEntry
+	for _, entry := range entries {
+		if !entry.matchesSource(path) || !entry.hasTags(opts.Tags) {
+			continue
+		}
+		if !opts.Since.IsZero() && entry.CreatedAt.Before(opts.Since) {
+			continue
+		}
+		result = append(result, entry)
+	}
+
+	var less func(a, b BackupEntry) bool
+	switch opts.SortBy {
+	case "", "time":
+		less = func(a, b BackupEntry) bool { return a.CreatedAt.Before(b.CreatedAt) }
+	case "size":
+		less = func(a, b BackupEntry) bool { return a.Size < b.Size }
+	case "source":
+		less = func(a, b BackupEntry) bool { return a.Source < b.Source }
+	case "id":
+		less = func(a, b BackupEntry) bool { return a.ID < b.ID }
+	default:
+		return nil, fmt.Errorf("unknown sort key %q; use time, size, source or id", opts.SortBy)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if opts.Reverse {
+			return less(result[j], result[i])
+		}
+		return less(result[i], result[j])
+	})
+
+	return result, nil
+}
+
+// printBackupTable prints backups as an aligned table.
+func printBackupTable(entries []BackupEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tSIZE\tSHA256\tHOST\tUSER\tTAGS\tSOURCE")
+	for _, entry := range entries {
+		checksum := entry.SHA256
+		if len(checksum) > 12 {
+			checksum = checksum[:12]
+		}
+		if checksum == "" {
+			checksum = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			entry.ID,
+			entry.CreatedAt.Format(time.RFC3339Nano),
+			entry.Size,
+			checksum,
+			orDash(entry.Host),
+			orDash(entry.User),
+			orDash(strings.Join(entry.Tags, ",")),
+			entry.Source,
+		)
+	}
+	w.Flush()
+}
+
+// orDash returns s, or "-" when s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseSince parses a -since or -older-than value given either as a
+// duration ("24h", or "30d" for days) or an RFC 3339 time.
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q; use a duration like 24h or 30d, or an RFC 3339 time", value)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureStdout returns what run prints to standard output.
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+
+	run()
+	os.Stdout = saved
+	w.Close()
+	return <-output
+}
+
+// catalogTestEntries returns backups of /a and /b made a day apart.
+func catalogTestEntries() []BackupEntry {
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []BackupEntry{
+		{ID: "a-old", Source: "/a", Object: "a-old", Size: 30, CreatedAt: day, Tags: []string{"nightly"}},
+		{ID: "b", Source: "/b", Object: "b", Size: 10, CreatedAt: day.Add(24 * time.Hour), Host: "host", User: "user", Tags: []string{"nightly", "docs"}},
+		{ID: "a-new", Source: "/a", Object: "a-new", Size: 20, CreatedAt: day.Add(48 * time.Hour)},
+	}
+}
+
+// entryIDs returns the IDs of entries in order.
+func entryIDs(entries []BackupEntry) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
+
+func TestCatalogSaveAndLoad(t *testing.T) {
+	useMemFileSystem(t)
+
+	empty, err := LoadCatalog()
+	if err != nil || empty.Version != catalogVersion || len(empty.Backups) != 0 {
+		t.Fatalf("missing catalog = %+v, %v", empty, err)
+	}
+
+	catalog := &BackupCatalog{Version: catalogVersion}
+	for _, entry := range catalogTestEntries() {
+		catalog.Add(entry)
+	}
+	if err := catalog.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryIDs(loaded.Backups), entryIDs(catalogTestEntries()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	b := loaded.Backups[1]
+	if b.Source != "/b" || b.Size != 10 || b.Host != "host" || b.User != "user" ||
+		!reflect.DeepEqual(b.Tags, []string{"nightly", "docs"}) || !b.CreatedAt.Equal(catalogTestEntries()[1].CreatedAt) {
+		t.Errorf("loaded %+v", b)
+	}
+
+	if latest, ok := loaded.Latest("/a"); !ok || latest.ID != "a-new" {
+		t.Errorf("Latest = %v, %v", latest.ID, ok)
+	}
+	loaded.Remove("a-new")
+	if latest, _ := loaded.Latest("/a"); latest.ID != "a-old" {
+		t.Errorf("Latest after removal = %v", latest.ID)
+	}
+
+	fsys.WriteFile(filepath.Join(BackupDir, CatalogFile), []byte(`{"version": 99}`), 0644)
+	if _, err := LoadCatalog(); err == nil {
+		t.Error("newer catalog version accepted")
+	}
+}
+
+func TestFilterBackups(t *testing.T) {
+	useMemFileSystem(t)
+	entries := catalogTestEntries()
+	since := entries[1].CreatedAt
+
+	tests := []struct {
+		name string
+		path string
+		opts ListOptions
+		want []string
+	}{
+		{"all by time", "*", ListOptions{}, []string{"a-old", "b", "a-new"}},
+		{"one source", "/a", ListOptions{}, []string{"a-old", "a-new"}},
+		{"relative source", "a", ListOptions{}, []string{"a-old", "a-new"}},
+		{"tag", "*", ListOptions{Tags: []string{"nightly"}}, []string{"a-old", "b"}},
+		{"every tag", "*", ListOptions{Tags: []string{"nightly", "docs"}}, []string{"b"}},
+		{"since", "*", ListOptions{Since: since}, []string{"b", "a-new"}},
+		{"tag and since", "*", ListOptions{Tags: []string{"nightly"}, Since: since}, []string{"b"}},
+		{"by size", "*", ListOptions{SortBy: "size"}, []string{"b", "a-new", "a-old"}},
+		{"by id reversed", "*", ListOptions{SortBy: "id", Reverse: true}, []string{"b", "a-old", "a-new"}},
+		{"by source", "*", ListOptions{SortBy: "source"}, []string{"a-old", "a-new", "b"}},
+		{"none", "/c", ListOptions{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filterBackups(entries, tt.path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := entryIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	if _, err := filterBackups(entries, "*", ListOptions{SortBy: "color"}); err == nil {
+		t.Error("unknown sort key accepted")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"24h", now.Add(-24 * time.Hour)},
+		{"30d", now.AddDate(0, 0, -30)},
+		{"2024-03-01T12:00:00Z", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSince(tt.value)
+		if err != nil {
+			t.Errorf("%s: %v", tt.value, err)
+			continue
+		}
+		if d := got.Sub(tt.want); d < -time.Minute || d > time.Minute {
+			t.Errorf("%s = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	if got, err := parseSince(""); err != nil || !got.IsZero() {
+		t.Errorf("empty value = %v, %v", got, err)
+	}
+	for _, bad := range []string{"yesterday", "3x", "2024-03-01"} {
+		if _, err := parseSince(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestCatalogImportsLegacyBackups(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll(filepath.Join(BackupDir, "sub_backup_20240301120000"), 0755)
+	mem.WriteFile(filepath.Join(BackupDir, "notes.txt_backup_20240301120000"), []byte("old backup"), 0644)
+	mem.WriteFile(filepath.Join(BackupDir, "report_backup_20240302080000"), []byte("cataloged"), 0644)
+	mem.WriteFile(filepath.Join(BackupDir, "report_backup_notatime"), nil, 0644)
+	mem.WriteFile(filepath.Join(BackupDir, "_backup_20240301120000"), nil, 0644)
+
+	catalog := &BackupCatalog{Version: catalogVersion}
+	catalog.Add(BackupEntry{ID: "report", Source: "/report", Object: "report_backup_20240302080000"})
+	if err := catalog.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := catalog.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := entryIDs(entries); !reflect.DeepEqual(ids, []string{"report", "notes.txt_backup_20240301120000"}) {
+		t.Fatalf("entries = %v", ids)
+	}
+	legacy := entries[1]
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	if !legacy.Legacy || legacy.Source != "notes.txt" || legacy.Size != 10 || !legacy.CreatedAt.Equal(created) {
+		t.Errorf("legacy entry = %+v", legacy)
+	}
+
+	// Legacy backups only know the base name of their source.
+	if !legacy.matchesSource("/elsewhere/notes.txt") || legacy.matchesSource("/notes") {
+		t.Error("legacy entry matched by the wrong path")
+	}
+}
+
+func TestNewBackupID(t *testing.T) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newBackupID(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("%s created twice in the same instant", id)
+		}
+		seen[id] = true
+	}
+
+	earlier, _ := newBackupID(now)
+	later, _ := newBackupID(now.Add(time.Nanosecond))
+	if earlier >= later {
+		t.Errorf("%s does not sort before %s", earlier, later)
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	useMemFileSystem(t)
+	catalog := &BackupCatalog{Version: catalogVersion, Backups: catalogTestEntries()}
+	if err := catalog.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureStdout(t, func() {
+		if err := ListBackups("*", ListOptions{Format: "json", Tags: []string{"nightly"}, Reverse: true}); err != nil {
+			t.Error(err)
+		}
+	})
+	var listed []BackupEntry
+	if err := json.Unmarshal([]byte(output), &listed); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, output)
+	}
+	if ids := entryIDs(listed); !reflect.DeepEqual(ids, []string{"b", "a-old"}) {
+		t.Errorf("listed %v", ids)
+	}
+
+	output = captureStdout(t, func() {
+		if err := ListBackups("/c", ListOptions{Format: "json"}); err != nil {
+			t.Error(err)
+		}
+	})
+	if strings.TrimSpace(output) != "[]" {
+		t.Errorf("no backups listed as %q", output)
+	}
+
+	output = captureStdout(t, func() {
+		if err := ListBackups("/b", ListOptions{}); err != nil {
+			t.Error(err)
+		}
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "ID ") {
+		t.Fatalf("table = %q", output)
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 8 || fields[0] != "b" || fields[3] != "-" || fields[6] != "nightly,docs" {
+		t.Errorf("row = %q", lines[2])
+	}
+
+	if err := ListBackups("*", ListOptions{Format: "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultScheduleFile is the schedule read by the daemon when -schedule is not given.
+const DefaultScheduleFile = "gofiler.schedule"
+
+// DaemonStatusFile is the name of the daemon status report inside BackupDir.
+const DaemonStatusFile = "daemon-status.json"
+
+// Run statuses recorded in the daemon status file.
+const (
+	RunOK          = "ok"
+	RunFailed      = "failed"
+	RunInterrupted = "interrupted"
+)
+
+// DaemonJob is one line of the schedule: when to run, how to back up and what.
+type DaemonJob struct {
+	Schedule *CronSchedule
+	Keep     int // backups to retain per file after each run; 0 keeps all
+	Options  BackupOptions
+	Paths    []string
+}
+
+// RunReport describes one run of a job.
+type RunReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status"`
+	BackedUp   []string  `json:"backed_up,omitempty"`
+	Pruned     int       `json:"pruned"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// JobStatus is the state of one job in the daemon status file.
+type JobStatus struct {
+	Schedule string     `json:"schedule"`
+	Paths    []string   `json:"paths"`
+	NextRun  time.Time  `json:"next_run"`
+	LastRun  *RunReport `json:"last_run,omitempty"`
+}
+
+// DaemonStatus is written to the status file whenever the daemon changes state.
+type DaemonStatus struct {
+	PID       int         `json:"pid"`
+	State     string      `json:"state"`
+	StartedAt time.Time   `json:"started_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Jobs      []JobStatus `json:"jobs"`
+}
+
+// ParseSchedule reads a schedule file. Each non-empty line that does not
+// start with '#' has the form
+//
+//	<cron expression> [keep=N] [tags=a,b] [parity=N] <path> [path...]
+//
+// where the cron expression is either five fields or an @-shortcut such as @daily.
+func ParseSchedule(path string) ([]*DaemonJob, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open schedule: %w", err)
+	}
+	defer file.Close()
+
+	var jobs []*DaemonJob
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		job, err := parseScheduleLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("schedule %s contains no jobs", path)
+	}
+
+	return jobs, nil
+}
+
+// parseScheduleLine parses a single schedule entry.
+func parseScheduleLine(line string) (*DaemonJob, error) {
+	fields := strings.Fields(line)
+
+	cronLen := 5
+	if strings.HasPrefix(fields[0], "@") {
+		cronLen = 1
+	}
+	if len(fields) <= cronLen {
+		return nil, fmt.Errorf("expected a cron expression followed by at least one path")
+	}
+
+	schedule, err := ParseCron(strings.Join(fields[:cronLen], " "))
+	if err != nil {
+		return nil, err
+	}
+
+	job := &DaemonJob{Schedule: schedule}
+	for _, field := range fields[cronLen:] {
+		key, value, ok := strings.Cut(field, "=")
+		switch {
+		case ok && key == "keep":
+			job.Keep, err = strconv.Atoi(value)
+		case ok && key == "parity":
+			job.Options.ParityShards, err = strconv.Atoi(value)
+		case ok && key == "tags":
+			job.Options.Tags = splitList(value)
+		default:
+			job.Paths = append(job.Paths, field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %q: %w", field, err)
+		}
+	}
+	if len(job.Paths) == 0 {
+		return nil, fmt.Errorf("no paths to back up")
+	}
+
+	return job, nil
+}
+
+// daemon runs scheduled backups and keeps the status file up to date.
+type daemon struct {
+	jobs       []*DaemonJob
+	statusPath string
+	status     DaemonStatus
+}
+
+// RunDaemon implements the "daemon" command. It runs until it receives
+// SIGTERM or an interrupt; a backup in progress at that point is allowed to
+// finish, the remaining files of the run are skipped, and the run is
+// recorded as interrupted.
+func RunDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	schedulePtr := flags.String("schedule", DefaultScheduleFile, "Schedule file listing cron expressions and paths to back up")
+	statusPtr := flags.String("status", filepath.Join(BackupDir, DaemonStatusFile), "File the daemon writes its status and last-run report to")
+	rootPtr := flags.String("root", "", "Confine every path, including the schedule, to a directory")
+	flags.Parse(args)
+
+	if *rootPtr != "" {
+		sandbox, err := NewSandboxFileSystem(*rootPtr, fsys)
+		if err != nil {
+			return err
+		}
+		fsys = sandbox
+	}
+
+	jobs, err := ParseSchedule(*schedulePtr)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	d := &daemon{
+		jobs:       jobs,
+		statusPath: *statusPtr,
+		status: DaemonStatus{
+			PID:       os.Getpid(),
+			StartedAt: time.Now(),
+			Jobs:      make([]JobStatus, len(jobs)),
+		},
+	}
+
+	return d.run(ctx)
+}
+
+// run waits for the next due job, runs it and repeats until ctx is cancelled.
+func (d *daemon) run(ctx context.Context) error {
+	now := time.Now()
+	for i, job := range d.jobs {
+		d.status.Jobs[i] = JobStatus{
+			Schedule: job.Schedule.String(),
+			Paths:    job.Paths,
+			NextRun:  job.Schedule.Next(now),
+		}
+	}
+	log.Printf("GoFiler daemon started with %d jobs", len(d.jobs))
+
+	for {
+		next := d.nextRun()
+		if next.IsZero() {
+			return fmt.Errorf("no scheduled job will ever run")
+		}
+		if err := d.writeStatus("idle"); err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("GoFiler daemon stopping")
+			return d.writeStatus("stopped")
+		case <-timer.C:
+		}
+
+		for i, job := range d.jobs {
+			if due := d.status.Jobs[i].NextRun; due.IsZero() || due.After(time.Now()) {
+				continue
+			}
+
+			if err := d.writeStatus("running"); err != nil {
+				return err
+			}
+			report := d.runJob(ctx, job)
+			d.status.Jobs[i].LastRun = report
+			d.status.Jobs[i].NextRun = job.Schedule.Next(time.Now())
+
+			if report.Status == RunInterrupted {
+				log.Printf("GoFiler daemon stopping after interrupted run")
+				return d.writeStatus("stopped")
+			}
+		}
+	}
+}
+
+// nextRun returns the earliest time any job is due.
+func (d *daemon) nextRun() time.Time {
+	var next time.Time
+	for _, job := range d.status.Jobs {
+		if job.NextRun.IsZero() {
+			continue
+		}
+		if next.IsZero() || job.NextRun.Before(next) {
+			next = job.NextRun
+		}
+	}
+
+	return next
+}
+
+// runJob backs up every file of the job and then applies its retention policy.
+func (d *daemon) runJob(ctx context.Context, job *DaemonJob) *RunReport {
+	report := &RunReport{StartedAt: time.Now(), Status: RunOK}
+	log.Printf("Running backup job %q", job.Schedule)
+
+	files, errs := expandBackupPaths(job.Paths)
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			report.Status = RunInterrupted
+			break
+		}
+
+		if err := BackupFile(file, job.Options); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.BackedUp = append(report.BackedUp, file)
+
+		if job.Keep > 0 {
+			removed, err := PruneBackups(file, job.Keep)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+			report.Pruned += len(removed)
+		}
+	}
+
+	if report.Status == RunOK && len(report.Errors) > 0 {
+		report.Status = RunFailed
+	}
+	report.FinishedAt = time.Now()
+	log.Printf("Backup job %q %s: %d backed up, %d pruned, %d errors",
+		job.Schedule, report.Status, len(report.BackedUp), report.Pruned, len(report.Errors))
+
+	return report
+}
+
+// expandBackupPaths resolves the job paths into regular files, walking
+// directories recursively. The backup directory itself is never included.
+func expandBackupPaths(paths []string) ([]string, []error) {
+	backupDir, _ := fsys.Abs(BackupDir)
+
+	var files []string
+	var errs []error
+	for _, path := range paths {
+		err := walkDir(fsys, path, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			if abs, _ := fsys.Abs(p); abs == backupDir {
+				return filepath.SkipDir
+			}
+			if entry.Type().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, filepath.SkipDir) {
+			errs = append(errs, err)
+		}
+	}
+
+	return files, errs
+}
+
+// writeStatus records the daemon state in the status file.
+func (d *daemon) writeStatus(state string) error {
+	d.status.State = state
+	d.status.UpdatedAt = time.Now()
+
+	if err := fsys.MkdirAll(filepath.Dir(d.statusPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create status directory: %w", err)
+	}
+	if err := writeJSONFile(d.statusPath, d.status); err != nil {
+		return fmt.Errorf("failed to write daemon status: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestParseSchedule(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.WriteFile("/schedule", []byte(`
+# nightly documents
+0 2 * * * keep=7 tags=nightly,docs /docs /notes.txt
+@hourly parity=2 /db
+`), 0644)
+
+	jobs, err := ParseSchedule("/schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("parsed %d jobs", len(jobs))
+	}
+
+	nightly := jobs[0]
+	if nightly.Schedule.String() != "0 2 * * *" || nightly.Keep != 7 ||
+		fmt.Sprint(nightly.Options.Tags) != "[nightly docs]" || fmt.Sprint(nightly.Paths) != "[/docs /notes.txt]" {
+		t.Errorf("nightly job = %+v", nightly)
+	}
+	if hourly := jobs[1]; hourly.Schedule.String() != "@hourly" || hourly.Options.ParityShards != 2 || fmt.Sprint(hourly.Paths) != "[/db]" {
+		t.Errorf("hourly job = %+v", hourly)
+	}
+
+	for _, bad := range []string{"", "# only a comment\n", "0 2 * * *\n", "0 2 * * * keep=x /a\n", "61 2 * * * /a\n"} {
+		mem.WriteFile("/bad", []byte(bad), 0644)
+		if _, err := ParseSchedule("/bad"); err == nil {
+			t.Errorf("ParseSchedule accepted %q", bad)
+		}
+	}
+}
+
+func TestDaemonRunJob(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/data/sub", 0755)
+	mem.WriteFile("/data/a", []byte("a"), 0644)
+	mem.WriteFile("/data/sub/b", []byte("b"), 0644)
+
+	schedule, _ := ParseCron("@daily")
+	job := &DaemonJob{Schedule: schedule, Keep: 2, Paths: []string{"/data", "/missing"}}
+	d := &daemon{}
+
+	var report *RunReport
+	for i := 0; i < 3; i++ {
+		report = d.runJob(context.Background(), job)
+	}
+	// The missing path is reported, but the other files are still backed up.
+	if report.Status != RunFailed || len(report.Errors) != 1 || len(report.BackedUp) != 2 || report.Pruned != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Backups) != 4 {
+		t.Errorf("catalog holds %d backups, want 2 of each file", len(catalog.Backups))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := d.runJob(ctx, job); report.Status != RunInterrupted || len(report.BackedUp) != 0 {
+		t.Errorf("cancelled run = %+v", report)
+	}
+}
+
+func TestDaemonWritesStatusWhenStopped(t *testing.T) {
+	useMemFileSystem(t)
+	schedule, _ := ParseCron("@hourly")
+	d := &daemon{
+		jobs:       []*DaemonJob{{Schedule: schedule, Paths: []string{"/data"}}},
+		statusPath: filepath.Join(BackupDir, DaemonStatusFile),
+		status:     DaemonStatus{Jobs: make([]JobStatus, 1)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fsys.ReadFile(d.statusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status DaemonStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "stopped" || len(status.Jobs) != 1 || status.Jobs[0].NextRun.IsZero() {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestConcurrentBackupsKeepEveryEntry(t *testing.T) {
+	mem := useMemFileSystem(t)
+	const n = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		mem.WriteFile(name, []byte(name), 0644)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- BackupFile(name, BackupOptions{})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Backups) != n {
+		t.Errorf("catalog holds %d of %d backups", len(catalog.Backups), n)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// ParitySuffix is appended to a backup object name to form the name of its parity file.
+const ParitySuffix = ".parity"
+
+// DefaultDataShards is the number of data shards per stripe when -dataShards is not given.
+const DefaultDataShards = 10
+
+// maxShardSize caps the size of a single shard, and so the memory used per stripe.
+const maxShardSize = 64 * 1024
+
+// crcTable is used to checksum individual shards.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ParityInfo describes the Reed-Solomon parity stored for a backup object.
+//
+// The object is split into stripes of DataShards*ShardSize bytes. For every
+// stripe the parity file holds a record with the CRC-32C of each data and
+// parity shard followed by the parity shards themselves, so damaged shards
+// can be located and rebuilt from the surviving ones.
+type ParityInfo struct {
+	Object       string `json:"object"`
+	ObjectSize   int64  `json:"object_size"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	ShardSize    int    `json:"shard_size"`
+}
+
+// stripeSize returns the number of object bytes covered by one stripe.
+func (p ParityInfo) stripeSize() int64 {
+	return int64(p.DataShards) * int64(p.ShardSize)
+}
+
+// stripes returns the number of stripes covering the object.
+func (p ParityInfo) stripes() int64 {
+	return (p.ObjectSize + p.stripeSize() - 1) / p.stripeSize()
+}
+
+// recordSize returns the size of one stripe record in the parity file.
+func (p ParityInfo) recordSize() int64 {
+	return int64(p.DataShards+p.ParityShards)*4 + int64(p.ParityShards)*int64(p.ShardSize)
+}
+
+// ParityReport counts the shards rebuilt by RepairWithParity.
+type ParityReport struct {
+	DataShards   int
+	ParityShards int
+	Resized      bool // the object had trailing bytes that were cut off
+}
+
+// Repaired reports whether anything was rebuilt.
+func (r ParityReport) Repaired() bool {
+	return r.DataShards > 0 || r.ParityShards > 0 || r.Resized
+}
+
+// WriteParity computes Reed-Solomon parity for the object at objectPath and
+// writes it to parityPath.
+func WriteParity(objectPath, parityPath string, dataShards, parityShards int) (*ParityInfo, error) {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid parity configuration: %d data and %d parity shards", dataShards, parityShards)
+	}
+
+	object, err := fsys.Open(objectPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup object: %w", err)
+	}
+	defer object.Close()
+
+	stat, err := object.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup object: %w", err)
+	}
+
+	shardSize := int((stat.Size() + int64(dataShards) - 1) / int64(dataShards))
+	if shardSize > maxShardSize {
+		shardSize = maxShardSize
+	}
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	info := &ParityInfo{
+		ObjectSize:   stat.Size(),
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		ShardSize:    shardSize,
+	}
+
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parity encoder: %w", err)
+	}
+
+	err = writeFileAtomic(parityPath, 0644, func(w io.Writer) error {
+		for stripe := int64(0); stripe < info.stripes(); stripe++ {
+			shards, err := readStripe(object, *info, stripe)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(shards); err != nil {
+				return fmt.Errorf("failed to compute parity: %w", err)
+			}
+			if _, err := w.Write(encodeRecord(*info, shards)); err != nil {
+				return fmt.Errorf("failed to write parity file: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// RepairWithParity checks every stripe of the object against its parity
+// record and rebuilds damaged data or parity shards in place.
+func RepairWithParity(objectPath, parityPath string, info ParityInfo) (ParityReport, error) {
+	var report ParityReport
+
+	enc, err := reedsolomon.New(info.DataShards, info.ParityShards)
+	if err != nil {
+		return report, fmt.Errorf("failed to create parity encoder: %w", err)
+	}
+
+	object, err := fsys.OpenFile(objectPath, os.O_RDWR, 0)
+	if err != nil {
+		return report, fmt.Errorf("failed to open backup object: %w", err)
+	}
+	defer object.Close()
+
+	parity, err := fsys.OpenFile(parityPath, os.O_RDWR, 0)
+	if err != nil {
+		return report, fmt.Errorf("failed to open parity file: %w", err)
+	}
+	defer parity.Close()
+
+	if stat, err := object.Stat(); err == nil && stat.Size() > info.ObjectSize {
+		report.Resized = true
+	}
+
+	for stripe := int64(0); stripe < info.stripes(); stripe++ {
+		shards, err := readStripe(object, info, stripe)
+		if err != nil {
+			return report, err
+		}
+
+		record := make([]byte, info.recordSize())
+		n, err := parity.ReadAt(record, stripe*info.recordSize())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, fmt.Errorf("failed to read parity file: %w", err)
+		}
+		sums, parityShards := decodeRecord(info, record, n)
+		copy(shards[info.DataShards:], parityShards)
+
+		var badData, badParity []int
+		for i, shard := range shards {
+			if shard != nil && crc32.Checksum(shard, crcTable) == sums[i] {
+				continue
+			}
+			shards[i] = nil
+			if i < info.DataShards {
+				badData = append(badData, i)
+			} else {
+				badParity = append(badParity, i)
+			}
+		}
+		if len(badData) == 0 && len(badParity) == 0 {
+			continue
+		}
+
+		if err := enc.Reconstruct(shards); err != nil {
+			return report, fmt.Errorf("stripe %d cannot be repaired: %d of %d shards damaged: %w",
+				stripe, len(badData)+len(badParity), info.DataShards+info.ParityShards, err)
+		}
+
+		for _, i := range badData {
+			offset := stripe*info.stripeSize() + int64(i)*int64(info.ShardSize)
+			shard := shards[i]
+			if end := offset + int64(len(shard)); end > info.ObjectSize {
+				shard = shard[:max64(info.ObjectSize-offset, 0)]
+			}
+			if _, err := object.WriteAt(shard, offset); err != nil {
+				return report, fmt.Errorf("failed to write repaired data: %w", err)
+			}
+		}
+		if _, err := parity.WriteAt(encodeRecord(info, shards), stripe*info.recordSize()); err != nil {
+			return report, fmt.Errorf("failed to write repaired parity: %w", err)
+		}
+
+		report.DataShards += len(badData)
+		report.ParityShards += len(badParity)
+	}
+
+	if report.Repaired() {
+		if err := object.Truncate(info.ObjectSize); err != nil {
+			return report, fmt.Errorf("failed to restore backup object size: %w", err)
+		}
+		if err := object.Sync(); err != nil {
+			return report, fmt.Errorf("failed to sync backup object: %w", err)
+		}
+		if err := parity.Sync(); err != nil {
+			return report, fmt.Errorf("failed to sync parity file: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+// readStripe reads one stripe of the object into data shards followed by
+// empty parity shards. Bytes past the end of the object are zero padding.
+// A shard that cannot be read in full because the object was truncated is
+// returned as nil so it is treated as damaged.
+func readStripe(object FileHandle, info ParityInfo, stripe int64) ([][]byte, error) {
+	shards := make([][]byte, info.DataShards+info.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, info.ShardSize)
+	}
+
+	for i := 0; i < info.DataShards; i++ {
+		offset := stripe*info.stripeSize() + int64(i)*int64(info.ShardSize)
+		want := info.ObjectSize - offset
+		if want <= 0 {
+			continue
+		}
+		if want > int64(info.ShardSize) {
+			want = int64(info.ShardSize)
+		}
+
+		n, err := object.ReadAt(shards[i][:want], offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read backup object: %w", err)
+		}
+		if int64(n) < want {
+			shards[i] = nil
+		}
+	}
+
+	return shards, nil
+}
+
+// encodeRecord serialises the shard checksums and parity shards of a stripe.
+func encodeRecord(info ParityInfo, shards [][]byte) []byte {
+	record := make([]byte, 0, info.recordSize())
+	for _, shard := range shards {
+		record = binary.BigEndian.AppendUint32(record, crc32.Checksum(shard, crcTable))
+	}
+	for _, shard := range shards[info.DataShards:] {
+		record = append(record, shard...)
+	}
+
+	return record
+}
+
+// decodeRecord splits a stripe record into shard checksums and parity shards.
+// Only the first n bytes of record were read; parity shards that are cut
+// short are returned as nil.
+func decodeRecord(info ParityInfo, record []byte, n int) ([]uint32, [][]byte) {
+	total := info.DataShards + info.ParityShards
+	sums := make([]uint32, total)
+	for i := range sums {
+		if (i+1)*4 <= n {
+			sums[i] = binary.BigEndian.Uint32(record[i*4:])
+		}
+	}
+
+	shards := make([][]byte, info.ParityShards)
+	for i := range shards {
+		start := total*4 + i*info.ShardSize
+		if start+info.ShardSize <= n {
+			shards[i] = record[start : start+info.ShardSize]
+		}
+	}
+
+	return sums, shards
+}
+
+// max64 returns the larger of a and b.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
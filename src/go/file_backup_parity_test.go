@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRandomFile writes size pseudo-random bytes to a new file in dir.
+func writeRandomFile(t *testing.T, dir string, size int) (string, []byte) {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	path := filepath.Join(dir, "object")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
+
+// flipBytes inverts the bytes of the file at the given offsets.
+func flipBytes(t *testing.T, path string, offsets ...int64) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, offset := range offsets {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if _, err := f.WriteAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRepairWithParityRebuildsFlippedBytes(t *testing.T) {
+	dir := t.TempDir()
+	object, want := writeRandomFile(t, dir, 3*maxShardSize*DefaultDataShards+12345)
+	parity := object + ParitySuffix
+
+	info, err := WriteParity(object, parity, DefaultDataShards, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage two shards in the first stripe, one in the last (partial) stripe
+	// and one parity shard.
+	stripe := info.stripeSize()
+	flipBytes(t, object, 0, int64(info.ShardSize)+7, 3*stripe+100)
+	flipBytes(t, parity, info.recordSize()+int64(info.DataShards+info.ParityShards)*4+5)
+
+	report, err := RepairWithParity(object, parity, *info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DataShards != 3 || report.ParityShards != 1 {
+		t.Fatalf("repaired %d data and %d parity shards, want 3 and 1", report.DataShards, report.ParityShards)
+	}
+
+	got, err := os.ReadFile(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("object content differs after repair")
+	}
+
+	report, err = RepairWithParity(object, parity, *info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired() {
+		t.Fatalf("second scrub repaired %+v, want nothing", report)
+	}
+}
+
+func TestRepairWithParityRestoresTruncatedObject(t *testing.T) {
+	dir := t.TempDir()
+	object, want := writeRandomFile(t, dir, 5000)
+	parity := object + ParitySuffix
+
+	info, err := WriteParity(object, parity, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(object, int64(len(want)-int(info.ShardSize)/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RepairWithParity(object, parity, *info); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("object content differs after repair")
+	}
+}
+
+func TestRepairWithParityFailsWhenTooManyShardsAreDamaged(t *testing.T) {
+	dir := t.TempDir()
+	object, _ := writeRandomFile(t, dir, 10000)
+	parity := object + ParitySuffix
+
+	info, err := WriteParity(object, parity, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipBytes(t, object, 0, int64(info.ShardSize))
+
+	if _, err := RepairWithParity(object, parity, *info); err == nil {
+		t.Fatal("expected repair to fail with two damaged shards and one parity shard")
+	}
+}
+
+func TestVerifyBackupsRepairsCorruptedBackup(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	source, want := writeRandomFile(t, dir, 200000)
+	if err := BackupFile(source, BackupOptions{ParityShards: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := catalog.Backups[0]
+	if entry.Parity == nil {
+		t.Fatal("backup was stored without parity")
+	}
+	flipBytes(t, filepath.Join(BackupDir, entry.Object), 1, 50000, 150000)
+
+	report, err := ScrubBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := report.Objects[0].Status; status != VerifyRepaired {
+		t.Fatalf("status = %s, want %s", status, VerifyRepaired)
+	}
+
+	got, err := os.ReadFile(filepath.Join(BackupDir, entry.Object))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("backup content differs after repair")
+	}
+
+	if err := VerifyBackups(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		name, expr, from, want string
+	}{
+		{"every minute", "* * * * *", "2024-01-01 10:07", "2024-01-01 10:08"},
+		{"alias", "@daily", "2024-01-01 10:07", "2024-01-02 00:00"},
+		{"range start", "0 9-17 * * *", "2024-01-01 08:30", "2024-01-01 09:00"},
+		{"range end", "0 9-17 * * *", "2024-01-01 17:30", "2024-01-02 09:00"},
+		{"step", "*/15 * * * *", "2024-01-01 10:07", "2024-01-01 10:15"},
+		{"step from value", "5/20 * * * *", "2024-01-01 10:26", "2024-01-01 10:45"},
+		{"step over range", "0 8-18/5 * * *", "2024-01-01 13:01", "2024-01-01 18:00"},
+		{"list", "0 0 1,15 * *", "2024-01-02 00:00", "2024-01-15 00:00"},
+		{"list of ranges", "30 1-2,22-23 * * *", "2024-01-01 03:00", "2024-01-01 22:30"},
+		{"day of week only", "0 0 * * 5", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"day of month only", "0 0 13 * *", "2024-01-01 00:00", "2024-01-13 00:00"},
+		// When both day fields are restricted, either one matching is enough.
+		{"day of month or week", "0 0 13 * 5", "2024-01-06 00:00", "2024-01-12 00:00"},
+		{"day of month or week", "0 0 13 * 5", "2024-01-12 00:00", "2024-01-13 00:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"month rollover", "0 0 1 * *", "2024-01-31 23:59", "2024-02-01 00:00"},
+		{"year rollover", "0 0 1 * *", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"skips short months", "0 0 31 * *", "2024-01-31 12:00", "2024-03-31 00:00"},
+		{"leap day", "0 0 29 2 *", "2025-03-01 00:00", "2028-02-29 00:00"},
+		{"month list", "0 0 1 3,9 *", "2024-03-01 00:00", "2024-09-01 00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Next(at(tt.from)); !got.Equal(at(tt.want)) {
+				t.Errorf("Next(%s) of %q = %v, want %s", tt.from, tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNeverMatching(t *testing.T) {
+	schedule, err := ParseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(time.Now()); !next.IsZero() {
+		t.Errorf("February 30 scheduled at %v", next)
+	}
+}
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1- * * * *",
+		"@often",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Verification statuses reported by VerifyBackups.
+const (
+	VerifyOK       = "ok"
+	VerifyRepaired = "repaired"
+	VerifyCorrupt  = "corrupt"
+	VerifyMissing  = "missing"
+	VerifySkipped  = "skipped"
+)
+
+// ObjectReport is the verification result of one stored backup object.
+// Several catalog entries may share an object, so a bad object lists every
+// backup it affects.
+type ObjectReport struct {
+	Object   string
+	Status   string
+	Expected string
+	Actual   string
+	Repair   *ParityReport
+	Backups  []BackupEntry
+}
+
+// VerifyReport summarises a scrub of the backup store.
+type VerifyReport struct {
+	Objects []ObjectReport
+}
+
+// Failed returns the objects that are corrupt or missing.
+func (r *VerifyReport) Failed() []ObjectReport {
+	var failed []ObjectReport
+	for _, object := range r.Objects {
+		if object.Status == VerifyCorrupt || object.Status == VerifyMissing {
+			failed = append(failed, object)
+		}
+	}
+
+	return failed
+}
+
+// ScrubBackups re-hashes every stored backup object and compares it with the
+// checksum recorded in the catalog at backup time.
+func ScrubBackups() (*VerifyReport, error) {
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := catalog.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	byObject := make(map[string][]BackupEntry)
+	var objects []string
+	for _, entry := range entries {
+		if _, ok := byObject[entry.Object]; !ok {
+			objects = append(objects, entry.Object)
+		}
+		byObject[entry.Object] = append(byObject[entry.Object], entry)
+	}
+	sort.Strings(objects)
+
+	report := &VerifyReport{}
+	for _, object := range objects {
+		report.Objects = append(report.Objects, verifyObject(object, byObject[object]))
+	}
+
+	return report, nil
+}
+
+// verifyObject checks a single object against the checksum of the backups referencing it.
+func verifyObject(object string, backups []BackupEntry) ObjectReport {
+	result := ObjectReport{Object: object, Backups: backups}
+
+	var parity *ParityInfo
+	for _, entry := range backups {
+		if entry.SHA256 != "" && result.Expected == "" {
+			result.Expected = entry.SHA256
+		}
+		if entry.Parity != nil && parity == nil {
+			parity = entry.Parity
+		}
+	}
+	if result.Expected == "" {
+		result.Status = VerifySkipped
+		return result
+	}
+
+	objectPath := filepath.Join(BackupDir, object)
+
+	// Scrub the parity first so damaged blocks are rebuilt before the object is re-hashed.
+	if parity != nil {
+		repair, err := RepairWithParity(objectPath, filepath.Join(BackupDir, parity.Object), *parity)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			result.Status = VerifyCorrupt
+			result.Actual = err.Error()
+			return result
+		}
+		if err == nil && repair.Repaired() {
+			result.Repair = &repair
+		}
+	}
+
+	actual, err := CalculateChecksum(objectPath)
+	if errors.Is(err, os.ErrNotExist) {
+		result.Status = VerifyMissing
+		return result
+	}
+	if err != nil {
+		result.Status = VerifyCorrupt
+		result.Actual = err.Error()
+		return result
+	}
+
+	result.Actual = actual
+	if actual != result.Expected {
+		result.Status = VerifyCorrupt
+		return result
+	}
+
+	result.Status = VerifyOK
+	if result.Repair != nil {
+		result.Status = VerifyRepaired
+	}
+	return result
+}
+
+// VerifyBackups scrubs the backup store, prints a report and returns an
+// error when any backup is corrupt or missing.
+func VerifyBackups() error {
+	report, err := ScrubBackups()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, object := range report.Objects {
+		counts[object.Status]++
+		switch object.Status {
+		case VerifyCorrupt:
+			fmt.Printf("CORRUPT %s: expected sha256 %s, got %s\n", object.Object, object.Expected, object.Actual)
+		case VerifyMissing:
+			fmt.Printf("MISSING %s\n", object.Object)
+		case VerifyRepaired:
+			fmt.Printf("REPAIRED %s: rebuilt %d data and %d parity shards\n",
+				object.Object, object.Repair.DataShards, object.Repair.ParityShards)
+		default:
+			continue
+		}
+		fmt.Printf("  affected backups: %s\n", describeBackups(object.Backups))
+	}
+
+	fmt.Printf("Verified %d backup objects: %d ok, %d repaired, %d corrupt, %d missing, %d skipped (no recorded checksum)\n",
+		len(report.Objects), counts[VerifyOK], counts[VerifyRepaired], counts[VerifyCorrupt], counts[VerifyMissing], counts[VerifySkipped])
+
+	if failed := report.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d backup objects failed verification", len(failed))
+	}
+
+	return nil
+}
+
+// describeBackups formats backup IDs with their sources for a report line.
+func describeBackups(backups []BackupEntry) string {
+	var parts []string
+	for _, entry := range backups {
+		parts = append(parts, fmt.Sprintf("%s (%s)", entry.ID, entry.Source))
+	}
+
+	return strings.Join(parts, ", ")
+}
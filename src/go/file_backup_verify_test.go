@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// backupForScrub backs up content as the file name and returns its entry.
+func backupForScrub(t *testing.T, mem *MemFileSystem, name string, content []byte, opts BackupOptions) BackupEntry {
+	t.Helper()
+
+	mem.WriteFile(name, content, 0644)
+	if err := BackupFile(name, opts); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := catalog.Latest(name)
+	return entry
+}
+
+// flipObjectBytes inverts the bytes of a stored backup object at the given offsets.
+func flipObjectBytes(t *testing.T, mem *MemFileSystem, object string, offsets ...int) {
+	t.Helper()
+
+	path := filepath.Join(BackupDir, object)
+	data, err := mem.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range offsets {
+		data[offset] ^= 0xff
+	}
+	mem.WriteFile(path, data, 0644)
+}
+
+// scrubReports scrubs the backup store and returns the reports by object.
+func scrubReports(t *testing.T) map[string]ObjectReport {
+	t.Helper()
+
+	report, err := ScrubBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := make(map[string]ObjectReport)
+	for _, object := range report.Objects {
+		reports[object.Object] = object
+	}
+
+	return reports
+}
+
+func TestScrubBackupsStatuses(t *testing.T) {
+	mem := useMemFileSystem(t)
+	ok := backupForScrub(t, mem, "/ok", []byte("intact"), BackupOptions{})
+	corrupt := backupForScrub(t, mem, "/corrupt", []byte("damaged"), BackupOptions{})
+	missing := backupForScrub(t, mem, "/missing", []byte("deleted"), BackupOptions{})
+	mem.WriteFile(filepath.Join(BackupDir, "legacy_backup_20240301120000"), []byte("no checksum"), 0644)
+
+	flipObjectBytes(t, mem, corrupt.Object, 0)
+	mem.Remove(filepath.Join(BackupDir, missing.Object))
+
+	reports := scrubReports(t)
+	want := map[string]string{
+		ok.Object:                      VerifyOK,
+		corrupt.Object:                 VerifyCorrupt,
+		missing.Object:                 VerifyMissing,
+		"legacy_backup_20240301120000": VerifySkipped,
+	}
+	for object, status := range want {
+		if got := reports[object].Status; got != status {
+			t.Errorf("%s: status = %q, want %q", object, got, status)
+		}
+	}
+	if len(reports) != len(want) {
+		t.Errorf("%d objects scrubbed, want %d", len(reports), len(want))
+	}
+
+	if r := reports[corrupt.Object]; r.Expected != corrupt.SHA256 || r.Actual == "" || r.Actual == r.Expected {
+		t.Errorf("corrupt object: expected %q, actual %q", r.Expected, r.Actual)
+	}
+	if err := VerifyBackups(); err == nil {
+		t.Error("verification passed with a corrupt and a missing backup")
+	}
+}
+
+func TestScrubBackupsDamageBeyondRepair(t *testing.T) {
+	mem := useMemFileSystem(t)
+	entry := backupForScrub(t, mem, "/file", bytes.Repeat([]byte("parity "), 2000), BackupOptions{DataShards: 4, ParityShards: 1})
+	before, _ := mem.ReadFile(filepath.Join(BackupDir, entry.Object))
+
+	// Two damaged data shards of a stripe are more than one parity shard rebuilds.
+	flipObjectBytes(t, mem, entry.Object, 0, int(entry.Parity.ShardSize))
+
+	r := scrubReports(t)[entry.Object]
+	if r.Status != VerifyCorrupt || r.Actual == "" || r.Repair != nil {
+		t.Errorf("report = %+v", r)
+	}
+	after, _ := mem.ReadFile(filepath.Join(BackupDir, entry.Object))
+	if bytes.Equal(after, before) {
+		t.Error("object repaired without enough parity")
+	}
+}
+
+func TestScrubBackupsListsBackupsSharingObject(t *testing.T) {
+	mem := useMemFileSystem(t)
+	shared := backupForScrub(t, mem, "/first", []byte("same content"), BackupOptions{})
+	other := backupForScrub(t, mem, "/other", []byte("other content"), BackupOptions{})
+
+	// A second backup of the same content stores no object of its own, as
+	// imported backups do.
+	catalog, _ := LoadCatalog()
+	second := shared
+	second.ID, second.Source = "second", "/second"
+	catalog.Add(second)
+	if err := catalog.Save(); err != nil {
+		t.Fatal(err)
+	}
+	flipObjectBytes(t, mem, shared.Object, 3)
+
+	reports := scrubReports(t)
+	if len(reports) != 2 {
+		t.Fatalf("%d objects scrubbed, want 2", len(reports))
+	}
+	r := reports[shared.Object]
+	if r.Status != VerifyCorrupt {
+		t.Errorf("shared object: status = %q", r.Status)
+	}
+	if ids := entryIDs(r.Backups); !reflect.DeepEqual(ids, []string{shared.ID, "second"}) {
+		t.Errorf("affected backups = %v", ids)
+	}
+	if got := entryIDs(reports[other.Object].Backups); !reflect.DeepEqual(got, []string{other.ID}) {
+		t.Errorf("backups of the intact object = %v", got)
+	}
+
+	failed := (&VerifyReport{Objects: []ObjectReport{reports[shared.Object], reports[other.Object]}}).Failed()
+	if len(failed) != 1 || failed[0].Object != shared.Object {
+		t.Errorf("failed = %v", failed)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"sync"
 )
 
@@ -57,7 +56,8 @@ func (f *File) Save() error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	err := os.WriteFile(f.Name, []byte(f.Content), 0644)
+	// Replace the file atomically, so a failed save keeps the previous content.
+	err := writeDataAtomic(f.Name, []byte(f.Content), filePerm(f.Name, 0644))
 	if err != nil {
 		return fmt.Errorf("failed to save the file: %w", err)
 	}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression codecs available in addition to CompressionNone and CompressionGzip.
+const (
+	CompressionZlib = "zlib"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+)
+
+// DefaultLevel selects the default level of a codec.
+const DefaultLevel = 0
+
+// compressedMagic starts the output of CompressWith; its last byte is the
+// format version. It is followed by the length of the codec name, the name
+// itself and the compressed data. Compress writes plain gzip without it.
+const compressedMagic = "GFZ\x01"
+
+// autoSampleSize is the amount of input examined to decide whether it is
+// already compressed.
+const autoSampleSize = 64 * 1024
+
+// autoEntropyThreshold is the Shannon entropy, in bits per byte, above which
+// input is considered not worth compressing.
+const autoEntropyThreshold = 7.5
+
+// Codec describes a compression algorithm. Levels run from MinLevel to
+// MaxLevel; DefaultLevel selects the codec's own default.
+type Codec struct {
+	Name     string
+	MinLevel int
+	MaxLevel int
+
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// CompressionOptions selects how data is compressed before it is encrypted.
+// With Auto set, input that already looks compressed is stored with
+// CompressionNone instead.
+type CompressionOptions struct {
+	Codec string
+	Level int
+	Auto  bool
+}
+
+var codecs = map[string]*Codec{}
+
+// RegisterCodec makes a codec available by name.
+func RegisterCodec(codec *Codec) {
+	codecs[codec.Name] = codec
+}
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (*Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", name)
+	}
+
+	return codec, nil
+}
+
+// CodecNames returns the names of all registered codecs.
+func CodecNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewWriter returns a writer compressing into w at the given level.
+func (c *Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if err := c.CheckLevel(level); err != nil {
+		return nil, err
+	}
+
+	return c.newWriter(w, level)
+}
+
+// CheckLevel reports whether level is valid for the codec. Codecs without
+// levels accept any level.
+func (c *Codec) CheckLevel(level int) error {
+	if c.MaxLevel == 0 || level == DefaultLevel {
+		return nil
+	}
+	if level < c.MinLevel || level > c.MaxLevel {
+		return fmt.Errorf("invalid %s level %d: must be between %d and %d", c.Name, level, c.MinLevel, c.MaxLevel)
+	}
+
+	return nil
+}
+
+// NewReader returns a reader decompressing r.
+func (c *Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return c.newReader(r)
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing.
+func (nopWriteCloser) Close() error { return nil }
+
+// xzDictCaps maps xz levels to dictionary sizes, following the presets of xz(1).
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name: CompressionNone,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:     CompressionGzip,
+		MinLevel: gzip.BestSpeed,
+		MaxLevel: gzip.BestCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == DefaultLevel {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:     CompressionZlib,
+		MinLevel: zlib.BestSpeed,
+		MaxLevel: zlib.BestCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == DefaultLevel {
+				level = zlib.DefaultCompression
+			}
+			return zlib.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:     CompressionZstd,
+		MinLevel: 1,
+		MaxLevel: 22,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			encoderLevel := zstd.SpeedDefault
+			if level != DefaultLevel {
+				encoderLevel = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:     CompressionXz,
+		MinLevel: 1,
+		MaxLevel: len(xzDictCaps) - 1,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == DefaultLevel {
+				level = 6
+			}
+			return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		},
+	})
+}
+
+// CompressWith compresses data with the named codec and level. Unlike
+// Compress, the output is not plain compressed data: the codec is recorded
+// after compressedMagic at the start, so Decompress can tell which one to use.
+func CompressWith(data []byte, name string, level int) ([]byte, error) {
+	codec, err := LookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(compressedMagic)
+	buf.WriteByte(byte(len(codec.Name)))
+	buf.WriteString(codec.Name)
+
+	if err := compressTo(&buf, bytes.NewReader(data), codec, level); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compressTo copies src into dst through the codec.
+func compressTo(dst io.Writer, src io.Reader, codec *Codec, level int) error {
+	w, err := codec.NewWriter(dst, level)
+	if err != nil {
+		return fmt.Errorf("failed to create %s writer: %w", codec.Name, err)
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close %s writer: %w", codec.Name, err)
+	}
+
+	return nil
+}
+
+// detectCodec returns the codec recorded at the start of data produced by
+// CompressWith, and the compressed data that follows it. Data without the
+// header is taken to be plain gzip, as written by Compress.
+func detectCodec(data []byte) (*Codec, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(compressedMagic)) {
+		if bytes.HasPrefix(data, gzipMagic) {
+			return codecs[CompressionGzip], data, nil
+		}
+		return nil, nil, errors.New("unknown compression format")
+	}
+
+	data = data[len(compressedMagic):]
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return nil, nil, errors.New("truncated compression header")
+	}
+
+	codec, err := LookupCodec(string(data[1 : 1+data[0]]))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return codec, data[1+data[0]:], nil
+}
+
+// Magic numbers of common compressed file formats.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	compressedMagics = [][]byte{
+		gzipMagic,
+		{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+		{'B', 'Z', 'h'},                    // bzip2
+		{'P', 'K', 0x03, 0x04},             // zip, docx, jar
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+		{'R', 'a', 'r', '!', 0x1a, 0x07},   // rar
+		{0x89, 'P', 'N', 'G'},              // png
+		{0xff, 0xd8, 0xff},                 // jpeg
+		{'G', 'I', 'F', '8'},               // gif
+		{'O', 'g', 'g', 'S'},               // ogg
+		{'f', 'L', 'a', 'C'},               // flac
+		{'I', 'D', '3'},                    // mp3
+		{0x04, 0x22, 0x4d, 0x18},           // lz4
+		[]byte(compressedMagic),
+		[]byte(containerMagic),
+	}
+)
+
+// LooksCompressed reports whether a sample from the start of some content
+// suggests it is already compressed, either by a known magic number or by
+// its byte entropy.
+func LooksCompressed(sample []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(sample, magic) {
+			return true
+		}
+	}
+
+	// Media containers such as mp4 and mov carry "ftyp" after a size field.
+	if len(sample) >= 8 && string(sample[4:8]) == "ftyp" {
+		return true
+	}
+
+	return entropy(sample) > autoEntropyThreshold
+}
+
+// entropy returns the Shannon entropy of data in bits per byte.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var bits float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+
+	return bits
+}
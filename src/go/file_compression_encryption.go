@@ -1,78 +1,250 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+
+	"golang.org/x/crypto/argon2"
 )
 
+// Default argon2id parameters used to derive a file key from a passphrase.
 const (
-	key = "myverystrongpasswordo32bitlength"
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+	kdfKeyLen  = 32
+	saltSize   = 16
 )
 
-// Compress compresses the input bytes using gzip.
-func Compress(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
+// Upper bounds on KDF parameters read from a container, so a crafted header
+// cannot make GoFiler exhaust memory or CPU.
+const (
+	maxKDFTime   = 64
+	maxKDFMemory = 4 * 1024 * 1024 // KiB
+)
 
-	_, err := gz.Write(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compress data: %w", err)
+// ErrWrongPassphrase is returned when encrypted data cannot be authenticated
+// with the given passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted file")
+
+// newKDFParams returns the default argon2id parameters with a fresh random salt.
+func newKDFParams() (KDFParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDFParams{}, fmt.Errorf("failed to create salt: %w", err)
+	}
+
+	return KDFParams{Name: KDFArgon2id, Time: kdfTime, Memory: kdfMemory, Threads: kdfThreads, Salt: salt}, nil
+}
+
+// deriveKey derives an AES-256 key from the passphrase using the given KDF parameters.
+func deriveKey(passphrase []byte, params KDFParams) ([]byte, error) {
+	if params.Name != KDFArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation function %q", params.Name)
+	}
+	if params.Time == 0 || params.Time > maxKDFTime || params.Memory == 0 || params.Memory > maxKDFMemory || params.Threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters: time=%d memory=%d threads=%d", params.Time, params.Memory, params.Threads)
 	}
 
-	if err := gz.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	return argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, kdfKeyLen), nil
+}
+
+// MaxDecompressedSize bounds the output of the functions that decompress
+// into memory, so a small crafted input cannot exhaust it. Streaming
+// decryption writes to its destination and is not limited.
+var MaxDecompressedSize int64 = 1 << 30
+
+// ErrTooLarge is returned when decompressed data exceeds MaxDecompressedSize.
+var ErrTooLarge = errors.New("decompressed data is too large")
+
+// Compress compresses the input bytes as plain gzip at the default level.
+// Use CompressWith to choose another codec or level.
+func Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := compressTo(&buf, bytes.NewReader(data), codecs[CompressionGzip], DefaultLevel); err != nil {
+		return nil, err
 	}
 
 	return buf.Bytes(), nil
 }
 
-// Decompress decompresses the input bytes using gzip.
+// Decompress decompresses plain gzip produced by Compress, or the output of
+// CompressWith using the codec it records.
 func Decompress(data []byte) ([]byte, error) {
-	rdata := bytes.NewReader(data)
-	r, err := gzip.NewReader(rdata)
+	codec, data, err := detectCodec(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
 	}
 
+	return decompressWith(codec, data)
+}
+
+// decompressWith decompresses data that was compressed with the codec,
+// failing with ErrTooLarge beyond MaxDecompressedSize.
+func decompressWith(codec *Codec, data []byte) ([]byte, error) {
+	r, err := codec.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s reader: %w", codec.Name, err)
+	}
+	defer r.Close()
+
 	var res bytes.Buffer
-	_, err = res.ReadFrom(r)
+	n, err := res.ReadFrom(io.LimitReader(r, MaxDecompressedSize+1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decompress data: %w", err)
 	}
+	if n > MaxDecompressedSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, MaxDecompressedSize)
+	}
 
 	return res.Bytes(), nil
 }
 
-// Encrypt encrypts the input data using AES.
-func Encrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(key))
+// Encrypt encrypts the input data into a container using AES-256-GCM with a
+// key derived from the passphrase and a random per-file salt.
+func Encrypt(data, passphrase []byte) ([]byte, error) {
+	var encrypted bytes.Buffer
+	err := CompressAndEncryptStream(&encrypted, bytes.NewReader(data), Keys{Passphrase: passphrase}, CompressionOptions{Codec: CompressionNone})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, fmt.Errorf("failed to encrypt data: %w", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return encrypted.Bytes(), nil
+}
+
+// Decrypt decrypts a container produced by Encrypt or CompressAndEncrypt and
+// returns its payload as stored. It returns ErrWrongPassphrase if the
+// passphrase does not match.
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	_, payload, err := decrypt(data, Keys{Passphrase: passphrase})
+	return payload, err
+}
+
+// decrypt decrypts a container held in memory, returning its header and payload.
+func decrypt(data []byte, keys Keys) (*ContainerHeader, []byte, error) {
+	r := bytes.NewReader(data)
+	header, _, err := ReadContainerHeader(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, nil, err
+	}
+
+	plain, err := openStream(header, r, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := io.ReadAll(plain)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	return header, payload, nil
+}
+
+// headerAEAD recovers the file key and creates the cipher named in the header.
+func headerAEAD(header *ContainerHeader, keys Keys) (cipher.AEAD, error) {
+	if header.Cipher != CipherAES256GCM {
+		return nil, fmt.Errorf("unsupported cipher %q", header.Cipher)
+	}
+
+	key, err := headerFileKey(header, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGCM(key)
+}
+
+// legacyKey is the fixed key every file was encrypted with before keys were
+// derived from a passphrase. It is only used to read such files with -legacy.
+const legacyKey = "myverystrongpasswordo32bitlength"
+
+// ErrNotLegacy is returned when data cannot be decrypted with legacyKey.
+var ErrNotLegacy = errors.New("not a file encrypted by an older GoFiler version")
+
+// DecryptLegacy decrypts and decompresses data written by GoFiler before the
+// container format existed, laid out as nonce || ciphertext of gzip-compressed
+// data under legacyKey.
+func DecryptLegacy(data []byte) ([]byte, error) {
+	if IsContainer(data) {
+		return nil, fmt.Errorf("%w: it is a GoFiler container, decrypt it without -legacy", ErrNotLegacy)
+	}
+
+	gcm, err := newGCM([]byte(legacyKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrNotLegacy
+	}
+
+	compressed, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrNotLegacy
+	}
+
+	return decompressWith(codecs[CompressionGzip], compressed)
+}
+
+// decryptLegacyStream decrypts a legacy file read from src into dst. Legacy
+// files are a single ciphertext, so they are decrypted in memory.
+func decryptLegacyStream(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+
+	plain, err := DecryptLegacy(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(plain); err != nil {
+		return fmt.Errorf("failed to write decrypted data: %w", err)
+	}
+
+	return nil
+}
+
+// DecryptLegacyFileTo decrypts the legacy file src into dst. Either may be
+// StdioPath to read from standard input or write to standard output.
+func DecryptLegacyFileTo(src, dst string) error {
+	err := transformFile(src, dst, decryptLegacyStream)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt legacy file: %w", err)
+	}
+
+	return nil
+}
+
+// MigrateLegacyFileTo decrypts the legacy file src and encrypts its content
+// into dst with keys, as CompressAndEncryptFileTo does. The plaintext is only
+// held in memory, and src is left untouched if anything fails.
+func MigrateLegacyFileTo(src, dst string, keys Keys, opts CompressionOptions) error {
+	err := transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		var plain bytes.Buffer
+		if err := decryptLegacyStream(&plain, r); err != nil {
+			return err
+		}
+		return CompressAndEncryptStream(w, &plain, keys, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt legacy file: %w", err)
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return nil
 }
 
-// Decrypt decrypts the input data using AES.
-func Decrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(key))
+// newGCM creates an AES-GCM AEAD for the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
@@ -82,86 +254,274 @@ func Decrypt(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	return gcm, nil
+}
+
+// CompressAndEncrypt compresses the input data with gzip and then encrypts it.
+func CompressAndEncrypt(data, passphrase []byte) ([]byte, error) {
+	var encrypted bytes.Buffer
+	if err := CompressAndEncryptStream(&encrypted, bytes.NewReader(data), Keys{Passphrase: passphrase}, CompressionOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to compress and encrypt data: %w", err)
+	}
+
+	return encrypted.Bytes(), nil
+}
+
+// DecryptAndDecompress decrypts and then decompresses the input data, using
+// the compression recorded in the container header.
+func DecryptAndDecompress(data, passphrase []byte) ([]byte, error) {
+	header, payload, err := decrypt(data, Keys{Passphrase: passphrase})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %w", err)
 	}
 
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	codec, err := LookupCodec(header.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %w", err)
+		return nil, err
 	}
 
-	return plaintext, nil
+	return decompressWith(codec, payload)
 }
 
-// CompressAndEncrypt compresses and then encrypts the input data.
-func CompressAndEncrypt(data []byte) ([]byte, error) {
-	compressedData, err := Compress(data)
+// CompressAndEncryptStream compresses src as selected by opts and encrypts it
+// into dst as a chunked stream, so memory use does not depend on the size of
+// the input. The file key is wrapped to keys.Recipients when any are given and
+// derived from keys.Passphrase otherwise.
+func CompressAndEncryptStream(dst io.Writer, src io.Reader, keys Keys, opts CompressionOptions) error {
+	codec, src, err := selectCodec(src, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compress data: %w", err)
+		return err
+	}
+
+	noncePrefix := make([]byte, streamNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	header := &ContainerHeader{
+		Version:     containerVersion,
+		Compression: codec.Name,
+		Cipher:      CipherAES256GCM,
+		Nonce:       noncePrefix,
+		ChunkSize:   streamChunkSize,
 	}
 
-	encryptedData, err := Encrypt(compressedData)
+	key, err := newFileKey(header, keys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
 	}
 
-	return encryptedData, nil
+	prefix, err := header.Marshal()
+	if err != nil {
+		return err
+	}
+	ad, err := header.additionalData()
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(prefix); err != nil {
+		return fmt.Errorf("failed to write container header: %w", err)
+	}
+
+	stream := newStreamWriter(dst, gcm, noncePrefix, ad, streamChunkSize)
+	if err := compressTo(stream, src, codec, opts.Level); err != nil {
+		return err
+	}
+
+	return stream.Close()
 }
 
-// DecryptAndDecompress decrypts and then decompresses the input data.
-func DecryptAndDecompress(data []byte) ([]byte, error) {
-	decryptedData, err := Decrypt(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt data: %w", err)
+// selectCodec returns the codec chosen by opts, gzip by default. In auto mode
+// the start of src is examined, and content that already looks compressed is
+// stored uncompressed; the returned reader still yields all of src.
+func selectCodec(src io.Reader, opts CompressionOptions) (*Codec, io.Reader, error) {
+	name := opts.Codec
+	if name == "" {
+		name = CompressionGzip
 	}
 
-	decompressedData, err := Decompress(decryptedData)
+	codec, err := LookupCodec(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decompress data: %w", err)
+		return nil, nil, err
+	}
+	if err := codec.CheckLevel(opts.Level); err != nil {
+		return nil, nil, err
+	}
+	if !opts.Auto || codec.Name == CompressionNone {
+		return codec, src, nil
+	}
+
+	br := bufio.NewReaderSize(src, autoSampleSize)
+	sample, err := br.Peek(autoSampleSize)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, nil, fmt.Errorf("failed to read data: %w", err)
+	}
+	if LooksCompressed(sample) {
+		codec = codecs[CompressionNone]
 	}
 
-	return decompressedData, nil
+	return codec, br, nil
 }
 
-// CompressAndEncryptFile reads the file, compresses and encrypts its content, and writes it back to the file.
-func CompressAndEncryptFile(filename string) error {
-	data, err := os.ReadFile(filename)
+// DecryptAndDecompressStream decrypts a container read from src and writes
+// the decompressed content to dst, one chunk at a time.
+func DecryptAndDecompressStream(dst io.Writer, src io.Reader, keys Keys) error {
+	br := bufio.NewReader(src)
+	header, _, err := ReadContainerHeader(br)
+	if errors.Is(err, ErrNotContainer) {
+		return fmt.Errorf("%w; files encrypted by older GoFiler versions are read with -legacy", err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return err
 	}
 
-	encryptedData, err := CompressAndEncrypt(data)
+	plain, err := openStream(header, br, keys)
 	if err != nil {
-		return fmt.Errorf("failed to compress and encrypt file: %w", err)
+		return err
 	}
 
-	err = os.WriteFile(filename, encryptedData, 0644)
+	codec, err := LookupCodec(header.Compression)
 	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+		return err
+	}
+
+	decompressed, err := codec.NewReader(plain)
+	if errors.Is(err, ErrWrongPassphrase) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s reader: %w", codec.Name, err)
+	}
+	defer decompressed.Close()
+
+	if _, err := io.Copy(dst, decompressed); err != nil {
+		return fmt.Errorf("failed to decrypt and decompress data: %w", err)
 	}
 
 	return nil
 }
 
-// DecryptAndDecompressFile reads the file, decrypts and decompresses its content, and writes it back to the file.
-func DecryptAndDecompressFile(filename string) error {
-	data, err := os.ReadFile(filename)
+// openStream returns a reader decrypting the chunked body of a container.
+func openStream(header *ContainerHeader, body io.Reader, keys Keys) (io.Reader, error) {
+	if header.ChunkSize <= 0 || header.ChunkSize > maxStreamChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", header.ChunkSize)
+	}
+	if len(header.Nonce) != streamNoncePrefixSize {
+		return nil, fmt.Errorf("invalid nonce prefix size %d", len(header.Nonce))
+	}
+
+	gcm, err := headerAEAD(header, keys)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := header.additionalData()
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(body, gcm, header.Nonce, ad, header.ChunkSize), nil
+}
+
+// CompressAndEncryptFile compresses and encrypts the file in place as a stream.
+// Files that are already GoFiler containers are refused rather than encrypted twice.
+func CompressAndEncryptFile(filename string, keys Keys, opts CompressionOptions) error {
+	return CompressAndEncryptFileTo(filename, filename, keys, opts)
+}
+
+// CompressAndEncryptFileTo compresses and encrypts src into dst. Either may
+// be StdioPath to read from standard input or write to standard output.
+func CompressAndEncryptFileTo(src, dst string, keys Keys, opts CompressionOptions) error {
+	encrypted, err := IsEncryptedFile(src)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		return fmt.Errorf("%s: %w", src, ErrAlreadyEncrypted)
+	}
+
+	err = transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		return CompressAndEncryptStream(w, r, keys, opts)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return fmt.Errorf("failed to compress and encrypt file: %w", err)
 	}
 
-	decryptedData, err := DecryptAndDecompress(data)
+	return nil
+}
+
+// DecryptAndDecompressFile decrypts and decompresses the file in place as a stream.
+func DecryptAndDecompressFile(filename string, keys Keys) error {
+	return DecryptAndDecompressFileTo(filename, filename, keys)
+}
+
+// DecryptAndDecompressFileTo decrypts and decompresses src into dst. Either
+// may be StdioPath to read from standard input or write to standard output.
+func DecryptAndDecompressFileTo(src, dst string, keys Keys) error {
+	err := transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		return DecryptAndDecompressStream(w, r, keys)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to decrypt and decompress file: %w", err)
 	}
 
-	err = os.WriteFile(filename, decryptedData, 0644)
+	return nil
+}
+
+// transformFile streams src through transform into dst. A file destination,
+// including src itself, is written to a temporary file in the same directory
+// that is renamed over dst only once complete, so an existing dst is left
+// untouched if the transform fails. The mode and timestamps of a source file
+// are carried over to dst, and a replaced dst keeps its owner. Output to
+// standard output is written as it is produced.
+func transformFile(src, dst string, transform func(w io.Writer, r io.Reader) error) error {
+	var in io.Reader
+	var info os.FileInfo
+	if src == StdioPath {
+		in = stdinReader()
+	} else {
+		file, err := fsys.Open(src)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+
+		info, err = file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		in = bufio.NewReader(file)
+	}
+
+	if dst == StdioPath {
+		out := bufio.NewWriter(os.Stdout)
+		if err := transform(out, in); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+
+	perm := os.FileMode(0644)
+	if info != nil {
+		perm = info.Mode().Perm()
+	}
+
+	err := writeFileAtomic(dst, perm, func(w io.Writer) error {
+		return transform(w, in)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+		return err
+	}
+
+	if info != nil {
+		if err := fsys.Chtimes(dst, accessTime(info), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to set file times: %w", err)
+		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
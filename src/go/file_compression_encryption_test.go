@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkFileSize is the size of the file encrypted by each benchmark iteration.
+const benchmarkFileSize = 32 * 1024 * 1024
+
+var benchmarkPassphrase = []byte("benchmark passphrase")
+
+var benchmarkKeys = Keys{Passphrase: benchmarkPassphrase}
+
+// writeBenchmarkFile writes a partly compressible file of benchmarkFileSize bytes.
+func writeBenchmarkFile(b *testing.B) string {
+	b.Helper()
+
+	data := make([]byte, benchmarkFileSize)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < len(data); i += 4096 {
+		if (i/4096)%2 == 0 {
+			rng.Read(data[i:minInt(i+4096, len(data))])
+		}
+	}
+
+	path := filepath.Join(b.TempDir(), "plain")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	return path
+}
+
+// minInt returns the smaller of a and b.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// BenchmarkCompressAndEncryptBaseline measures the implementation GoFiler
+// had before streaming, as reproduced by legacyEncrypt: the whole file is
+// read, gzipped and sealed in memory before it is written back.
+func BenchmarkCompressAndEncryptBaseline(b *testing.B) {
+	path := writeBenchmarkFile(b)
+	out := path + ".enc"
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(out, legacyEncrypt(b, data), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCompressAndEncryptInMemory measures CompressAndEncrypt, which
+// streams into a buffer but still holds the whole file and its ciphertext
+// in memory.
+func BenchmarkCompressAndEncryptInMemory(b *testing.B) {
+	path := writeBenchmarkFile(b)
+	out := path + ".enc"
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encrypted, err := CompressAndEncrypt(data, benchmarkPassphrase)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(out, encrypted, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCompressAndEncryptStream measures the streaming pipeline.
+func BenchmarkCompressAndEncryptStream(b *testing.B) {
+	path := writeBenchmarkFile(b)
+	out := path + ".enc"
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		src, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst, err := os.Create(out)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := CompressAndEncryptStream(dst, src, benchmarkKeys, CompressionOptions{}); err != nil {
+			b.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+// BenchmarkDecryptAndDecompressStream measures decrypting a streamed container.
+func BenchmarkDecryptAndDecompressStream(b *testing.B) {
+	path := writeBenchmarkFile(b)
+	var encrypted bytes.Buffer
+	src, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := CompressAndEncryptStream(&encrypted, src, benchmarkKeys, CompressionOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	src.Close()
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := DecryptAndDecompressStream(io.Discard, bytes.NewReader(encrypted.Bytes()), benchmarkKeys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCompressAndEncryptStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, 3*streamChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(plain)
+
+		var encrypted bytes.Buffer
+		if err := CompressAndEncryptStream(&encrypted, bytes.NewReader(plain), benchmarkKeys, CompressionOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var decrypted bytes.Buffer
+		if err := DecryptAndDecompressStream(&decrypted, bytes.NewReader(encrypted.Bytes()), benchmarkKeys); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Fatalf("size %d: round trip changed the data", size)
+		}
+
+		truncated := encrypted.Bytes()[:encrypted.Len()-1]
+		if err := DecryptAndDecompressStream(io.Discard, bytes.NewReader(truncated), benchmarkKeys); err == nil {
+			t.Fatalf("size %d: truncated stream decrypted without error", size)
+		}
+	}
+}
+
+// legacyEncrypt encrypts data as GoFiler did before the container format:
+// gzip, then AES-256-GCM under the built-in key with the nonce prepended.
+func legacyEncrypt(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	gcm, err := newGCM([]byte(legacyKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+
+	return gcm.Seal(nonce, nonce, compressed.Bytes(), nil)
+}
+
+func TestLegacyFiles(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.WriteFile("/old", legacyEncrypt(t, []byte("old secret")), 0600)
+
+	if err := DecryptLegacyFileTo("/old", "/plain"); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/plain", "old secret")
+
+	if err := MigrateLegacyFileTo("/old", "/old", benchmarkKeys, CompressionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var decrypted bytes.Buffer
+	data, _ := mem.ReadFile("/old")
+	if err := DecryptAndDecompressStream(&decrypted, bytes.NewReader(data), benchmarkKeys); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.String() != "old secret" {
+		t.Errorf("migrated file holds %q", decrypted.String())
+	}
+
+	// Neither a container nor other data is taken for a legacy file.
+	for name, content := range map[string][]byte{"/old": data, "/other": []byte("not encrypted at all")} {
+		mem.WriteFile(name, content, 0600)
+		if err := MigrateLegacyFileTo(name, name, benchmarkKeys, CompressionOptions{}); !errors.Is(err, ErrNotLegacy) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+		assertUnchanged(t, mem, name, string(content))
+	}
+}
+
+func TestContainerRejectsTampering(t *testing.T) {
+	encrypted, err := Encrypt([]byte("payload"), benchmarkPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := Decrypt(encrypted, benchmarkPassphrase); err != nil || string(plain) != "payload" {
+		t.Fatalf("Decrypt = %q, %v", plain, err)
+	}
+	if _, err := Decrypt(encrypted, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+
+	header, prefix, err := ReadContainerHeader(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != containerVersion || header.Compression != CompressionNone {
+		t.Errorf("header = %+v", header)
+	}
+
+	// Changing the recorded compression must fail authentication.
+	header.Compression = CompressionGzip
+	tampered, _ := header.Marshal()
+	tampered = append(tampered, encrypted[len(prefix):]...)
+	if _, err := Decrypt(tampered, benchmarkPassphrase); err == nil {
+		t.Error("tampered header accepted")
+	}
+
+	unknown := append([]byte(nil), encrypted...)
+	unknown[len(containerMagic)] = containerVersion + 1
+	if _, err := Decrypt(unknown, benchmarkPassphrase); err == nil {
+		t.Error("unknown container version accepted")
+	}
+}
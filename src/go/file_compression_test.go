@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// compressibleData returns text that every codec can shrink.
+func compressibleData() []byte {
+	return []byte(strings.Repeat("GoFiler compresses repetitive text well. ", 2000))
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	plain := compressibleData()
+	encryptKeys, decryptKeys := identityKeys(t)
+
+	for _, name := range CodecNames() {
+		codec, _ := LookupCodec(name)
+		levels := []int{DefaultLevel}
+		if codec.MaxLevel != 0 {
+			levels = append(levels, codec.MinLevel, codec.MaxLevel)
+		}
+
+		for _, level := range levels {
+			compressed, err := CompressWith(plain, name, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			if name != CompressionNone && len(compressed) >= len(plain) {
+				t.Errorf("%s level %d did not compress: %d bytes", name, level, len(compressed))
+			}
+			decompressed, err := Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			if !bytes.Equal(decompressed, plain) {
+				t.Fatalf("%s level %d: round trip changed the data", name, level)
+			}
+
+			var encrypted, decrypted bytes.Buffer
+			opts := CompressionOptions{Codec: name, Level: level}
+			if err := CompressAndEncryptStream(&encrypted, bytes.NewReader(plain), encryptKeys, opts); err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			if err := DecryptAndDecompressStream(&decrypted, &encrypted, decryptKeys); err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plain) {
+				t.Fatalf("%s level %d: encrypted round trip changed the data", name, level)
+			}
+		}
+	}
+}
+
+func TestCodecRejectsInvalidLevel(t *testing.T) {
+	for _, name := range []string{CompressionGzip, CompressionZlib, CompressionZstd, CompressionXz} {
+		codec, _ := LookupCodec(name)
+		for _, level := range []int{codec.MinLevel - 1, codec.MaxLevel + 1} {
+			if level == DefaultLevel {
+				continue
+			}
+			if _, err := CompressWith([]byte("data"), name, level); err == nil {
+				t.Errorf("%s accepted level %d", name, level)
+			}
+		}
+	}
+	if _, err := CompressWith([]byte("data"), "lzma", DefaultLevel); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+func TestCompressWritesPlainGzip(t *testing.T) {
+	plain := compressibleData()
+	compressed, err := Compress(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Compress output is not gzip: %v", err)
+	}
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("gzip reader returned %d bytes, %v", len(data), err)
+	}
+
+	if decompressed, err := Decompress(compressed); err != nil || !bytes.Equal(decompressed, plain) {
+		t.Errorf("Decompress = %d bytes, %v", len(decompressed), err)
+	}
+	if _, err := Decompress([]byte("neither gzip nor tagged")); err == nil {
+		t.Error("unknown format decompressed")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	limit := MaxDecompressedSize
+	MaxDecompressedSize = 1024
+	t.Cleanup(func() { MaxDecompressedSize = limit })
+
+	bomb, err := CompressWith(make([]byte, 1<<20), CompressionZstd, DefaultLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress(bomb); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("error = %v", err)
+	}
+
+	encrypted, err := CompressAndEncrypt(make([]byte, 1<<20), benchmarkPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptAndDecompress(encrypted, benchmarkPassphrase); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("error = %v", err)
+	}
+
+	if data, err := Decompress(mustCompress(t, make([]byte, 1024))); err != nil || len(data) != 1024 {
+		t.Errorf("data at the limit: %d bytes, %v", len(data), err)
+	}
+}
+
+// mustCompress compresses data with Compress.
+func mustCompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	compressed, err := Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return compressed
+}
+
+func TestAutoSkipsCompressedInput(t *testing.T) {
+	random := make([]byte, 2*autoSampleSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	gzipped := mustCompress(t, compressibleData())
+	encryptKeys, decryptKeys := identityKeys(t)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"text", compressibleData(), CompressionZstd},
+		{"random", random, CompressionNone},
+		{"gzip", gzipped, CompressionNone},
+		{"empty", nil, CompressionZstd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encrypted bytes.Buffer
+			opts := CompressionOptions{Codec: CompressionZstd, Auto: true}
+			if err := CompressAndEncryptStream(&encrypted, bytes.NewReader(tt.input), encryptKeys, opts); err != nil {
+				t.Fatal(err)
+			}
+			header, _, err := ReadContainerHeader(bytes.NewReader(encrypted.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Compression != tt.want {
+				t.Errorf("compression = %s, want %s", header.Compression, tt.want)
+			}
+
+			var decrypted bytes.Buffer
+			if err := DecryptAndDecompressStream(&decrypted, &encrypted, decryptKeys); err != nil || !bytes.Equal(decrypted.Bytes(), tt.input) {
+				t.Errorf("round trip: %d bytes, %v", decrypted.Len(), err)
+			}
+		})
+	}
+}
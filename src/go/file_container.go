@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// containerMagic starts every file encrypted by GoFiler.
+const containerMagic = "GOFILER\x1a"
+
+// containerVersion is the container format version GoFiler writes. A later
+// format must use a new version and keep reading this one.
+const containerVersion = 1
+
+// maxHeaderSize bounds the header length accepted when reading a container.
+const maxHeaderSize = 1 << 20
+
+// Algorithm identifiers recorded in the container header.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CipherAES256GCM = "aes-256-gcm"
+	KDFArgon2id     = "argon2id"
+)
+
+// ErrNotContainer is returned when a file does not start with the container magic.
+var ErrNotContainer = errors.New("not a GoFiler encrypted file")
+
+// ErrAlreadyEncrypted is returned when asked to encrypt a file that already is a container.
+var ErrAlreadyEncrypted = errors.New("file is already encrypted by GoFiler")
+
+// KDFParams records how the file key was derived from the passphrase.
+type KDFParams struct {
+	Name    string `json:"name"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	Salt    []byte `json:"salt"`
+}
+
+// ContainerHeader describes how the body of a container was produced.
+//
+// On disk a container is laid out as
+//
+//	magic (8 bytes) | version (1 byte) | header length (4 bytes, big endian) | header (JSON) | body
+//
+// The body is a stream of chunks of ChunkSize plaintext bytes, and Nonce is
+// the prefix of every chunk nonce. Everything before the body except the key
+// slots is authenticated as additional data of every chunk, so the header
+// cannot be altered without detection.
+//
+// The file key is derived from a passphrase as described by KDF, or is random
+// and wrapped to each of the Recipients or under the master key named in
+// Envelope. These key slots are left out of the additional data, so a wrapped
+// key can be replaced without re-encrypting the body; a tampered key slot
+// simply yields a key that fails to open the body.
+type ContainerHeader struct {
+	Version     uint8             `json:"-"`
+	Compression string            `json:"compression"`
+	Cipher      string            `json:"cipher"`
+	KDF         *KDFParams        `json:"kdf,omitempty"`
+	Recipients  []RecipientStanza `json:"recipients,omitempty"`
+	Envelope    *EnvelopeKey      `json:"envelope,omitempty"`
+	Nonce       []byte            `json:"nonce"`
+	ChunkSize   int               `json:"chunk_size,omitempty"`
+}
+
+// Marshal encodes the header with the magic, version and length framing.
+func (h *ContainerHeader) Marshal() ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode container header: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(containerMagic)
+	buf.WriteByte(h.Version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+
+	return buf.Bytes(), nil
+}
+
+// additionalData returns the bytes authenticated with every chunk of the
+// body: the framed header without its key slots.
+func (h *ContainerHeader) additionalData() ([]byte, error) {
+	unkeyed := *h
+	unkeyed.KDF = nil
+	unkeyed.Recipients = nil
+	unkeyed.Envelope = nil
+	return unkeyed.Marshal()
+}
+
+// ReadContainerHeader reads the framed header from r. It returns the header
+// together with its raw bytes, which are the additional data of the body.
+func ReadContainerHeader(r io.Reader) (*ContainerHeader, []byte, error) {
+	prefix := make([]byte, len(containerMagic)+1+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, ErrNotContainer
+		}
+		return nil, nil, fmt.Errorf("failed to read container header: %w", err)
+	}
+	if string(prefix[:len(containerMagic)]) != containerMagic {
+		return nil, nil, ErrNotContainer
+	}
+
+	version := prefix[len(containerMagic)]
+	if version != containerVersion {
+		return nil, nil, fmt.Errorf("unsupported container version %d", version)
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(containerMagic)+1:])
+	if size > maxHeaderSize {
+		return nil, nil, fmt.Errorf("container header too large: %d bytes", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, fmt.Errorf("failed to read container header: %w", err)
+	}
+
+	header := &ContainerHeader{Version: version}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse container header: %w", err)
+	}
+
+	return header, append(prefix, data...), nil
+}
+
+// PeekContainerHeader reads the container header of the file at path. For
+// StdioPath the header is read from standard input without consuming it.
+func PeekContainerHeader(path string) (*ContainerHeader, error) {
+	if path != StdioPath {
+		file, err := fsys.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+
+		header, _, err := ReadContainerHeader(bufio.NewReader(file))
+		return header, err
+	}
+
+	prefixSize := len(containerMagic) + 1 + 4
+	prefix, err := stdinReader().Peek(prefixSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read standard input: %w", err)
+	}
+	if len(prefix) < prefixSize || !IsContainer(prefix) {
+		return nil, ErrNotContainer
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(containerMagic)+1:])
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("container header too large: %d bytes", size)
+	}
+
+	data, err := stdinReader().Peek(prefixSize + int(size))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read standard input: %w", err)
+	}
+
+	header, _, err := ReadContainerHeader(bytes.NewReader(data))
+	return header, err
+}
+
+// IsContainer reports whether data starts with the container magic.
+func IsContainer(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(containerMagic))
+}
+
+// IsEncryptedFile reports whether the file at path is a GoFiler container.
+// For StdioPath the start of standard input is examined without consuming it.
+func IsEncryptedFile(path string) (bool, error) {
+	if path == StdioPath {
+		magic, err := stdinReader().Peek(len(containerMagic))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("failed to read standard input: %w", err)
+		}
+		return IsContainer(magic), nil
+	}
+
+	file, err := fsys.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(containerMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return IsContainer(magic[:n]), nil
+}
+
+// InspectFile prints the container header of an encrypted file.
+func InspectFile(path string) error {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	header, raw, err := ReadContainerHeader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	fmt.Printf("File: %s\n", path)
+	fmt.Printf("Format version: %d\n", header.Version)
+	fmt.Printf("Compression: %s\n", header.Compression)
+	fmt.Printf("Cipher: %s\n", header.Cipher)
+	if header.KDF != nil {
+		fmt.Printf("KDF: %s (time=%d, memory=%d KiB, threads=%d)\n", header.KDF.Name, header.KDF.Time, header.KDF.Memory, header.KDF.Threads)
+		fmt.Printf("Salt: %x\n", header.KDF.Salt)
+	}
+	if len(header.Recipients) > 0 {
+		fmt.Printf("Recipients: %d\n", len(header.Recipients))
+	}
+	if header.Envelope != nil {
+		fmt.Printf("Master key: %s\n", header.Envelope.KeyID)
+	}
+	fmt.Printf("Chunk size: %d bytes\n", header.ChunkSize)
+	fmt.Printf("Header size: %d bytes\n", len(raw))
+	fmt.Printf("Payload size: %d bytes\n", info.Size()-int64(len(raw)))
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for files that already exist at the destination of a copy.
+const (
+	ExistingOverwrite = "overwrite" // replace them
+	ExistingSkip      = "skip"      // keep them
+	ExistingUpdate    = "update"    // replace them only if the source is newer
+)
+
+// CopyOptions controls how CopyPath copies files and directory trees.
+type CopyOptions struct {
+	Preserve       bool   // keep times, ownership where permitted, and setuid, setgid and sticky bits
+	FollowSymlinks bool   // copy what symbolic links point to instead of the links
+	Existing       string // policy for existing files; empty means ExistingOverwrite
+	Verify         bool   // compare the SHA-256 of every copy with its source
+}
+
+// CopySummary counts what a copy did.
+type CopySummary struct {
+	Files   int
+	Links   int
+	Dirs    int
+	Skipped int
+	Bytes   int64
+}
+
+// CopyPath copies the file, symbolic link or directory tree src to dest.
+// As with cp, an existing directory dest receives a copy named after src.
+// Every file is written under a temporary name and renamed into place, so
+// an existing file is never left half overwritten.
+func CopyPath(src, dest string, opts CopyOptions) error {
+	switch opts.Existing {
+	case "", ExistingOverwrite, ExistingSkip, ExistingUpdate:
+	default:
+		return fmt.Errorf("unknown policy for existing files %q; use overwrite, skip or update", opts.Existing)
+	}
+
+	dest = copyTarget(src, dest)
+	if info, err := fsys.Stat(src); err == nil && info.IsDir() {
+		within, err := isWithin(src, dest)
+		if err != nil {
+			return err
+		}
+		if within {
+			return fmt.Errorf("cannot copy %s into itself", src)
+		}
+	}
+
+	summary, err := copyTree(src, dest, opts)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dest, err)
+	}
+
+	fmt.Printf("Copied %s to %s: %d files (%d bytes), %d links, %d directories, %d skipped\n",
+		src, dest, summary.Files, summary.Bytes, summary.Links, summary.Dirs, summary.Skipped)
+	return nil
+}
+
+// copyTarget returns where CopyPath puts the copy of src: inside dest if
+// it is an existing directory, as with cp, and at dest otherwise.
+func copyTarget(src, dest string) string {
+	if info, err := fsys.Stat(dest); err == nil && info.IsDir() {
+		return filepath.Join(dest, filepath.Base(src))
+	}
+
+	return dest
+}
+
+// isWithin reports whether path is dir or lies inside it.
+func isWithin(dir, path string) (bool, error) {
+	absDir, err := fsys.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	absPath, err := fsys.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false, nil
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// copier copies one tree for copyTree.
+type copier struct {
+	opts    CopyOptions
+	summary CopySummary
+}
+
+// copyTree copies the file, symbolic link or directory tree at src to dst,
+// merging directories into existing ones.
+func copyTree(src, dst string, opts CopyOptions) (CopySummary, error) {
+	c := &copier{opts: opts}
+	err := c.copy(src, dst, nil)
+
+	return c.summary, err
+}
+
+// copy copies src to dst. ancestors are the directories being copied above
+// src, to detect loops through followed symbolic links.
+func (c *copier) copy(src, dst string, ancestors []fs.FileInfo) error {
+	stat := fsys.Lstat
+	if c.opts.FollowSymlinks {
+		stat = fsys.Stat
+	}
+	info, err := stat(src)
+	if err != nil {
+		return err
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		return c.copyDir(src, dst, info, ancestors)
+	case mode&fs.ModeSymlink != 0:
+		return c.copyLink(src, dst, info)
+	case mode.IsRegular():
+		return c.copyFile(src, dst, info)
+	default:
+		return fmt.Errorf("cannot copy %s: unsupported file type %s", src, mode.Type())
+	}
+}
+
+// copyDir copies the directory src and everything in it to dst. Its
+// metadata is set once its entries are copied, so adding them does not
+// change its times and a read-only directory can still be filled.
+func (c *copier) copyDir(src, dst string, info fs.FileInfo, ancestors []fs.FileInfo) error {
+	for _, ancestor := range ancestors {
+		if fsys.SameFile(ancestor, info) {
+			return fmt.Errorf("cannot copy %s: symbolic link loop", src)
+		}
+	}
+
+	created := false
+	existing, err := fsys.Lstat(dst)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := fsys.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		created = true
+	case err != nil:
+		return err
+	case !existing.IsDir():
+		return fmt.Errorf("cannot copy directory %s over %s, which is not a directory", src, dst)
+	}
+
+	entries, err := fsys.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	ancestors = append(ancestors, info)
+	for _, entry := range entries {
+		if err := c.copy(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), ancestors); err != nil {
+			return err
+		}
+	}
+
+	c.summary.Dirs++
+	if !created && !c.opts.Preserve {
+		return nil
+	}
+	return c.setMetadata(dst, info)
+}
+
+// keep reports whether the policy for existing files keeps dst instead of
+// replacing it with src.
+func (c *copier) keep(src, dst string, info fs.FileInfo) (bool, error) {
+	existing, err := fsys.Lstat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing.IsDir() {
+		return false, fmt.Errorf("cannot copy %s over the directory %s", src, dst)
+	}
+
+	switch c.opts.Existing {
+	case ExistingSkip:
+		return true, nil
+	case ExistingUpdate:
+		return !info.ModTime().After(existing.ModTime()), nil
+	}
+	return false, nil
+}
+
+// copyFile copies the regular file src to a temporary file next to dst and
+// renames it into place once it is complete and, if asked for, verified.
+func (c *copier) copyFile(src, dst string, info fs.FileInfo) error {
+	keep, err := c.keep(src, dst, info)
+	if err != nil || keep {
+		if keep {
+			c.summary.Skipped++
+		}
+		return err
+	}
+
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".copy-*")
+	if err != nil {
+		return err
+	}
+	n, err := copyFileData(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && c.opts.Verify {
+		err = verifyCopy(src, out.Name())
+	}
+	if err == nil {
+		err = c.setMetadata(out.Name(), info)
+	}
+	if err == nil {
+		err = fsys.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		fsys.Remove(out.Name())
+		return err
+	}
+
+	c.summary.Files++
+	c.summary.Bytes += n
+	return nil
+}
+
+// copyLink copies the symbolic link src as a link with the same target.
+func (c *copier) copyLink(src, dst string, info fs.FileInfo) error {
+	keep, err := c.keep(src, dst, info)
+	if err != nil || keep {
+		if keep {
+			c.summary.Skipped++
+		}
+		return err
+	}
+
+	target, err := fsys.Readlink(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := hiddenSibling(dst, "copy")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Symlink(target, tmp); err != nil {
+		return err
+	}
+	err = c.setMetadata(tmp, info)
+	if err == nil {
+		err = fsys.Rename(tmp, dst)
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+
+	c.summary.Links++
+	return nil
+}
+
+// verifyCopy checks that the copy reads back the same as the original.
+func verifyCopy(src, copy string) error {
+	want, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	got, err := hashFile(copy)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("copy of %s does not match the original", src)
+	}
+
+	return nil
+}
+
+// setMetadata gives a copy the metadata of info. Without Preserve only the
+// permission bits are copied, as cp does.
+func (c *copier) setMetadata(name string, info fs.FileInfo) error {
+	if c.opts.Preserve {
+		return copyMetadata(name, info)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	return fsys.Chmod(name, info.Mode().Perm())
+}
+
+// copyMetadata gives name the ownership, mode and times recorded in info.
+// Ownership that may not be given away is left to the current user, as mv
+// does. Symbolic links only get their ownership.
+func copyMetadata(name string, info fs.FileInfo) error {
+	link := info.Mode()&fs.ModeSymlink != 0
+	if uid, gid, ok := fsys.Owner(info); ok {
+		chown := fsys.Chown
+		if link {
+			chown = fsys.Lchown
+		}
+		if err := chown(name, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if link {
+		return nil
+	}
+
+	// Chmod comes after chown, which clears the setuid and setgid bits.
+	if err := fsys.Chmod(name, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	return fsys.Chtimes(name, accessTime(info), info.ModTime())
+}
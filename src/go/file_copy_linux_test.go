@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyPathReflinksInSandbox(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "src"), []byte("shared data"), 0644)
+	sandbox, err := NewSandboxFileSystem(root, OSFileSystem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedClone := fsys, cloneFile
+	fsys = sandbox
+	t.Cleanup(func() { fsys, cloneFile = saved, savedClone })
+
+	// Refuse the reflink, as most file systems do, so the data is copied.
+	clones := 0
+	cloneFile = func(dst, src int) error {
+		clones++
+		return syscall.EOPNOTSUPP
+	}
+
+	if err := CopyPath("/src", "/dst", CopyOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if clones != 1 {
+		t.Errorf("%d reflinks attempted, want 1", clones)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "dst")); string(data) != "shared data" {
+		t.Errorf("dst = %q", data)
+	}
+}
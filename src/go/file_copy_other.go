@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "io"
+
+// copyFileData copies the contents of in to out.
+func copyFileData(out, in FileHandle) (int64, error) {
+	return io.Copy(out, in)
+}
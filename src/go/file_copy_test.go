@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCopyPathExistingPolicies(t *testing.T) {
+	mem := useMemFileSystem(t)
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mem.MkdirAll("/src/sub", 0755)
+	mem.WriteFile("/src/sub/new", []byte("new source"), 0600)
+	mem.WriteFile("/src/old", []byte("old source"), 0644)
+	mem.Chtimes("/src/old", old, old)
+
+	if err := CopyPath("/src", "/dst", CopyOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/dst/sub/new", "new source")
+	if info, _ := mem.Stat("/dst/sub/new"); info.Mode().Perm() != 0600 {
+		t.Errorf("mode of copy = %v", info.Mode().Perm())
+	}
+
+	mem.WriteFile("/dst/sub/new", []byte("edited"), 0600)
+	mem.WriteFile("/dst/old", []byte("edited"), 0644)
+	copyInto := func(existing string) {
+		t.Helper()
+		if err := copyTreeQuietly("/src", "/dst", CopyOptions{Existing: existing}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copyInto(ExistingSkip)
+	assertUnchanged(t, mem, "/dst/sub/new", "edited")
+
+	// The edited copies are newer than /src/old but older than /src/sub/new.
+	mem.Chtimes("/dst/sub/new", old.Add(-time.Hour), old.Add(-time.Hour))
+	copyInto(ExistingUpdate)
+	assertUnchanged(t, mem, "/dst/sub/new", "new source")
+	assertUnchanged(t, mem, "/dst/old", "edited")
+
+	copyInto(ExistingOverwrite)
+	assertUnchanged(t, mem, "/dst/old", "old source")
+
+	// An existing directory receives a copy named after the source.
+	if err := CopyPath("/src/old", "/dst/sub", CopyOptions{Preserve: true}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := mem.Stat("/dst/sub/old"); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("copy into directory: %v, %v", info, err)
+	}
+	if err := CopyPath("/src", "/src/sub", CopyOptions{}); err == nil {
+		t.Error("copied a directory into itself")
+	}
+}
+
+// copyTreeQuietly copies src over dst without CopyPath's output or its
+// copying into existing directories.
+func copyTreeQuietly(src, dst string, opts CopyOptions) error {
+	_, err := copyTree(src, dst, opts)
+	return err
+}
+
+func TestCopyPathKeepsExistingFileOnFailure(t *testing.T) {
+	faults, mem := useFaultFileSystem(t)
+	mem.WriteFile("/src", []byte("new content"), 0644)
+	mem.WriteFile("/dst", []byte("old content"), 0644)
+
+	faults.Inject(Fault{Op: FaultWrite, Path: ".dst.copy-*", ShortWrite: true})
+	if err := CopyPath("/src", "/dst", CopyOptions{}); err == nil {
+		t.Fatal("copy succeeded under the fault")
+	}
+	assertUnchanged(t, mem, "/dst", "old content")
+	assertNoHiddenFiles(t, "/")
+
+	faults.Reset()
+	faults.Inject(Fault{Op: FaultRename, Path: "dst", Err: syscall.EIO})
+	if err := CopyPath("/src", "/dst", CopyOptions{Verify: true}); err == nil {
+		t.Fatal("copy succeeded under the fault")
+	}
+	assertUnchanged(t, mem, "/dst", "old content")
+	assertNoHiddenFiles(t, "/")
+}
+
+func TestCopyPathSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "data"), []byte("data"), 0644)
+	if err := os.Symlink("sub", filepath.Join(src, "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	links := filepath.Join(dir, "links")
+	if err := CopyPath(src, links, CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(links, "link")); err != nil || target != "sub" {
+		t.Errorf("copied link = %q, %v", target, err)
+	}
+
+	followed := filepath.Join(dir, "followed")
+	if err := CopyPath(src, followed, CopyOptions{FollowSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(followed, "link"))
+	if err != nil || !info.IsDir() {
+		t.Fatalf("followed link = %v, %v", info, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(followed, "link", "data")); string(data) != "data" {
+		t.Errorf("file behind followed link = %q", data)
+	}
+
+	os.Symlink("..", filepath.Join(src, "sub", "up"))
+	if err := CopyPath(src, filepath.Join(dir, "loop"), CopyOptions{FollowSymlinks: true}); err == nil {
+		t.Error("followed a symbolic link loop")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultWorkers is the number of files processed in parallel by tree
+// operations. Passphrase encryption needs 64 MiB per worker for argon2id.
+const DefaultWorkers = 4
+
+// Tree operations.
+const (
+	TreeEncrypt = "encrypt"
+	TreeDecrypt = "decrypt"
+)
+
+// staleTempFile matches the temporary files of writeFileAtomic, which an
+// interrupted rewrite may leave behind.
+var staleTempFile = regexp.MustCompile(`^\..+\.tmp-[0-9a-f]+$`)
+
+// TreeOptions selects the files of a tree operation and how they are processed.
+type TreeOptions struct {
+	Include     []string // glob patterns; if set, only matching files are processed
+	Exclude     []string // glob patterns of files and directories to leave alone
+	Workers     int      // files processed in parallel; 0 means DefaultWorkers
+	Keys        Keys
+	Compression CompressionOptions
+	ShredPasses int // if set, the plaintext of encrypted files is shredded with this many passes
+}
+
+// TreeSummary counts the outcome of a tree operation.
+type TreeSummary struct {
+	Processed   int
+	Skipped     int // already in the requested state, e.g. by an earlier interrupted run
+	Excluded    int
+	Failed      int
+	Leftover    int // temporary files and unshredded originals of interrupted runs, left in place
+	Resumed     int // originals of an interrupted -shred run shredded or unlinked
+	BytesIn     int64
+	BytesOut    int64
+	Duration    time.Duration
+	Interrupted bool
+}
+
+// Outcomes of a single file in a tree operation.
+const (
+	treeProcessed = iota
+	treeSkipped
+	treeExcluded
+	treeFailed
+	treeResumed
+	treeLeftover
+)
+
+// treeResult is the outcome of processing one file.
+type treeResult struct {
+	path     string
+	outcome  int
+	bytesIn  int64
+	bytesOut int64
+	err      error
+}
+
+// ProcessTree encrypts or decrypts every selected file under root in place.
+// Files already in the requested state are skipped, and every file is
+// replaced atomically, so an interrupted run can simply be started again and
+// picks up where it stopped. Interrupting with Ctrl-C or SIGTERM lets the
+// files in progress finish before the summary is printed.
+//
+// Temporary files and shred links of interrupted runs are never processed.
+// Temporary files are reported but not removed, as they may belong to someone
+// else. Shred links are dealt with by resumeShred before any file of their
+// directory is processed, while the link can still be told from the file.
+func ProcessTree(root, operation string, opts TreeOptions) error {
+	if operation != TreeEncrypt && operation != TreeDecrypt {
+		return fmt.Errorf("unknown tree operation %q", operation)
+	}
+	for _, pattern := range append(append([]string(nil), opts.Include...), opts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	var summary TreeSummary
+	paths := make(chan string)
+	results := make(chan treeResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				results <- processTreeFile(path, operation, opts)
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		walkErr = walkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				results <- treeResult{path: path, outcome: treeFailed, err: err}
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			rel, _ := filepath.Rel(root, path)
+			if d.IsDir() {
+				if rel != "." && (matchesAny(opts.Exclude, rel) || rel == BackupDir) {
+					return filepath.SkipDir
+				}
+				resumeShreds(path, opts.ShredPasses, results)
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if shredPending.MatchString(d.Name()) {
+				return nil
+			}
+			if staleTempFile.MatchString(d.Name()) {
+				results <- treeResult{path: path, outcome: treeLeftover}
+				return nil
+			}
+			if matchesAny(opts.Exclude, rel) || (len(opts.Include) > 0 && !matchesAny(opts.Include, rel)) {
+				results <- treeResult{path: path, outcome: treeExcluded}
+				return nil
+			}
+
+			select {
+			case paths <- path:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		switch result.outcome {
+		case treeExcluded:
+			summary.Excluded++
+		case treeFailed:
+			fmt.Printf("%s: %v\n", result.path, result.err)
+			summary.Failed++
+		case treeSkipped:
+			summary.Skipped++
+		case treeResumed:
+			fmt.Printf("finished interrupted shred of %s\n", result.path)
+			summary.Resumed++
+		case treeLeftover:
+			if staleTempFile.MatchString(filepath.Base(result.path)) {
+				fmt.Printf("%s: temporary file of an interrupted write left in place; delete it once no other program uses it\n", result.path)
+			} else {
+				fmt.Printf("%s: original content of an interrupted -shred run left in place; run again with -shred to shred it\n", result.path)
+			}
+			summary.Leftover++
+		default:
+			fmt.Printf("%sed %s\n", operation, result.path)
+			summary.Processed++
+			summary.BytesIn += result.bytesIn
+			summary.BytesOut += result.bytesOut
+		}
+	}
+
+	summary.Duration = time.Since(start)
+	summary.Interrupted = errors.Is(walkErr, context.Canceled)
+	if walkErr != nil && !summary.Interrupted {
+		return fmt.Errorf("failed to walk %s: %w", root, walkErr)
+	}
+
+	printTreeSummary(operation, summary)
+	if summary.Interrupted {
+		return errors.New("interrupted; run the same command again to resume")
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d files could not be %sed", summary.Failed, operation)
+	}
+
+	return nil
+}
+
+// resumeShreds passes the shred links in dir to resumeShred and sends the
+// outcomes to results. It runs before the walk reaches the files of dir: once
+// a file is rewritten, a link to its old content looks like one left after
+// the rewrite and would be kept instead of removed.
+func resumeShreds(dir string, passes int, results chan<- treeResult) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		// The walk reports the error when it reads dir itself.
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !shredPending.MatchString(entry.Name()) {
+			continue
+		}
+		link := filepath.Join(dir, entry.Name())
+		resumed, err := resumeShred(link, passes)
+		switch {
+		case err != nil:
+			results <- treeResult{path: link, outcome: treeFailed, err: err}
+		case resumed:
+			results <- treeResult{path: link, outcome: treeResumed}
+		default:
+			results <- treeResult{path: link, outcome: treeLeftover}
+		}
+	}
+}
+
+// processTreeFile encrypts or decrypts a single file of a tree, skipping it
+// if it already is in the requested state.
+func processTreeFile(path, operation string, opts TreeOptions) treeResult {
+	encrypted, err := IsEncryptedFile(path)
+	if err != nil {
+		return treeResult{path: path, outcome: treeFailed, err: err}
+	}
+	if encrypted == (operation == TreeEncrypt) {
+		return treeResult{path: path, outcome: treeSkipped}
+	}
+
+	before, err := fsys.Stat(path)
+	if err != nil {
+		return treeResult{path: path, outcome: treeFailed, err: err}
+	}
+
+	if operation == TreeEncrypt && opts.ShredPasses > 0 {
+		err = ShredReplaced(path, opts.ShredPasses, func() error {
+			return CompressAndEncryptFile(path, opts.Keys, opts.Compression)
+		})
+	} else if operation == TreeEncrypt {
+		err = CompressAndEncryptFile(path, opts.Keys, opts.Compression)
+	} else {
+		err = DecryptAndDecompressFile(path, opts.Keys)
+	}
+	if err != nil {
+		return treeResult{path: path, outcome: treeFailed, err: err}
+	}
+
+	after, err := fsys.Stat(path)
+	if err != nil {
+		return treeResult{path: path, outcome: treeFailed, err: err}
+	}
+
+	return treeResult{path: path, outcome: treeProcessed, bytesIn: before.Size(), bytesOut: after.Size()}
+}
+
+// matchesAny reports whether the slash-separated relative path matches any of
+// the patterns. Patterns without a slash are matched against the base name,
+// others against the whole path.
+func matchesAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = rel[strings.LastIndex(rel, "/")+1:]
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printTreeSummary prints the outcome of a tree operation.
+func printTreeSummary(operation string, s TreeSummary) {
+	fmt.Printf("\nSummary (%s):\n", operation)
+	fmt.Printf("  Processed: %d (%d bytes -> %d bytes)\n", s.Processed, s.BytesIn, s.BytesOut)
+	fmt.Printf("  Already %sed: %d\n", operation, s.Skipped)
+	fmt.Printf("  Excluded: %d\n", s.Excluded)
+	fmt.Printf("  Failed: %d\n", s.Failed)
+	if s.Resumed > 0 {
+		fmt.Printf("  Interrupted shreds finished: %d\n", s.Resumed)
+	}
+	if s.Leftover > 0 {
+		fmt.Printf("  Left by interrupted runs, not touched: %d\n", s.Leftover)
+	}
+	fmt.Printf("  Duration: %s\n", s.Duration.Round(time.Millisecond))
+	if s.Interrupted {
+		fmt.Println("  Interrupted before all files were processed")
+	}
+}
+
+// TreeDecryptionKeys returns the keys needed to decrypt every container
+// under root, loading identities, the keystore and the passphrase only if
+// some file needs them.
+func TreeDecryptionKeys(root, passphraseFile string, identityFiles []string) (Keys, error) {
+	var needPassphrase, needIdentities, needKeystore bool
+	err := walkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		header, err := PeekContainerHeader(path)
+		if err != nil {
+			return nil
+		}
+		switch {
+		case header.Envelope != nil:
+			needKeystore = true
+		case len(header.Recipients) > 0:
+			needIdentities = true
+		default:
+			needPassphrase = true
+		}
+		return nil
+	})
+	if err != nil {
+		return Keys{}, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	var keys Keys
+	if needKeystore {
+		if keys.Keystore, err = LoadKeystore(); err != nil {
+			return Keys{}, err
+		}
+	}
+	if needIdentities {
+		if keys.Identities, err = LoadIdentities(identityFiles); err != nil {
+			return Keys{}, err
+		}
+	}
+	if needPassphrase {
+		if keys.Passphrase, err = ReadPassphrase(passphraseFile, false); err != nil {
+			return Keys{}, err
+		}
+	}
+
+	return keys, nil
+}
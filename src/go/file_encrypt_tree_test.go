@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+// assertEncrypted checks whether the file at name is a container.
+func assertEncrypted(t *testing.T, name string, want bool) {
+	t.Helper()
+
+	encrypted, err := IsEncryptedFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != want {
+		t.Errorf("%s encrypted = %v, want %v", name, encrypted, want)
+	}
+}
+
+func TestProcessTreeRoundTrip(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/data/docs", 0755)
+	mem.MkdirAll("/data/cache", 0755)
+	mem.WriteFile("/data/a.txt", []byte("a"), 0644)
+	mem.WriteFile("/data/docs/b.txt", []byte("b"), 0644)
+	mem.WriteFile("/data/c.log", []byte("c"), 0644)
+	mem.WriteFile("/data/cache/d.txt", []byte("d"), 0644)
+	encryptKeys, decryptKeys := identityKeys(t)
+
+	opts := TreeOptions{Include: []string{"*.txt"}, Exclude: []string{"cache"}, Keys: encryptKeys}
+	if err := ProcessTree("/data", TreeEncrypt, opts); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, "/data/a.txt", true)
+	assertEncrypted(t, "/data/docs/b.txt", true)
+	assertUnchanged(t, mem, "/data/c.log", "c")
+	assertUnchanged(t, mem, "/data/cache/d.txt", "d")
+
+	// Running again finds nothing left to encrypt.
+	before, _ := mem.ReadFile("/data/a.txt")
+	if err := ProcessTree("/data", TreeEncrypt, opts); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/data/a.txt", string(before))
+
+	if err := ProcessTree("/data", TreeDecrypt, TreeOptions{Keys: decryptKeys}); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/data/a.txt", "a")
+	assertUnchanged(t, mem, "/data/docs/b.txt", "b")
+}
+
+func TestProcessTreeLeavesTemporaryFiles(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/data", 0755)
+	mem.WriteFile("/data/notes", []byte("notes"), 0644)
+	// Temporary files of an interrupted run, or of another program still
+	// writing, with the suffixes of os.CreateTemp and MemFileSystem.
+	mem.WriteFile("/data/.notes.tmp-123456", []byte("partial"), 0644)
+	mem.WriteFile("/data/.notes.tmp-0a1b2c", []byte("in progress"), 0644)
+	encryptKeys, _ := identityKeys(t)
+
+	if err := ProcessTree("/data", TreeEncrypt, TreeOptions{Keys: encryptKeys}); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, "/data/notes", true)
+	assertUnchanged(t, mem, "/data/.notes.tmp-123456", "partial")
+	assertUnchanged(t, mem, "/data/.notes.tmp-0a1b2c", "in progress")
+}
+
+func TestProcessTreeResumesInterruptedShred(t *testing.T) {
+	const (
+		replacedLink   = "/data/.replaced" + shredPendingInfix + "0123456789abcdef"
+		unreplacedLink = "/data/.unreplaced" + shredPendingInfix + "fedcba9876543210"
+	)
+	setup := func(t *testing.T) *MemFileSystem {
+		mem := useMemFileSystem(t)
+		mem.MkdirAll("/data", 0755)
+		// Interrupted after the file was encrypted: the link holds the only
+		// copy of the plaintext.
+		mem.WriteFile("/data/replaced", []byte("replaced"), 0644)
+		mem.Link("/data/replaced", replacedLink)
+		encryptKeys, _ := identityKeys(t)
+		if err := CompressAndEncryptFile("/data/replaced", encryptKeys, CompressionOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		// Interrupted before the file was encrypted: the link is a second
+		// name for it.
+		mem.WriteFile("/data/unreplaced", []byte("unreplaced"), 0644)
+		mem.Link("/data/unreplaced", unreplacedLink)
+		return mem
+	}
+
+	t.Run("with shred", func(t *testing.T) {
+		mem := setup(t)
+		encryptKeys, _ := identityKeys(t)
+		if err := ProcessTree("/data", TreeEncrypt, TreeOptions{Keys: encryptKeys, ShredPasses: 1}); err != nil {
+			t.Fatal(err)
+		}
+		entries, _ := mem.ReadDir("/data")
+		if len(entries) != 2 {
+			t.Errorf("/data holds %d entries", len(entries))
+		}
+		assertEncrypted(t, "/data/unreplaced", true)
+	})
+
+	t.Run("without shred", func(t *testing.T) {
+		mem := setup(t)
+		encryptKeys, _ := identityKeys(t)
+		if err := ProcessTree("/data", TreeEncrypt, TreeOptions{Keys: encryptKeys}); err != nil {
+			t.Fatal(err)
+		}
+		// The plaintext is neither encrypted as if it were a file of its
+		// own nor deleted without being shredded.
+		assertUnchanged(t, mem, replacedLink, "replaced")
+		assertEncrypted(t, "/data/unreplaced", true)
+		if _, err := mem.Stat(unreplacedLink); err == nil {
+			t.Error("link to a file that was never replaced kept")
+		}
+	})
+}
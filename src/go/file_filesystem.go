@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileHandle is an open file of a FileSystem.
+type FileHandle interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.StringWriter
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Chmod(mode fs.FileMode) error
+}
+
+// FileSystem is the set of file system operations used by GoFiler. Every
+// command goes through fsys, so it can be pointed at something other than
+// the local disk, such as an in-memory file system in tests.
+type FileSystem interface {
+	Open(name string) (FileHandle, error)
+	Create(name string) (FileHandle, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (FileHandle, error)
+	CreateTemp(dir, pattern string) (FileHandle, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Link(oldName, newName string) error
+	Symlink(target, name string) error
+	Readlink(name string) (string, error)
+	Chmod(name string, mode fs.FileMode) error
+	Chown(name string, uid, gid int) error
+	Lchown(name string, uid, gid int) error
+	Owner(info fs.FileInfo) (uid, gid int, ok bool)
+	SameFile(a, b fs.FileInfo) bool
+	Chtimes(name string, atime, mtime time.Time) error
+	Abs(name string) (string, error)
+	Lock(name string) (io.Closer, error)
+}
+
+// fsys is the file system used by all commands.
+var fsys FileSystem = OSFileSystem{}
+
+// OSFileSystem is the FileSystem of the operating system.
+type OSFileSystem struct{}
+
+// Open opens the named file for reading.
+func (OSFileSystem) Open(name string) (FileHandle, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Create creates or truncates the named file.
+func (OSFileSystem) Create(name string) (FileHandle, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// OpenFile opens the named file with the given flags and permissions.
+func (OSFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (FileHandle, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// CreateTemp creates a new temporary file in dir, as os.CreateTemp does.
+func (OSFileSystem) CreateTemp(dir, pattern string) (FileHandle, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// ReadFile reads the whole named file.
+func (OSFileSystem) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+// WriteFile writes data to the named file, creating or truncating it.
+func (OSFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (OSFileSystem) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// Stat returns the file info of the named file, following symbolic links.
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+// Lstat returns the file info of the named file without following symbolic links.
+func (OSFileSystem) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+// Mkdir creates a directory.
+func (OSFileSystem) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+
+// MkdirAll creates a directory and any missing parents.
+func (OSFileSystem) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+
+// Remove removes a file or an empty directory.
+func (OSFileSystem) Remove(name string) error { return os.Remove(name) }
+
+// RemoveAll removes a file or directory and everything it contains.
+func (OSFileSystem) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+// Rename renames a file or directory, replacing an existing file at newName.
+func (OSFileSystem) Rename(oldName, newName string) error { return os.Rename(oldName, newName) }
+
+// Link creates newName as a hard link to oldName.
+func (OSFileSystem) Link(oldName, newName string) error { return os.Link(oldName, newName) }
+
+// Symlink creates name as a symbolic link to target.
+func (OSFileSystem) Symlink(target, name string) error { return os.Symlink(target, name) }
+
+// Readlink returns the target of a symbolic link.
+func (OSFileSystem) Readlink(name string) (string, error) { return os.Readlink(name) }
+
+// Chmod changes the mode of the named file.
+func (OSFileSystem) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+// Chown changes the owner and group of the named file.
+func (OSFileSystem) Chown(name string, uid, gid int) error { return os.Chown(name, uid, gid) }
+
+// Lchown changes the owner and group of the named file without following symbolic links.
+func (OSFileSystem) Lchown(name string, uid, gid int) error { return os.Lchown(name, uid, gid) }
+
+// Owner returns the owner and group recorded in info by the operating system.
+func (OSFileSystem) Owner(info fs.FileInfo) (uid, gid int, ok bool) { return systemOwner(info) }
+
+// SameFile reports whether two file infos describe the same file.
+func (OSFileSystem) SameFile(a, b fs.FileInfo) bool { return os.SameFile(a, b) }
+
+// Chtimes changes the access and modification times of the named file.
+func (OSFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Abs returns an absolute name for name, relative to the working directory.
+func (OSFileSystem) Abs(name string) (string, error) { return filepath.Abs(name) }
+
+// Lock takes an exclusive lock on the named file, creating it if needed,
+// and waits until other processes holding it release it. Closing the
+// result releases the lock; so does the process exiting.
+func (OSFileSystem) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, &fs.PathError{Op: "lock", Path: name, Err: err}
+	}
+
+	return file, nil
+}
+
+// walkDir walks the tree rooted at root on fsys like filepath.WalkDir,
+// calling fn for every file and directory in lexical order.
+func walkDir(fsys FileSystem, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirEntry(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+
+	return err
+}
+
+// walkDirEntry walks the file or directory at path for walkDir.
+func walkDirEntry(fsys FileSystem, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, filepath.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		// Report the error a second time, so fn can decide whether to go on.
+		if err = fn(path, d, err); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				err = nil
+			}
+			return err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if err := walkDirEntry(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Operations a Fault can be injected into. Open covers Open, Create,
+// OpenFile and CreateTemp; the others name the FileSystem or FileHandle
+// method they apply to.
+const (
+	FaultAny      = "*"
+	FaultOpen     = "open"
+	FaultRead     = "read"
+	FaultWrite    = "write"
+	FaultSync     = "sync"
+	FaultClose    = "close"
+	FaultTruncate = "truncate"
+	FaultStat     = "stat"
+	FaultReadDir  = "readdir"
+	FaultMkdir    = "mkdir"
+	FaultRemove   = "remove"
+	FaultRename   = "rename"
+	FaultLink     = "link"
+	FaultChmod    = "chmod"
+	FaultChown    = "chown"
+	FaultChtimes  = "chtimes"
+)
+
+// Fault describes an error injected by a FaultFileSystem.
+type Fault struct {
+	Op   string // operation to fail, or FaultAny
+	Path string // glob matched like -include patterns; empty matches every file
+
+	Err        error         // error returned; for short writes io.ErrShortWrite if nil
+	After      int           // matching calls that succeed before the fault triggers
+	Times      int           // number of calls that fail; 0 means every call after After
+	ShortWrite bool          // writes store half of their data before failing
+	Latency    time.Duration // delay added to matching calls, failing or not
+
+	fs       *FaultFileSystem // the file system the fault was injected into
+	calls    int
+	injected int
+}
+
+// FaultFileSystem wraps a FileSystem and injects errors, short writes and
+// latency into selected operations, to test how GoFiler copes with full
+// disks and failing hardware.
+type FaultFileSystem struct {
+	base FileSystem
+
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+// NewFaultFileSystem returns a FaultFileSystem over base without any faults.
+func NewFaultFileSystem(base FileSystem) *FaultFileSystem {
+	return &FaultFileSystem{base: base}
+}
+
+// Inject adds a fault and returns it, so its Injected count can be checked.
+func (f *FaultFileSystem) Inject(fault Fault) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	injected := &fault
+	injected.fs = f
+	f.faults = append(f.faults, injected)
+	return injected
+}
+
+// Reset removes all faults.
+func (f *FaultFileSystem) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// Injected returns how many times the fault has failed a call. It is safe
+// to call while the fault is being injected.
+func (fault *Fault) Injected() int {
+	if fault.fs == nil {
+		return 0
+	}
+	fault.fs.mu.Lock()
+	defer fault.fs.mu.Unlock()
+
+	return fault.injected
+}
+
+// check returns the fault that fails the op on name, if any, after
+// sleeping for the latency of every matching fault.
+func (f *FaultFileSystem) check(op, name string) *Fault {
+	f.mu.Lock()
+	var failing *Fault
+	var latency time.Duration
+	for _, fault := range f.faults {
+		if fault.Op != FaultAny && fault.Op != op {
+			continue
+		}
+		if fault.Path != "" && !matchesAny([]string{fault.Path}, name) {
+			continue
+		}
+		latency += fault.Latency
+
+		fault.calls++
+		if failing != nil || fault.calls <= fault.After {
+			continue
+		}
+		if fault.Times > 0 && fault.injected >= fault.Times {
+			continue
+		}
+		if fault.Err == nil && !fault.ShortWrite {
+			continue
+		}
+		fault.injected++
+		failing = fault
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return failing
+}
+
+// fail returns the error of the fault failing op on name, or nil.
+func (f *FaultFileSystem) fail(op, name string) error {
+	if fault := f.check(op, name); fault != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fault.err()}
+	}
+
+	return nil
+}
+
+// err returns the error the fault injects.
+func (fault *Fault) err() error {
+	if fault.Err == nil {
+		return io.ErrShortWrite
+	}
+
+	return fault.Err
+}
+
+// faultFile is an open file of a FaultFileSystem.
+type faultFile struct {
+	FileHandle
+	fs *FaultFileSystem
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.fail(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.FileHandle.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fail(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.FileHandle.ReadAt(p, off)
+}
+
+// write applies a write fault to a write of p through write.
+func (f *faultFile) write(p []byte, write func([]byte) (int, error)) (int, error) {
+	fault := f.fs.check(FaultWrite, f.Name())
+	if fault == nil {
+		return write(p)
+	}
+
+	n := 0
+	if fault.ShortWrite {
+		var err error
+		if n, err = write(p[:len(p)/2]); err != nil {
+			return n, err
+		}
+	}
+	return n, &fs.PathError{Op: FaultWrite, Path: f.Name(), Err: fault.err()}
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	return f.write(p, f.FileHandle.Write)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, func(b []byte) (int, error) { return f.FileHandle.WriteAt(b, off) })
+}
+
+func (f *faultFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.fail(FaultSync, f.Name()); err != nil {
+		return err
+	}
+	return f.FileHandle.Sync()
+}
+
+// Close closes the file even when a fault fails it, as a failing close
+// still releases the descriptor.
+func (f *faultFile) Close() error {
+	err := f.FileHandle.Close()
+	if faultErr := f.fs.fail(FaultClose, f.Name()); faultErr != nil {
+		return faultErr
+	}
+	return err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.fail(FaultTruncate, f.Name()); err != nil {
+		return err
+	}
+	return f.FileHandle.Truncate(size)
+}
+
+func (f *faultFile) Chmod(mode fs.FileMode) error {
+	if err := f.fs.fail(FaultChmod, f.Name()); err != nil {
+		return err
+	}
+	return f.FileHandle.Chmod(mode)
+}
+
+func (f *faultFile) Stat() (fs.FileInfo, error) {
+	if err := f.fs.fail(FaultStat, f.Name()); err != nil {
+		return nil, err
+	}
+	return f.FileHandle.Stat()
+}
+
+// open applies open faults to name and wraps the file opened by open.
+func (f *FaultFileSystem) open(name string, open func() (FileHandle, error)) (FileHandle, error) {
+	if err := f.fail(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{FileHandle: file, fs: f}, nil
+}
+
+// Open opens the named file for reading.
+func (f *FaultFileSystem) Open(name string) (FileHandle, error) {
+	return f.open(name, func() (FileHandle, error) { return f.base.Open(name) })
+}
+
+// Create creates or truncates the named file.
+func (f *FaultFileSystem) Create(name string) (FileHandle, error) {
+	return f.open(name, func() (FileHandle, error) { return f.base.Create(name) })
+}
+
+// OpenFile opens the named file with the given flags and permissions.
+func (f *FaultFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (FileHandle, error) {
+	return f.open(name, func() (FileHandle, error) { return f.base.OpenFile(name, flag, perm) })
+}
+
+// CreateTemp creates a temporary file. Open faults are matched against the
+// directory joined with the pattern.
+func (f *FaultFileSystem) CreateTemp(dir, pattern string) (FileHandle, error) {
+	return f.open(filepath.Join(dir, pattern), func() (FileHandle, error) { return f.base.CreateTemp(dir, pattern) })
+}
+
+// ReadFile reads the whole named file through the faults of Open and Read.
+func (f *FaultFileSystem) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// WriteFile writes the named file through the faults of Open and Write.
+func (f *FaultFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := f.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadDir returns the entries of the named directory.
+func (f *FaultFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.fail(FaultReadDir, name); err != nil {
+		return nil, err
+	}
+	return f.base.ReadDir(name)
+}
+
+// Stat returns the file info of the named file.
+func (f *FaultFileSystem) Stat(name string) (fs.FileInfo, error) {
+	if err := f.fail(FaultStat, name); err != nil {
+		return nil, err
+	}
+	return f.base.Stat(name)
+}
+
+// Lstat returns the file info of the named file without following links.
+func (f *FaultFileSystem) Lstat(name string) (fs.FileInfo, error) {
+	if err := f.fail(FaultStat, name); err != nil {
+		return nil, err
+	}
+	return f.base.Lstat(name)
+}
+
+// Mkdir creates a directory.
+func (f *FaultFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	if err := f.fail(FaultMkdir, name); err != nil {
+		return err
+	}
+	return f.base.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (f *FaultFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	if err := f.fail(FaultMkdir, name); err != nil {
+		return err
+	}
+	return f.base.MkdirAll(name, perm)
+}
+
+// Remove removes a file or an empty directory.
+func (f *FaultFileSystem) Remove(name string) error {
+	if err := f.fail(FaultRemove, name); err != nil {
+		return err
+	}
+	return f.base.Remove(name)
+}
+
+// RemoveAll removes a file or directory and everything it contains.
+func (f *FaultFileSystem) RemoveAll(name string) error {
+	if err := f.fail(FaultRemove, name); err != nil {
+		return err
+	}
+	return f.base.RemoveAll(name)
+}
+
+// Rename renames a file or directory. Faults are matched against both names.
+func (f *FaultFileSystem) Rename(oldName, newName string) error {
+	if fault := f.check(FaultRename, oldName); fault != nil {
+		return &os.LinkError{Op: FaultRename, Old: oldName, New: newName, Err: fault.err()}
+	}
+	if fault := f.check(FaultRename, newName); fault != nil {
+		return &os.LinkError{Op: FaultRename, Old: oldName, New: newName, Err: fault.err()}
+	}
+	return f.base.Rename(oldName, newName)
+}
+
+// Link creates newName as a hard link to oldName.
+func (f *FaultFileSystem) Link(oldName, newName string) error {
+	if fault := f.check(FaultLink, newName); fault != nil {
+		return &os.LinkError{Op: FaultLink, Old: oldName, New: newName, Err: fault.err()}
+	}
+	return f.base.Link(oldName, newName)
+}
+
+// Symlink creates name as a symbolic link to target.
+func (f *FaultFileSystem) Symlink(target, name string) error {
+	if fault := f.check(FaultLink, name); fault != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: name, Err: fault.err()}
+	}
+	return f.base.Symlink(target, name)
+}
+
+// Readlink returns the target of a symbolic link.
+func (f *FaultFileSystem) Readlink(name string) (string, error) {
+	if err := f.fail(FaultStat, name); err != nil {
+		return "", err
+	}
+	return f.base.Readlink(name)
+}
+
+// Chmod changes the mode of the named file.
+func (f *FaultFileSystem) Chmod(name string, mode fs.FileMode) error {
+	if err := f.fail(FaultChmod, name); err != nil {
+		return err
+	}
+	return f.base.Chmod(name, mode)
+}
+
+// Chown changes the owner and group of the named file.
+func (f *FaultFileSystem) Chown(name string, uid, gid int) error {
+	if err := f.fail(FaultChown, name); err != nil {
+		return err
+	}
+	return f.base.Chown(name, uid, gid)
+}
+
+// Lchown changes the owner and group of the named file without following links.
+func (f *FaultFileSystem) Lchown(name string, uid, gid int) error {
+	if err := f.fail(FaultChown, name); err != nil {
+		return err
+	}
+	return f.base.Lchown(name, uid, gid)
+}
+
+// Owner returns the owner and group recorded in info by the base file system.
+func (f *FaultFileSystem) Owner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return f.base.Owner(info)
+}
+
+// SameFile reports whether two file infos describe the same file, as the
+// base file system does.
+func (f *FaultFileSystem) SameFile(a, b fs.FileInfo) bool {
+	return f.base.SameFile(a, b)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (f *FaultFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.fail(FaultChtimes, name); err != nil {
+		return err
+	}
+	return f.base.Chtimes(name, atime, mtime)
+}
+
+// Abs returns an absolute name for name.
+func (f *FaultFileSystem) Abs(name string) (string, error) {
+	return f.base.Abs(name)
+}
+
+// Lock takes an exclusive lock on the named file, applying open faults to it.
+func (f *FaultFileSystem) Lock(name string) (io.Closer, error) {
+	if err := f.fail(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	return f.base.Lock(name)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useFaultFileSystem points fsys at a fault-injecting file system over a new
+// in-memory one for the duration of the test.
+func useFaultFileSystem(t *testing.T) (*FaultFileSystem, *MemFileSystem) {
+	t.Helper()
+
+	mem := useMemFileSystem(t)
+	faults := NewFaultFileSystem(mem)
+	fsys = faults
+
+	return faults, mem
+}
+
+// faultCases are the faults every operation is run under. Paths are left to
+// the tests, which aim them at the files the operation writes.
+var faultCases = []struct {
+	name  string
+	fault Fault
+}{
+	{"ENOSPC on write", Fault{Op: FaultWrite, Err: syscall.ENOSPC}},
+	{"short write", Fault{Op: FaultWrite, ShortWrite: true}},
+	{"EIO on sync", Fault{Op: FaultSync, Err: syscall.EIO}},
+	{"EIO on close", Fault{Op: FaultClose, Err: syscall.EIO}},
+	{"EXDEV on rename", Fault{Op: FaultRename, Err: syscall.EXDEV}},
+	{"ENOSPC on create", Fault{Op: FaultOpen, Err: syscall.ENOSPC}},
+}
+
+// assertUnchanged fails the test if the named file does not hold want.
+func assertUnchanged(t *testing.T, mem *MemFileSystem, name, want string) {
+	t.Helper()
+
+	data, err := mem.ReadFile(name)
+	if err != nil || string(data) != want {
+		t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+	}
+}
+
+// assertNoTempFiles fails the test if a temporary file was left in dir.
+func assertNoTempFiles(t *testing.T, mem *MemFileSystem, dir string) {
+	t.Helper()
+
+	entries, err := mem.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Errorf("temporary file %s left in %s", entry.Name(), dir)
+		}
+	}
+}
+
+func TestFaultFileSystemInjects(t *testing.T) {
+	faults := NewFaultFileSystem(NewMemFileSystem())
+	faults.WriteFile("/a.txt", []byte("a"), 0644)
+
+	fault := faults.Inject(Fault{Op: FaultStat, Path: "*.txt", Err: syscall.EIO, After: 1, Times: 2})
+	var errs []error
+	for i := 0; i < 4; i++ {
+		_, err := faults.Stat("/a.txt")
+		errs = append(errs, err)
+	}
+	if errs[0] != nil || !errors.Is(errs[1], syscall.EIO) || !errors.Is(errs[2], syscall.EIO) || errs[3] != nil {
+		t.Errorf("Stat errors = %v", errs)
+	}
+	if fault.Injected() != 2 {
+		t.Errorf("Injected = %d, want 2", fault.Injected())
+	}
+	if _, err := faults.Stat("/"); err != nil {
+		t.Errorf("fault applied to a name it does not match: %v", err)
+	}
+
+	faults.Reset()
+	faults.Inject(Fault{Op: FaultWrite, ShortWrite: true})
+	f, _ := faults.Create("/b.txt")
+	n, err := f.Write([]byte("1234"))
+	f.Close()
+	if n != 2 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("short write = %d, %v", n, err)
+	}
+
+	faults.Reset()
+	faults.Inject(Fault{Op: FaultAny, Latency: 20 * time.Millisecond})
+	start := time.Now()
+	faults.Stat("/a.txt")
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("latency not injected: Stat took %v", elapsed)
+	}
+}
+
+func TestFaultInjectedWhileRunning(t *testing.T) {
+	faults := NewFaultFileSystem(NewMemFileSystem())
+	fault := faults.Inject(Fault{Op: FaultStat, Err: syscall.EIO})
+
+	// Polling the count races with the calls it counts unless both lock.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			faults.Stat("/")
+		}
+		close(done)
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+			fault.Injected()
+		}
+	}
+	if fault.Injected() != 100 {
+		t.Errorf("Injected = %d, want 100", fault.Injected())
+	}
+	if (&Fault{}).Injected() != 0 {
+		t.Error("fault that was never injected counts calls")
+	}
+}
+
+func TestBackupUnderFaults(t *testing.T) {
+	for _, c := range faultCases {
+		t.Run(c.name, func(t *testing.T) {
+			faults, mem := useFaultFileSystem(t)
+			FileOpWrite("data.txt", "original")
+
+			fault := c.fault
+			fault.Path = BackupDir + "/*"
+			faults.Inject(fault)
+			if err := BackupFile("data.txt", BackupOptions{}); err == nil {
+				t.Fatal("backup succeeded under the fault")
+			}
+			faults.Reset()
+
+			assertUnchanged(t, mem, "data.txt", "original")
+			assertNoTempFiles(t, mem, BackupDir)
+			if _, found, _ := latestBackup("data.txt"); found {
+				t.Error("a failed backup was recorded in the catalog")
+			}
+
+			// Once the fault is gone, the same backup goes through.
+			if err := BackupFile("data.txt", BackupOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRestoreUnderFaults(t *testing.T) {
+	for _, c := range faultCases {
+		t.Run(c.name, func(t *testing.T) {
+			faults, mem := useFaultFileSystem(t)
+			FileOpWrite("data.txt", "backed up")
+			if err := BackupFile("data.txt", BackupOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			FileOpWrite("data.txt", "current")
+
+			fault := c.fault
+			fault.Path = "*data.txt*"
+			faults.Inject(fault)
+			if err := RestoreBackup("data.txt", RestoreOptions{}); err == nil {
+				t.Fatal("restore succeeded under the fault")
+			}
+			faults.Reset()
+
+			assertUnchanged(t, mem, "data.txt", "current")
+			assertNoTempFiles(t, mem, "/")
+
+			if err := RestoreBackup("data.txt", RestoreOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			assertUnchanged(t, mem, "data.txt", "backed up")
+		})
+	}
+}
+
+func TestEncryptUnderFaults(t *testing.T) {
+	keys := Keys{Passphrase: []byte("fault passphrase")}
+	opts := CompressionOptions{Codec: "gzip"}
+
+	for _, c := range faultCases {
+		t.Run(c.name, func(t *testing.T) {
+			faults, mem := useFaultFileSystem(t)
+			plain := strings.Repeat("plain text ", 1000)
+			FileOpWrite("data.txt", plain)
+
+			fault := c.fault
+			fault.Path = ".data.txt.tmp-*"
+			if c.fault.Op == FaultRename {
+				fault.Path = "data.txt"
+			}
+			faults.Inject(fault)
+			if err := CompressAndEncryptFile("data.txt", keys, opts); err == nil {
+				t.Fatal("encryption succeeded under the fault")
+			}
+			faults.Reset()
+
+			assertUnchanged(t, mem, "data.txt", plain)
+			assertNoTempFiles(t, mem, "/")
+
+			if err := CompressAndEncryptFile("data.txt", keys, opts); err != nil {
+				t.Fatal(err)
+			}
+			encrypted, _ := mem.ReadFile("data.txt")
+
+			faults.Inject(fault)
+			if err := DecryptAndDecompressFile("data.txt", keys); err == nil {
+				t.Fatal("decryption succeeded under the fault")
+			}
+			faults.Reset()
+
+			assertUnchanged(t, mem, "data.txt", string(encrypted))
+			assertNoTempFiles(t, mem, "/")
+
+			if err := DecryptAndDecompressFile("data.txt", keys); err != nil {
+				t.Fatal(err)
+			}
+			assertUnchanged(t, mem, "data.txt", plain)
+		})
+	}
+}
+
+func TestSaveUnderFaults(t *testing.T) {
+	for _, c := range faultCases {
+		t.Run(c.name, func(t *testing.T) {
+			faults, mem := useFaultFileSystem(t)
+			FileOpWrite("doc.txt", "saved before")
+
+			file := NewFile("doc.txt")
+			file.Content = "saved after"
+
+			fault := c.fault
+			fault.Path = ".doc.txt.tmp-*"
+			if c.fault.Op == FaultRename {
+				fault.Path = "doc.txt"
+			}
+			faults.Inject(fault)
+			if err := file.Save(); err == nil {
+				t.Fatal("save succeeded under the fault")
+			}
+			faults.Reset()
+
+			assertUnchanged(t, mem, "doc.txt", "saved before")
+			assertNoTempFiles(t, mem, "/")
+
+			if err := file.Save(); err != nil {
+				t.Fatal(err)
+			}
+			assertUnchanged(t, mem, "doc.txt", "saved after")
+		})
+	}
+}
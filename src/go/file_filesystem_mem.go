@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memNode is a file or directory of a MemFileSystem. Hard links share a node.
+type memNode struct {
+	mode     fs.FileMode
+	data     []byte
+	modTime  time.Time
+	uid, gid int
+}
+
+// MemFileSystem is a FileSystem held entirely in memory. Relative names are
+// resolved against its root. It is safe for concurrent use.
+type MemFileSystem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode      // keyed by clean, absolute, slash-separated path
+	locks map[string]chan struct{} // held locks, keyed like nodes
+}
+
+// NewMemFileSystem returns an empty in-memory file system.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		nodes: map[string]*memNode{"/": {mode: fs.ModeDir | 0755, modTime: time.Now()}},
+	}
+}
+
+// memPath returns the key of a name in the node map.
+func memPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// parentDir checks that the parent of p exists and is a directory. The
+// caller holds m.mu.
+func (m *MemFileSystem) parentDir(p string) error {
+	parent, ok := m.nodes[path.Dir(p)]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if !parent.mode.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	return nil
+}
+
+// hasChildren reports whether the directory p has any entries. The caller
+// holds m.mu.
+func (m *MemFileSystem) hasChildren(p string) bool {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for key := range m.nodes {
+		if key != p && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Open opens the named file for reading.
+func (m *MemFileSystem) Open(name string) (FileHandle, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file.
+func (m *MemFileSystem) Create(name string) (FileHandle, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile opens the named file with the given flags and permissions.
+func (m *MemFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (FileHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	node, ok := m.nodes[p]
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && node.mode.IsDir() && writable:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case ok && writable && flag&os.O_TRUNC != 0:
+		node.data = nil
+		node.modTime = time.Now()
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := m.parentDir(p); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		node = &memNode{mode: perm & fs.ModePerm, modTime: time.Now()}
+		m.nodes[p] = node
+	}
+
+	return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+}
+
+// CreateTemp creates a new temporary file in dir. The last "*" in pattern is
+// replaced by a random string, which is appended if there is no "*".
+func (m *MemFileSystem) CreateTemp(dir, pattern string) (FileHandle, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for {
+		random := make([]byte, 6)
+		if _, err := io.ReadFull(rand.Reader, random); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, prefix+hex.EncodeToString(random)+suffix)
+		file, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			return file, err
+		}
+	}
+}
+
+// ReadFile reads the whole named file.
+func (m *MemFileSystem) ReadFile(name string) ([]byte, error) {
+	file, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// WriteFile writes data to the named file, creating or truncating it.
+func (m *MemFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	node, ok := m.nodes[p]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: fs.ErrNotExist}
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	var entries []fs.DirEntry
+	for key, child := range m.nodes {
+		if key != p && path.Dir(key) == p {
+			entries = append(entries, fs.FileInfoToDirEntry(child.info(path.Base(key))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// Stat returns the file info of the named file.
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	node, ok := m.nodes[p]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return node.info(path.Base(p)), nil
+}
+
+// Lstat returns the file info of the named file. There are no symbolic
+// links in memory, so it is the same as Stat.
+func (m *MemFileSystem) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+// Mkdir creates a directory.
+func (m *MemFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	if _, ok := m.nodes[p]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.parentDir(p); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	m.nodes[p] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (m *MemFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	current := "/"
+	for _, part := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		node, ok := m.nodes[current]
+		if ok && !node.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		if !ok {
+			m.nodes[current] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+		}
+	}
+
+	return nil
+}
+
+// Remove removes a file or an empty directory.
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	node, ok := m.nodes[p]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case p == "/":
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	case node.mode.IsDir() && m.hasChildren(p):
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(m.nodes, p)
+	return nil
+}
+
+// RemoveAll removes a file or directory and everything it contains. A
+// missing name is not an error.
+func (m *MemFileSystem) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	if p == "/" {
+		return &fs.PathError{Op: "unlinkat", Path: name, Err: syscall.EBUSY}
+	}
+	for key := range m.nodes {
+		if key == p || strings.HasPrefix(key, p+"/") {
+			delete(m.nodes, key)
+		}
+	}
+
+	return nil
+}
+
+// Rename renames a file or directory. An existing file at newName is
+// replaced, as is an existing empty directory when renaming a directory.
+func (m *MemFileSystem) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldPath, newPath := memPath(oldName), memPath(newName)
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+
+	node, ok := m.nodes[oldPath]
+	if !ok {
+		return fail(fs.ErrNotExist)
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if oldPath == "/" || strings.HasPrefix(newPath, oldPath+"/") {
+		return fail(syscall.EINVAL)
+	}
+	if err := m.parentDir(newPath); err != nil {
+		return fail(err)
+	}
+	if target, ok := m.nodes[newPath]; ok {
+		switch {
+		case node.mode.IsDir() && !target.mode.IsDir():
+			return fail(syscall.ENOTDIR)
+		case !node.mode.IsDir() && target.mode.IsDir():
+			return fail(syscall.EISDIR)
+		case target.mode.IsDir() && m.hasChildren(newPath):
+			return fail(syscall.ENOTEMPTY)
+		}
+	}
+
+	moved := make(map[string]*memNode)
+	for key, n := range m.nodes {
+		if key == oldPath || strings.HasPrefix(key, oldPath+"/") {
+			moved[newPath+strings.TrimPrefix(key, oldPath)] = n
+			delete(m.nodes, key)
+		}
+	}
+	for key, n := range moved {
+		m.nodes[key] = n
+	}
+
+	return nil
+}
+
+// Link creates newName as a hard link to the file oldName.
+func (m *MemFileSystem) Link(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldPath, newPath := memPath(oldName), memPath(newName)
+	fail := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: err}
+	}
+
+	node, ok := m.nodes[oldPath]
+	switch {
+	case !ok:
+		return fail(fs.ErrNotExist)
+	case node.mode.IsDir():
+		return fail(syscall.EPERM)
+	}
+	if _, ok := m.nodes[newPath]; ok {
+		return fail(fs.ErrExist)
+	}
+	if err := m.parentDir(newPath); err != nil {
+		return fail(err)
+	}
+
+	m.nodes[newPath] = node
+	return nil
+}
+
+// Symlink fails, since there are no symbolic links in memory.
+func (m *MemFileSystem) Symlink(target, name string) error {
+	return &os.LinkError{Op: "symlink", Old: target, New: name, Err: syscall.ENOTSUP}
+}
+
+// Readlink fails, since there are no symbolic links in memory.
+func (m *MemFileSystem) Readlink(name string) (string, error) {
+	if _, err := m.Lstat(name); err != nil {
+		return "", err
+	}
+
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+}
+
+// update applies change to the node of the named file.
+func (m *MemFileSystem) update(op, name string, change func(*memNode)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[memPath(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	change(node)
+
+	return nil
+}
+
+// Chmod changes the permission bits of the named file.
+func (m *MemFileSystem) Chmod(name string, mode fs.FileMode) error {
+	return m.update("chmod", name, func(n *memNode) {
+		n.mode = n.mode&^fs.ModePerm | mode&fs.ModePerm
+	})
+}
+
+// Chown changes the owner and group of the named file.
+func (m *MemFileSystem) Chown(name string, uid, gid int) error {
+	return m.update("chown", name, func(n *memNode) {
+		n.uid, n.gid = uid, gid
+	})
+}
+
+// Lchown changes the owner and group of the named file, like Chown.
+func (m *MemFileSystem) Lchown(name string, uid, gid int) error {
+	return m.Chown(name, uid, gid)
+}
+
+// Owner returns the owner and group of the file info describes.
+func (m *MemFileSystem) Owner(info fs.FileInfo) (uid, gid int, ok bool) {
+	node, ok := info.Sys().(*memNode)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return node.uid, node.gid, true
+}
+
+// SameFile reports whether two file infos describe the same node.
+func (m *MemFileSystem) SameFile(a, b fs.FileInfo) bool {
+	node, ok := a.Sys().(*memNode)
+	return ok && node == b.Sys()
+}
+
+// Chtimes changes the modification time of the named file. Access times
+// are not tracked in memory.
+func (m *MemFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return m.update("chtimes", name, func(n *memNode) {
+		n.modTime = mtime
+	})
+}
+
+// Abs returns the absolute name of name. The working directory of a
+// MemFileSystem is its root.
+func (m *MemFileSystem) Abs(name string) (string, error) {
+	return filepath.FromSlash(memPath(name)), nil
+}
+
+// Lock takes an exclusive lock on the named file, creating it if needed,
+// and waits until it is free. Locks only exclude other users of the same
+// MemFileSystem. Closing the result releases the lock.
+func (m *MemFileSystem) Lock(name string) (io.Closer, error) {
+	file, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]chan struct{})
+	}
+	lock, ok := m.locks[memPath(name)]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.locks[memPath(name)] = lock
+	}
+	m.mu.Unlock()
+
+	lock <- struct{}{}
+	return &memLock{held: lock}, nil
+}
+
+// memLock is a lock held on a MemFileSystem file.
+type memLock struct {
+	once sync.Once
+	held chan struct{}
+}
+
+// Close releases the lock. Closing it again has no effect.
+func (l *memLock) Close() error {
+	l.once.Do(func() { <-l.held })
+	return nil
+}
+
+// info returns a snapshot of the node's metadata under the given name.
+func (n *memNode) info(name string) fs.FileInfo {
+	return memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime, node: n}
+}
+
+// memFileInfo is the fs.FileInfo of a MemFileSystem node.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	node    *memNode
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return i.node }
+
+// memFile is an open file of a MemFileSystem.
+type memFile struct {
+	fs     *MemFileSystem
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+// check returns an error if the file is closed or was not opened for the
+// kind of access requested. The caller holds f.fs.mu.
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	case !write && f.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	case f.node.mode.IsDir():
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// writeAt writes p at off, growing the file as needed. The caller holds f.fs.mu.
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	f.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errors.New("invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.writeAt(p, off)
+
+	return len(p), nil
+}
+
+func (f *memFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+
+	return nil
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return f.node.info(path.Base(memPath(f.name))), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return nil
+}
+
+func (f *memFile) Chmod(mode fs.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "chmod", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.node.mode = f.node.mode&^fs.ModePerm | mode&fs.ModePerm
+
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	resized := make([]byte, size)
+	copy(resized, f.node.data)
+	f.node.data = resized
+	f.node.modTime = time.Now()
+
+	return nil
+}
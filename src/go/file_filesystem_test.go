@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useMemFileSystem points fsys at a new in-memory file system for the
+// duration of the test.
+func useMemFileSystem(t *testing.T) *MemFileSystem {
+	t.Helper()
+
+	mem := NewMemFileSystem()
+	saved := fsys
+	fsys = mem
+	t.Cleanup(func() { fsys = saved })
+
+	return mem
+}
+
+func TestMemFileSystemFiles(t *testing.T) {
+	mem := NewMemFileSystem()
+
+	if err := mem.WriteFile("a.txt", []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(" world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("read from a write-only file succeeded")
+	}
+	f.Close()
+
+	data, err := mem.ReadFile("a.txt")
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	info, err := mem.Stat("a.txt")
+	if err != nil || info.Size() != 11 || info.Mode().Perm() != 0640 {
+		t.Fatalf("Stat = %v, %v", info, err)
+	}
+
+	if _, err := mem.OpenFile("a.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive create of an existing file: %v", err)
+	}
+	if _, err := mem.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open of a missing file: %v", err)
+	}
+	if err := mem.WriteFile("no/such/dir/b", nil, 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("create in a missing directory: %v", err)
+	}
+
+	if err := mem.Link("a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	mem.WriteFile("b.txt", []byte("linked"), 0644)
+	if data, _ := mem.ReadFile("a.txt"); string(data) != "linked" {
+		t.Errorf("hard link does not share content: %q", data)
+	}
+	a, _ := mem.Stat("a.txt")
+	b, _ := mem.Stat("b.txt")
+	if !mem.SameFile(a, b) {
+		t.Error("hard links are not the same file")
+	}
+}
+
+func TestMemFileSystemDirectories(t *testing.T) {
+	mem := NewMemFileSystem()
+
+	if err := mem.MkdirAll("/x/y/z", 0755); err != nil {
+		t.Fatal(err)
+	}
+	mem.WriteFile("/x/y/z/f", []byte("f"), 0644)
+	mem.WriteFile("/x/g", []byte("g"), 0644)
+
+	if err := mem.Remove("/x"); err == nil {
+		t.Error("removed a non-empty directory")
+	}
+	if err := mem.Rename("/x", "/x/y/inside"); err == nil {
+		t.Error("renamed a directory into itself")
+	}
+	if err := mem.Rename("/x", "/w"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mem.ReadFile("/w/y/z/f"); err != nil || string(data) != "f" {
+		t.Fatalf("file not moved with its directory: %q, %v", data, err)
+	}
+
+	entries, err := mem.ReadDir("/w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "g" || !entries[1].IsDir() || entries[1].Name() != "y" {
+		t.Fatalf("ReadDir = %v", entries)
+	}
+
+	var walked []string
+	walkDir(mem, "/w", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if want := []string{"/w", "/w/g", "/w/y", "/w/y/z", "/w/y/z/f"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+
+	if err := mem.RemoveAll("/w"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/w/y"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("RemoveAll left %v", err)
+	}
+}
+
+func TestMemFileSystemTempFiles(t *testing.T) {
+	mem := NewMemFileSystem()
+
+	f, err := mem.CreateTemp("/", ".data.tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("0123456789"))
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "234" {
+		t.Fatalf("read after seek = %q, %v", buf, err)
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("x")); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("write after close: %v", err)
+	}
+
+	if err := mem.Rename(f.Name(), "/data"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mem.ReadFile("/data"); string(data) != "0123" {
+		t.Errorf("data = %q", data)
+	}
+}
+
+func TestCommandsRunOnMemFileSystem(t *testing.T) {
+	mem := useMemFileSystem(t)
+
+	if err := FileOpWrite("notes.txt", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BackupFile("notes.txt", BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := FileOpAppend("notes.txt", " and second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := FileOpRename("notes.txt", "renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := FileOpRename("renamed.txt", "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup("notes.txt", RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := FileOpRead("notes.txt")
+	if err != nil || data != "first" {
+		t.Fatalf("restored content = %q, %v", data, err)
+	}
+	if _, err := mem.Stat(BackupDir + "/" + CatalogFile); err != nil {
+		t.Errorf("catalog not written to the in-memory file system: %v", err)
+	}
+}
+
+func TestLockExcludesOtherHolders(t *testing.T) {
+	for name, fsys := range map[string]FileSystem{"os": OSFileSystem{}, "mem": NewMemFileSystem()} {
+		t.Run(name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "lock")
+			fsys.MkdirAll(filepath.Dir(name), 0755)
+
+			first, err := fsys.Lock(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			acquired := make(chan io.Closer)
+			go func() {
+				second, err := fsys.Lock(name)
+				if err != nil {
+					t.Error(err)
+				}
+				acquired <- second
+			}()
+
+			select {
+			case <-acquired:
+				t.Fatal("lock taken twice")
+			case <-time.After(50 * time.Millisecond):
+			}
+			first.Close()
+			select {
+			case second := <-acquired:
+				second.Close()
+			case <-time.After(5 * time.Second):
+				t.Fatal("lock not released")
+			}
+		})
+	}
+}
+
+func TestFileSystemOwnerAndIdentity(t *testing.T) {
+	mem := NewMemFileSystem()
+	mem.MkdirAll("/root", 0755)
+	sandbox, err := NewSandboxFileSystem("/root", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fsys := range map[string]FileSystem{"os": OSFileSystem{}, "mem": NewMemFileSystem(), "sandbox": sandbox} {
+		t.Run(name, func(t *testing.T) {
+			dir := "/dir"
+			if name == "os" {
+				dir = t.TempDir()
+			}
+			fsys.MkdirAll(dir, 0755)
+			a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+			fsys.WriteFile(a, []byte("a"), 0644)
+			fsys.WriteFile(c, []byte("c"), 0644)
+			if err := fsys.Link(a, b); err != nil {
+				t.Fatal(err)
+			}
+
+			infoA, _ := fsys.Lstat(a)
+			infoB, _ := fsys.Lstat(b)
+			infoC, _ := fsys.Lstat(c)
+			if !fsys.SameFile(infoA, infoB) {
+				t.Error("hard links are not the same file")
+			}
+			if fsys.SameFile(infoA, infoC) {
+				t.Error("different files are the same file")
+			}
+
+			want := os.Getuid()
+			if name != "os" {
+				want = 1000
+				fsys.Chown(a, 1000, 100)
+				infoA, _ = fsys.Lstat(a)
+			}
+			uid, _, ok := fsys.Owner(infoA)
+			if name != "os" && !ok {
+				t.Fatal("owner unknown")
+			}
+			if ok && uid != want {
+				t.Errorf("owner = %d, want %d", uid, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// JournalFile is the name of the undo journal inside the GoFiler home.
+// What operations replaced is kept next to it, in JournalDir.
+const (
+	JournalFile = "journal.json"
+	JournalDir  = "journal"
+)
+
+// JournalLockFile is locked while the journal is read and updated, so that
+// concurrent commands do not lose each other's entries.
+const JournalLockFile = "journal.lock"
+
+// journalVersion is the current version of the journal format.
+const journalVersion = 1
+
+// journalLimit is how many operations the journal keeps. Older ones can no
+// longer be undone, and what was kept for them is deleted.
+const journalLimit = 100
+
+// JournalEntry records an operation with what is needed to undo it.
+type JournalEntry struct {
+	ID       int         `json:"id"`
+	Op       string      `json:"op"`
+	Path     string      `json:"path"`               // absolute path the operation changed, or moved away
+	Dest     string      `json:"dest,omitempty"`     // where a rename or move put Path
+	Snapshot bool        `json:"snapshot,omitempty"` // whether what the operation replaced is kept in JournalDir
+	Trash    string      `json:"trash,omitempty"`    // name of a deleted item in the trash
+	Mode     fs.FileMode `json:"mode,omitempty"`     // permissions before a chmod
+	Final    bool        `json:"final,omitempty"`    // whether the operation cannot be undone, e.g. shredding
+	Time     time.Time   `json:"time"`
+}
+
+// Journal lists the operations that can be undone, oldest first.
+type Journal struct {
+	Version int            `json:"version"`
+	Entries []JournalEntry `json:"entries"`
+
+	home string
+}
+
+// loadJournal reads the journal. A missing journal yields an empty one.
+func loadJournal() (*Journal, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return nil, err
+	}
+	journal := &Journal{Version: journalVersion, home: home}
+
+	data, err := fsys.ReadFile(filepath.Join(home, JournalFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the journal: %w", err)
+	}
+
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("failed to parse the journal: %w", err)
+	}
+	if journal.Version > journalVersion {
+		return nil, fmt.Errorf("journal version %d is newer than supported version %d", journal.Version, journalVersion)
+	}
+
+	return journal, nil
+}
+
+// lockJournal takes the journal lock, waiting while another command holds
+// it. Closing the result releases it.
+func lockJournal() (io.Closer, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsys.MkdirAll(home, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create GoFiler home: %w", err)
+	}
+	lock, err := fsys.Lock(filepath.Join(home, JournalLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the journal: %w", err)
+	}
+
+	return lock, nil
+}
+
+// save writes the journal, replacing the previous one atomically.
+func (j *Journal) save() error {
+	if err := fsys.MkdirAll(j.home, 0700); err != nil {
+		return fmt.Errorf("failed to create GoFiler home: %w", err)
+	}
+	if err := writeJSONFile(filepath.Join(j.home, JournalFile), j); err != nil {
+		return fmt.Errorf("failed to save the journal: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotPath returns where the journal keeps what the operation with the
+// given ID replaced.
+func (j *Journal) snapshotPath(id int) string {
+	return filepath.Join(j.home, JournalDir, strconv.Itoa(id))
+}
+
+// keep copies the file or directory at path into the journal with its
+// times and permissions, as the snapshot of the operation with the given ID.
+func (j *Journal) keep(id int, path string) error {
+	within, err := isWithin(path, j.home)
+	if err != nil {
+		return err
+	}
+	if within {
+		return fmt.Errorf("cannot keep %s for undo: it contains the journal", path)
+	}
+
+	snapshot := j.snapshotPath(id)
+	if err := fsys.MkdirAll(filepath.Dir(snapshot), 0700); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	// An interrupted run may have left a snapshot under this ID.
+	if err := fsys.RemoveAll(snapshot); err != nil {
+		return fmt.Errorf("failed to clear journal directory: %w", err)
+	}
+	if _, err := copyTree(path, snapshot, CopyOptions{Preserve: true}); err != nil {
+		fsys.RemoveAll(snapshot)
+		return fmt.Errorf("failed to keep %s for undo: %w", path, err)
+	}
+
+	return nil
+}
+
+// record adds entry to the journal, dropping the oldest entries beyond
+// journalLimit.
+func (j *Journal) record(entry JournalEntry) error {
+	j.Entries = append(j.Entries, entry)
+	var dropped []JournalEntry
+	if n := len(j.Entries) - journalLimit; n > 0 {
+		dropped = append(dropped, j.Entries[:n]...)
+		j.Entries = j.Entries[n:]
+	}
+
+	if err := j.save(); err != nil {
+		return err
+	}
+	for _, old := range dropped {
+		if old.Snapshot {
+			fsys.RemoveAll(j.snapshotPath(old.ID))
+		}
+	}
+
+	return nil
+}
+
+// journaled runs an operation and records entry for it once it succeeded.
+// If something exists at keep, it is copied into the journal first, so that
+// undo can bring it back. run may fill in entry with what it learns. The
+// journal stays locked until the entry is recorded.
+func journaled(entry JournalEntry, keep string, run func(entry *JournalEntry) error) error {
+	lock, err := lockJournal()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	journal, err := loadJournal()
+	if err != nil {
+		return err
+	}
+
+	entry.ID = 1
+	if n := len(journal.Entries); n > 0 {
+		entry.ID = journal.Entries[n-1].ID + 1
+	}
+	entry.Time = time.Now()
+
+	if keep != "" {
+		if _, err := fsys.Lstat(keep); err == nil {
+			if err := journal.keep(entry.ID, keep); err != nil {
+				return err
+			}
+			entry.Snapshot = true
+		}
+	}
+
+	if err := run(&entry); err != nil {
+		if entry.Snapshot {
+			fsys.RemoveAll(journal.snapshotPath(entry.ID))
+		}
+		return err
+	}
+
+	// The operation is done; failing to record it only means it cannot be undone.
+	if err := journal.record(entry); err != nil {
+		if entry.Snapshot {
+			fsys.RemoveAll(journal.snapshotPath(entry.ID))
+		}
+		fmt.Printf("Warning: %s cannot be undone: %v\n", entry.describe(), err)
+	}
+
+	return nil
+}
+
+// JournalChange runs an operation that creates or rewrites the file or
+// directory at path, such as -write or -copy, and records it. What was at
+// path before is kept, so that undo can put it back.
+func JournalChange(op, path string, change func() error) error {
+	abs, err := fsys.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+	// Writes go through symbolic links, so undo restores what they point to.
+	if abs, err = resolveSymlinks(abs); err != nil {
+		return err
+	}
+
+	return journaled(JournalEntry{Op: op, Path: abs}, abs, func(*JournalEntry) error {
+		return change()
+	})
+}
+
+// JournalMove runs a rename or move of src to dest and records it. A file
+// or empty directory replaced at dest is kept, so that undo can put it back.
+func JournalMove(op, src, dest string, move func() error) error {
+	absSrc, err := fsys.Abs(src)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+	absDest, err := fsys.Abs(dest)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+
+	return journaled(JournalEntry{Op: op, Path: absSrc, Dest: absDest}, absDest, func(*JournalEntry) error {
+		return move()
+	})
+}
+
+// JournalTrash moves path to the trash and records under which name.
+func JournalTrash(path string) error {
+	return journaled(JournalEntry{Op: "delete", Path: path}, "", func(entry *JournalEntry) error {
+		trashed, err := MoveToTrash(path)
+		entry.Path, entry.Trash = trashed.Path, trashed.Name
+		return err
+	})
+}
+
+// JournalFinal runs an operation that cannot be undone, such as shredding,
+// deleting permanently or encrypting in place, and records it, so that
+// -history lists it and -undo reports it instead of passing over it in
+// silence. Nothing is kept: a copy of what the operation destroys or
+// encrypts would defeat it.
+func JournalFinal(op, path string, run func() error) error {
+	abs, err := fsys.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+
+	return journaled(JournalEntry{Op: op, Path: abs, Final: true}, "", func(*JournalEntry) error {
+		return run()
+	})
+}
+
+// JournalUntrash restores an item from the trash and records where it went,
+// so that undo can move it back to the trash.
+func JournalUntrash(item string) error {
+	return journaled(JournalEntry{Op: "untrash"}, "", func(entry *JournalEntry) error {
+		restored, err := RestoreFromTrash(item)
+		entry.Path = restored.Path
+		return err
+	})
+}
+
+// JournalChmod runs an operation that changes the permissions of path and
+// records the permissions it had before.
+func JournalChmod(path string, chmod func() error) error {
+	abs, err := fsys.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+	info, err := fsys.Stat(abs)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	mode := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+
+	return journaled(JournalEntry{Op: "chmod", Path: abs, Mode: mode}, "", func(*JournalEntry) error {
+		return chmod()
+	})
+}
+
+// describe returns a short description of the recorded operation.
+func (e JournalEntry) describe() string {
+	switch e.Op {
+	case "rename", "move":
+		return fmt.Sprintf("%s %s to %s", e.Op, e.Path, e.Dest)
+	case "delete":
+		return fmt.Sprintf("delete %s (in the trash as %s)", e.Path, e.Trash)
+	case "chmod":
+		return fmt.Sprintf("chmod %s (was %04o)", e.Path, uint32(e.Mode.Perm()))
+	}
+	if e.Final {
+		return e.Op + " " + e.Path + " (cannot be undone)"
+	}
+
+	return e.Op + " " + e.Path
+}
+
+// Undo reverses the last steps operations in the journal, most recent
+// first. It stops at the first operation that fails to be undone, such as a
+// move whose source path has been taken since. Operations that can never be
+// undone, such as shredding, are reported and count as a step. Nothing is
+// lost by undoing: files that undo replaces are moved to the trash.
+func Undo(steps int) error {
+	lock, err := lockJournal()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	journal, err := loadJournal()
+	if err != nil {
+		return err
+	}
+	if steps < 1 {
+		return fmt.Errorf("invalid number of steps %d", steps)
+	}
+	if len(journal.Entries) == 0 {
+		return fmt.Errorf("nothing to undo: the journal is empty")
+	}
+	if steps > len(journal.Entries) {
+		return fmt.Errorf("cannot undo %d operations: the journal holds only %d", steps, len(journal.Entries))
+	}
+
+	for i := 0; i < steps; i++ {
+		entry := journal.Entries[len(journal.Entries)-1]
+		if !entry.Final {
+			if err := journal.undo(entry); err != nil {
+				return fmt.Errorf("failed to undo %s: %w", entry.describe(), err)
+			}
+		}
+		journal.Entries = journal.Entries[:len(journal.Entries)-1]
+		if err := journal.save(); err != nil {
+			return err
+		}
+
+		if entry.Final {
+			fmt.Printf("Skipped %s\n", entry.describe())
+		} else {
+			fmt.Printf("Undid %s\n", entry.describe())
+		}
+	}
+
+	return nil
+}
+
+// undo reverses a single recorded operation.
+func (j *Journal) undo(entry JournalEntry) error {
+	switch entry.Op {
+	case "rename", "move":
+		if _, err := fsys.Lstat(entry.Path); err == nil {
+			return fmt.Errorf("%s already exists", entry.Path)
+		}
+		if err := fsys.MkdirAll(filepath.Dir(entry.Path), 0755); err != nil {
+			return fmt.Errorf("failed to recreate the parent directory: %w", err)
+		}
+		if err := movePath(entry.Dest, entry.Path); err != nil {
+			return err
+		}
+		return j.putBack(entry, entry.Dest)
+	case "delete":
+		trash, err := TrashDir()
+		if err != nil {
+			return err
+		}
+		return restoreTrashEntry(trash, TrashEntry{Name: entry.Trash, Path: entry.Path})
+	case "chmod":
+		return fsys.Chmod(entry.Path, entry.Mode)
+	default:
+		if _, err := fsys.Lstat(entry.Path); err == nil {
+			if _, err := MoveToTrash(entry.Path); err != nil {
+				return err
+			}
+		}
+		return j.putBack(entry, entry.Path)
+	}
+}
+
+// putBack moves what the journal kept for entry to path.
+func (j *Journal) putBack(entry JournalEntry, path string) error {
+	if !entry.Snapshot {
+		return nil
+	}
+	if err := fsys.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to recreate the parent directory: %w", err)
+	}
+	if err := movePath(j.snapshotPath(entry.ID), path); err != nil {
+		return fmt.Errorf("failed to put back %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// History prints the operations in the journal, most recent first, each
+// with the number of -undo steps that reverses it.
+func History() error {
+	journal, err := loadJournal()
+	if err != nil {
+		return err
+	}
+	if len(journal.Entries) == 0 {
+		fmt.Println("The journal is empty.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEPS\tTIME\tOPERATION")
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		fmt.Fprintf(w, "%d\t%s\t%s\n", len(journal.Entries)-i, entry.Time.Format(time.RFC3339), entry.describe())
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useJournal keeps the journal in /home and the trash in /Trash of a new
+// in-memory file system.
+func useJournal(t *testing.T) *MemFileSystem {
+	t.Helper()
+
+	t.Setenv(HomeEnv, "/home")
+	return useTrash(t)
+}
+
+func TestUndoReversesOperations(t *testing.T) {
+	mem := useJournal(t)
+	mem.MkdirAll("/work/dir", 0755)
+	mem.MkdirAll("/moved", 0755)
+	mem.WriteFile("/work/dir/inner", []byte("inner"), 0644)
+	mem.WriteFile("/work/a", []byte("a"), 0644)
+	mem.WriteFile("/work/b", []byte("b"), 0600)
+
+	operations := []func() error{
+		func() error {
+			return JournalMove("rename", "/work/a", "/work/b", func() error { return FileOpRename("/work/a", "/work/b") })
+		},
+		func() error {
+			return JournalChange("write", "/work/b", func() error { return FileOpWrite("/work/b", "written") })
+		},
+		func() error {
+			return JournalChmod("/work/b", func() error { return SetPermissions("/work/b", 0640) })
+		},
+		func() error {
+			return JournalMove("move", "/work/dir", "/moved/dir", func() error { return FileOpMove("/work/dir", "/moved/dir") })
+		},
+		func() error { return JournalTrash("/moved/dir") },
+		func() error {
+			return JournalChange("create", "/work/new", func() error { return FileOpCreate("/work/new") })
+		},
+	}
+	for _, op := range operations {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal, err := loadJournal()
+	if err != nil || len(journal.Entries) != len(operations) {
+		t.Fatalf("journal holds %+v, %v", journal, err)
+	}
+
+	if err := Undo(2); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/moved/dir/inner", "inner")
+	if _, err := mem.Stat("/work/new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("created file still exists: %v", err)
+	}
+
+	if err := Undo(4); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/a", "a")
+	assertUnchanged(t, mem, "/work/b", "b")
+	assertUnchanged(t, mem, "/work/dir/inner", "inner")
+	if info, _ := mem.Stat("/work/b"); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v", info.Mode().Perm())
+	}
+
+	// What undo replaced is in the trash rather than lost.
+	entries, _ := trashEntries("/Trash")
+	if len(entries) != 2 {
+		t.Errorf("trash holds %+v", entries)
+	}
+	if err := Undo(1); err == nil {
+		t.Error("undid more operations than were recorded")
+	}
+	if entries, _ := mem.ReadDir("/home/" + JournalDir); len(entries) != 0 {
+		t.Errorf("journal keeps %v", entries)
+	}
+}
+
+func TestUndoRefusesToReplace(t *testing.T) {
+	mem := useJournal(t)
+	mem.WriteFile("/a", []byte("a"), 0644)
+	if err := JournalMove("move", "/a", "/b", func() error { return FileOpMove("/a", "/b") }); err != nil {
+		t.Fatal(err)
+	}
+	mem.WriteFile("/a", []byte("new"), 0644)
+
+	if err := Undo(1); err == nil {
+		t.Fatal("undo replaced a file")
+	}
+	assertUnchanged(t, mem, "/a", "new")
+	assertUnchanged(t, mem, "/b", "a")
+	if journal, _ := loadJournal(); len(journal.Entries) != 1 {
+		t.Errorf("journal holds %+v", journal.Entries)
+	}
+}
+
+func TestJournalSkipsFailedOperations(t *testing.T) {
+	mem := useJournal(t)
+	mem.WriteFile("/file", []byte("old"), 0644)
+	failed := errors.New("failed")
+
+	err := JournalChange("write", "/file", func() error { return failed })
+	if !errors.Is(err, failed) {
+		t.Fatalf("error = %v", err)
+	}
+	if journal, _ := loadJournal(); len(journal.Entries) != 0 {
+		t.Errorf("journal holds %+v", journal.Entries)
+	}
+	if _, err := mem.Stat("/home/" + JournalDir + "/1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("snapshot of a failed operation kept: %v", err)
+	}
+}
+
+func TestJournalLimit(t *testing.T) {
+	mem := useJournal(t)
+	mem.WriteFile("/file", []byte("start"), 0644)
+	for i := 0; i <= journalLimit; i++ {
+		err := JournalChange("write", "/file", func() error { return FileOpWrite("/file", strconv.Itoa(i)) })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journal, err := loadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Entries) != journalLimit || journal.Entries[0].ID != 2 {
+		t.Fatalf("journal holds %d entries from %d", len(journal.Entries), journal.Entries[0].ID)
+	}
+	if _, err := mem.Stat(journal.snapshotPath(1)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("snapshot of a dropped entry kept: %v", err)
+	}
+	assertUnchanged(t, mem, journal.snapshotPath(2), "0")
+}
+
+func TestUndoSkipsFinalOperations(t *testing.T) {
+	mem := useJournal(t)
+	mem.MkdirAll("/work", 0755)
+	mem.WriteFile("/work/a", []byte("original"), 0644)
+
+	if err := JournalChange("write", "/work/a", func() error { return FileOpWrite("/work/a", "written") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := JournalFinal("shred", "/work/a", func() error { return ShredPath("/work/a", 1) }); err != nil {
+		t.Fatal(err)
+	}
+	journal, _ := loadJournal()
+	if last := journal.Entries[len(journal.Entries)-1]; !last.Final || last.Snapshot {
+		t.Errorf("shred recorded as %+v", last)
+	}
+
+	// The shred is reported and passed; the write before it is undone.
+	if err := Undo(2); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/a", "original")
+	if journal, _ := loadJournal(); len(journal.Entries) != 0 {
+		t.Errorf("journal holds %d entries", len(journal.Entries))
+	}
+}
+
+func TestUndoUntrash(t *testing.T) {
+	mem := useJournal(t)
+	mem.MkdirAll("/work", 0755)
+	mem.WriteFile("/work/a", []byte("a"), 0644)
+
+	if err := JournalTrash("/work/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := JournalUntrash("/work/a"); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/a", "a")
+
+	if err := Undo(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/work/a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("restored file still exists: %v", err)
+	}
+	if err := Undo(1); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/a", "a")
+}
+
+func TestJournalWaitsForLock(t *testing.T) {
+	mem := useJournal(t)
+	mem.MkdirAll("/work", 0755)
+
+	// Another command holds the journal while it records its change.
+	lock, err := lockJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- JournalChange("create", "/work/file", func() error { return FileOpCreate("/work/file") })
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("recorded while the journal was locked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := mem.Stat("/work/file"); err == nil {
+		t.Error("command ran while the journal was locked")
+	}
+	lock.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("journal lock not released")
+	}
+
+	journal, err := loadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Entries) != 1 || journal.Entries[0].Path != "/work/file" {
+		t.Errorf("journal holds %+v", journal.Entries)
+	}
+}
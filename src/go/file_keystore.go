@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// KeystoreFile is the name of the master keystore inside the GoFiler home directory.
+const KeystoreFile = "keystore.json"
+
+// KeystoreLockFile is the lock file commands take while they change the keystore.
+const KeystoreLockFile = "keystore.lock"
+
+// keystoreVersion is the current version of the keystore format.
+const keystoreVersion = 1
+
+// envelopeWrapContext is authenticated with every wrapped data key.
+const envelopeWrapContext = "gofiler envelope v1\x00"
+
+// ErrUnknownMasterKey is returned when a file was encrypted under a master key missing from the keystore.
+var ErrUnknownMasterKey = errors.New("master key not found in keystore")
+
+// MasterKey is a key in the keystore that wraps per-file data keys.
+type MasterKey struct {
+	ID        string    `json:"id"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Keystore holds the master keys. New files are encrypted under Active;
+// older keys are kept so files not yet rotated can still be decrypted.
+type Keystore struct {
+	Version int         `json:"version"`
+	Active  string      `json:"active"`
+	Keys    []MasterKey `json:"keys"`
+}
+
+// EnvelopeKey is the data key of a file wrapped under a master key.
+type EnvelopeKey struct {
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// keystorePath returns the path of the master keystore.
+func keystorePath() (string, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, KeystoreFile), nil
+}
+
+// lockKeystore takes the keystore lock, waiting while another command holds
+// it, so that commands changing the keystore at the same time never lose each
+// other's keys. Closing the result releases it.
+func lockKeystore() (io.Closer, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsys.MkdirAll(home, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create GoFiler home: %w", err)
+	}
+	lock, err := fsys.Lock(filepath.Join(home, KeystoreLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the keystore: %w", err)
+	}
+
+	return lock, nil
+}
+
+// LoadKeystore reads the master keystore. A missing keystore yields an empty one.
+func LoadKeystore() (*Keystore, error) {
+	keystore := &Keystore{Version: keystoreVersion}
+
+	path, err := keystorePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fsys.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keystore, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+
+	if err := json.Unmarshal(data, keystore); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if keystore.Version > keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", keystore.Version)
+	}
+
+	return keystore, nil
+}
+
+// Save writes the keystore, readable only by its owner.
+func (k *Keystore) Save() error {
+	path, err := keystorePath()
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create GoFiler home: %w", err)
+	}
+
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keystore: %w", err)
+	}
+
+	err = writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+
+	return nil
+}
+
+// Lookup returns the master key with the given ID.
+func (k *Keystore) Lookup(id string) (*MasterKey, error) {
+	for i := range k.Keys {
+		if k.Keys[i].ID == id {
+			return &k.Keys[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownMasterKey, id)
+}
+
+// ActiveKey returns the master key new files are encrypted under.
+func (k *Keystore) ActiveKey() (*MasterKey, error) {
+	if k.Active == "" {
+		return nil, errors.New("keystore has no master key; create one with -new-master-key")
+	}
+
+	return k.Lookup(k.Active)
+}
+
+// NewMasterKey adds a random master key to the keystore and makes it active.
+func NewMasterKey() error {
+	lock, err := lockKeystore()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	keystore, err := LoadKeystore()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return fmt.Errorf("failed to create master key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return fmt.Errorf("failed to create master key ID: %w", err)
+	}
+
+	master := MasterKey{ID: hex.EncodeToString(id), Key: key, CreatedAt: time.Now().UTC()}
+	keystore.Keys = append(keystore.Keys, master)
+	keystore.Active = master.ID
+	if err := keystore.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Master key %s created and made active\n", master.ID)
+	return nil
+}
+
+// RemoveMasterKey deletes a master key that is no longer active. Files still
+// encrypted under it can no longer be decrypted.
+func RemoveMasterKey(id string) error {
+	lock, err := lockKeystore()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	keystore, err := LoadKeystore()
+	if err != nil {
+		return err
+	}
+	if id == keystore.Active {
+		return fmt.Errorf("master key %s is active; create a new one and rotate first", id)
+	}
+	if _, err := keystore.Lookup(id); err != nil {
+		return err
+	}
+
+	kept := keystore.Keys[:0]
+	for _, key := range keystore.Keys {
+		if key.ID != id {
+			kept = append(kept, key)
+		}
+	}
+	keystore.Keys = kept
+	if err := keystore.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Master key %s removed\n", id)
+	return nil
+}
+
+// ListMasterKeys prints the keys in the keystore, without their key material.
+func ListMasterKeys() error {
+	keystore, err := LoadKeystore()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tACTIVE")
+	for _, key := range keystore.Keys {
+		active := ""
+		if key.ID == keystore.Active {
+			active = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key.ID, key.CreatedAt.Format(time.RFC3339), active)
+	}
+
+	return w.Flush()
+}
+
+// wrap encrypts a data key under the master key.
+func (m *MasterKey) wrap(dataKey []byte) (*EnvelopeKey, error) {
+	gcm, err := newGCM(m.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	return &EnvelopeKey{
+		KeyID:      m.ID,
+		Nonce:      nonce,
+		WrappedKey: gcm.Seal(nil, nonce, dataKey, []byte(envelopeWrapContext+m.ID)),
+	}, nil
+}
+
+// unwrap decrypts a data key wrapped under the master key.
+func (m *MasterKey) unwrap(envelope *EnvelopeKey) ([]byte, error) {
+	gcm, err := newGCM(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(envelope.Nonce))
+	}
+
+	dataKey, err := gcm.Open(nil, envelope.Nonce, envelope.WrappedKey, []byte(envelopeWrapContext+m.ID))
+	if err != nil || len(dataKey) != fileKeySize {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %s", m.ID)
+	}
+
+	return dataKey, nil
+}
+
+// unwrapEnvelope recovers the data key of a file from the keystore.
+func unwrapEnvelope(envelope *EnvelopeKey, keystore *Keystore) ([]byte, error) {
+	if keystore == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMasterKey, envelope.KeyID)
+	}
+
+	master, err := keystore.Lookup(envelope.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return master.unwrap(envelope)
+}
+
+// Outcomes of rewrapping a single file.
+const (
+	rewrapDone    = "rewrapped"
+	rewrapCurrent = "current"
+	rewrapSkipped = "skipped"
+)
+
+// RotateReport counts the outcome of RotateKeys.
+type RotateReport struct {
+	Rewrapped int
+	Current   int
+	Skipped   int
+	Failed    int
+}
+
+// RotateKeys rewraps the data key of every envelope-encrypted file under root
+// with the active master key. Only the container header is rewritten; the
+// encrypted body is copied unchanged.
+func RotateKeys(root string) error {
+	keystore, err := LoadKeystore()
+	if err != nil {
+		return err
+	}
+	active, err := keystore.ActiveKey()
+	if err != nil {
+		return err
+	}
+
+	var report RotateReport
+	err = walkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			report.Failed++
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		outcome, err := rewrapFile(path, keystore, active)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: %v\n", path, err)
+			report.Failed++
+		case outcome == rewrapDone:
+			fmt.Printf("%s: rewrapped under %s\n", path, active.ID)
+			report.Rewrapped++
+		case outcome == rewrapCurrent:
+			report.Current++
+		default:
+			report.Skipped++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	fmt.Printf("Rewrapped: %d, already current: %d, not envelope-encrypted: %d, failed: %d\n",
+		report.Rewrapped, report.Current, report.Skipped, report.Failed)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d files could not be rewrapped", report.Failed)
+	}
+
+	return nil
+}
+
+// rewrapFile replaces the wrapped data key in the header of the file at path
+// with one wrapped under active, and returns what was done.
+func rewrapFile(path string, keystore *Keystore, active *MasterKey) (string, error) {
+	header, err := PeekContainerHeader(path)
+	if errors.Is(err, ErrNotContainer) {
+		return rewrapSkipped, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if header.Envelope == nil {
+		return rewrapSkipped, nil
+	}
+	if header.Envelope.KeyID == active.ID {
+		return rewrapCurrent, nil
+	}
+
+	if err := replaceEnvelope(path, keystore, active); err != nil {
+		return "", err
+	}
+
+	return rewrapDone, nil
+}
+
+// replaceEnvelope rewrites the header of the envelope-encrypted file at path
+// with its data key, unwrapped from keystore, wrapped under active instead.
+// The encrypted body is copied unchanged.
+func replaceEnvelope(path string, keystore *Keystore, active *MasterKey) error {
+	return transformFile(path, path, func(w io.Writer, r io.Reader) error {
+		header, _, err := ReadContainerHeader(r)
+		if err != nil {
+			return err
+		}
+		if header.Envelope == nil {
+			return errors.New("file is not envelope-encrypted")
+		}
+
+		dataKey, err := unwrapEnvelope(header.Envelope, keystore)
+		if err != nil {
+			return err
+		}
+		header.Envelope, err = active.wrap(dataKey)
+		if err != nil {
+			return err
+		}
+
+		prefix, err := header.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix); err != nil {
+			return fmt.Errorf("failed to write container header: %w", err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("failed to copy encrypted data: %w", err)
+		}
+		return nil
+	})
+}
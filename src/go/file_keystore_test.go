@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useKeystore keeps the keystore in /home of a new in-memory file system and
+// creates a first master key.
+func useKeystore(t *testing.T) *MemFileSystem {
+	t.Helper()
+
+	mem := useMemFileSystem(t)
+	t.Setenv(HomeEnv, "/home")
+	if err := NewMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	return mem
+}
+
+// encryptUnderEnvelope writes content to name encrypted under the active master key.
+func encryptUnderEnvelope(t *testing.T, mem *MemFileSystem, name, content string) {
+	t.Helper()
+
+	keystore, err := LoadKeystore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.WriteFile(name, []byte(content), 0644)
+	if err := CompressAndEncryptFile(name, Keys{Keystore: keystore}, CompressionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// envelopeDecrypt decrypts name with the current keystore.
+func envelopeDecrypt(mem *MemFileSystem, name string) (string, error) {
+	keystore, err := LoadKeystore()
+	if err != nil {
+		return "", err
+	}
+	data, err := mem.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+
+	var plain bytes.Buffer
+	err = DecryptAndDecompressStream(&plain, bytes.NewReader(data), Keys{Keystore: keystore})
+	return plain.String(), err
+}
+
+// envelopeKeyID returns the ID of the master key name is encrypted under.
+func envelopeKeyID(t *testing.T, name string) string {
+	t.Helper()
+
+	header, err := PeekContainerHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header.Envelope.KeyID
+}
+
+func TestRotateKeysKeepsFilesDecryptable(t *testing.T) {
+	mem := useKeystore(t)
+	mem.MkdirAll("/data/sub", 0755)
+	files := map[string]string{"/data/a": "first", "/data/sub/b": "second"}
+	for name, content := range files {
+		encryptUnderEnvelope(t, mem, name, content)
+	}
+	mem.WriteFile("/data/plain", []byte("not encrypted"), 0644)
+	old, _ := LoadKeystore()
+
+	if err := NewMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RotateKeys("/data"); err != nil {
+		t.Fatal(err)
+	}
+	keystore, _ := LoadKeystore()
+	for name, content := range files {
+		if id := envelopeKeyID(t, name); id != keystore.Active {
+			t.Errorf("%s is still under %s", name, id)
+		}
+		if got, err := envelopeDecrypt(mem, name); err != nil || got != content {
+			t.Errorf("%s after rotation: %q, %v", name, got, err)
+		}
+	}
+	assertUnchanged(t, mem, "/data/plain", "not encrypted")
+
+	// A second rotation has nothing left to do.
+	before, _ := mem.ReadFile("/data/a")
+	if err := RotateKeys("/data"); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/data/a", string(before))
+
+	// Once every file is rotated, the old key can go.
+	if err := RemoveMasterKey(keystore.Active); err == nil {
+		t.Error("active master key removed")
+	}
+	if err := RemoveMasterKey(old.Active); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if got, err := envelopeDecrypt(mem, name); err != nil || got != content {
+			t.Errorf("%s after removing the old key: %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestRemovingMasterKeyBeforeRotation(t *testing.T) {
+	mem := useKeystore(t)
+	mem.MkdirAll("/data", 0755)
+	encryptUnderEnvelope(t, mem, "/data/a", "stranded")
+	old, _ := LoadKeystore()
+
+	if err := NewMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveMasterKey(old.Active); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file can no longer be decrypted or rotated, and is left as it was.
+	if _, err := envelopeDecrypt(mem, "/data/a"); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("decrypting: error = %v", err)
+	}
+	before, _ := mem.ReadFile("/data/a")
+	if err := RotateKeys("/data"); err == nil {
+		t.Error("rotation succeeded without the old key")
+	}
+	assertUnchanged(t, mem, "/data/a", string(before))
+	if id := envelopeKeyID(t, "/data/a"); id != old.Active {
+		t.Errorf("file moved to %s", id)
+	}
+}
+
+func TestMasterKeyChangesWaitForLock(t *testing.T) {
+	useKeystore(t)
+
+	// Another command holds the keystore while it changes it.
+	lock, err := lockKeystore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- NewMasterKey() }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("keystore changed while it was locked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// What the other command saves must survive the waiting one.
+	keystore, _ := LoadKeystore()
+	keystore.Keys = append(keystore.Keys, MasterKey{ID: "other", Key: make([]byte, fileKeySize)})
+	if err := keystore.Save(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keystore lock not released")
+	}
+
+	keystore, err = LoadKeystore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keystore.Keys) != 3 {
+		t.Errorf("keystore holds %d keys, want 3", len(keystore.Keys))
+	}
+	if _, err := keystore.Lookup("other"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvelopeRejectsTamperedKey(t *testing.T) {
+	mem := useKeystore(t)
+	encryptUnderEnvelope(t, mem, "/file", "secret")
+	keystore, _ := LoadKeystore()
+
+	header, err := PeekContainerHeader("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Envelope.WrappedKey[0] ^= 1
+	if _, err := unwrapEnvelope(header.Envelope, keystore); err == nil {
+		t.Error("tampered wrapped key unwrapped")
+	}
+
+	// A wrapped key cannot be moved to another master key ID.
+	header.Envelope.WrappedKey[0] ^= 1
+	if err := NewMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	keystore, _ = LoadKeystore()
+	header.Envelope.KeyID = keystore.Active
+	if _, err := unwrapEnvelope(header.Envelope, keystore); err == nil {
+		t.Error("wrapped key opened under another master key")
+	}
+}
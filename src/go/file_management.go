@@ -2,13 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
 )
 
 // CreateFile creates a new file.
 func CreateFile(name string) error {
-	file, err := os.Create(name)
+	file, err := fsys.Create(name)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
@@ -20,7 +20,7 @@ func CreateFile(name string) error {
 
 // DeleteFile deletes a file.
 func DeleteFile(name string) error {
-	err := os.Remove(name)
+	err := fsys.Remove(name)
 	if err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
@@ -31,7 +31,7 @@ func DeleteFile(name string) error {
 
 // RenameFile renames a file.
 func RenameFile(oldName, newName string) error {
-	err := os.Rename(oldName, newName)
+	err := fsys.Rename(oldName, newName)
 	if err != nil {
 		return fmt.Errorf("failed to rename file: %w", err)
 	}
@@ -40,9 +40,10 @@ func RenameFile(oldName, newName string) error {
 	return nil
 }
 
-// MoveFile moves a file from source to destination.
+// MoveFile moves a file from source to destination, copying it if they are
+// on different devices.
 func MoveFile(src, dest string) error {
-	err := os.Rename(src, dest)
+	err := movePath(src, dest)
 	if err != nil {
 		return fmt.Errorf("failed to move file: %w", err)
 	}
@@ -53,7 +54,7 @@ func MoveFile(src, dest string) error {
 
 // ListFiles lists all files in a directory.
 func ListFiles(dir string) error {
-	files, err := os.ReadDir(dir)
+	files, err := fsys.ReadDir(dir)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
@@ -67,7 +68,7 @@ func ListFiles(dir string) error {
 
 // GetPermissions returns the permissions of a file.
 func GetPermissions(name string) error {
-	info, err := os.Stat(name)
+	info, err := fsys.Stat(name)
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
@@ -78,7 +79,7 @@ func GetPermissions(name string) error {
 
 // SetPermissions sets the permissions of a file.
 func SetPermissions(name string, mode os.FileMode) error {
-	err := os.Chmod(name, mode)
+	err := fsys.Chmod(name, mode)
 	if err != nil {
 		return fmt.Errorf("failed to set file permissions: %w", err)
 	}
@@ -89,7 +90,7 @@ func SetPermissions(name string, mode os.FileMode) error {
 
 // ReadFile reads the content of a file.
 func ReadFile(name string) error {
-	data, err := os.ReadFile(name)
+	data, err := fsys.ReadFile(name)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
@@ -98,9 +99,9 @@ func ReadFile(name string) error {
 	return nil
 }
 
-// WriteFile writes data to a file.
+// WriteFile writes data to a file, replacing its content atomically.
 func WriteFile(name string, data []byte) error {
-	err := os.WriteFile(name, data, 0644)
+	err := writeDataAtomic(name, data, filePerm(name, 0644))
 	if err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
@@ -111,7 +112,7 @@ func WriteFile(name string, data []byte) error {
 
 // CreateDirectory creates a new directory.
 func CreateDirectory(name string) error {
-	err := os.MkdirAll(name, 0755)
+	err := fsys.MkdirAll(name, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
@@ -120,20 +121,18 @@ func CreateDirectory(name string) error {
 	return nil
 }
 
-// DeleteDirectory deletes a directory.
+// DeleteDirectory moves a directory and everything in it to the trash.
 func DeleteDirectory(name string) error {
-	err := os.RemoveAll(name)
-	if err != nil {
+	if _, err := MoveToTrash(name); err != nil {
 		return fmt.Errorf("failed to delete directory: %w", err)
 	}
 
-	fmt.Printf("Directory %s deleted\n", name)
 	return nil
 }
 
 // RenameDirectory renames a directory.
 func RenameDirectory(oldName, newName string) error {
-	err := os.Rename(oldName, newName)
+	err := fsys.Rename(oldName, newName)
 	if err != nil {
 		return fmt.Errorf("failed to rename directory: %w", err)
 	}
@@ -142,9 +141,10 @@ func RenameDirectory(oldName, newName string) error {
 	return nil
 }
 
-// MoveDirectory moves a directory from source to destination.
+// MoveDirectory moves a directory from source to destination, copying the
+// whole tree if they are on different devices.
 func MoveDirectory(src, dest string) error {
-	err := os.Rename(src, dest)
+	err := movePath(src, dest)
 	if err != nil {
 		return fmt.Errorf("failed to move directory: %w", err)
 	}
@@ -156,11 +156,16 @@ func MoveDirectory(src, dest string) error {
 // GetDirectorySize returns the size of a directory.
 func GetDirectorySize(path string) (int64, error) {
 	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			size += info.Size()
+	err := walkDir(fsys, path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
 		}
-		return err
+		size += info.Size()
+		return nil
 	})
 
 	if err != nil {
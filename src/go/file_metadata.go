@@ -17,7 +17,7 @@ type FileInfo struct {
 
 // GetFileInfo gets the metadata of a file or directory.
 func GetFileInfo(name string) (*FileInfo, error) {
-	info, err := os.Stat(name)
+	info, err := fsys.Stat(name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
@@ -44,7 +44,7 @@ func PrintFileInfo(fileInfo *FileInfo) {
 
 // SetFilePermissions sets the permissions of a file or directory.
 func SetFilePermissions(name string, mode os.FileMode) error {
-	err := os.Chmod(name, mode)
+	err := fsys.Chmod(name, mode)
 	if err != nil {
 		return fmt.Errorf("failed to set file permissions: %w", err)
 	}
@@ -54,7 +54,7 @@ func SetFilePermissions(name string, mode os.FileMode) error {
 
 // SetFileOwner sets the owner and group of a file or directory.
 func SetFileOwner(name string, uid, gid int) error {
-	err := os.Chown(name, uid, gid)
+	err := fsys.Chown(name, uid, gid)
 	if err != nil {
 		return fmt.Errorf("failed to set file owner: %w", err)
 	}
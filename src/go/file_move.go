@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// movePath moves src to dest. Within a file system this is a rename. Across
+// devices, where rename fails with EXDEV, src is copied to dest and only
+// deleted once the copy is complete and verified.
+func movePath(src, dest string) error {
+	err := fsys.Rename(src, dest)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	return moveAcrossDevices(src, dest)
+}
+
+// moveAcrossDevices moves src to dest by copying it. The copy is made under
+// a hidden name next to dest and src is set aside under a hidden name next
+// to itself, so until the copy is renamed into place any failure can be
+// rolled back, leaving src and dest as they were.
+func moveAcrossDevices(src, dest string) error {
+	info, err := fsys.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := checkMoveTarget(src, dest, info); err != nil {
+		return err
+	}
+
+	tmp, err := hiddenSibling(dest, "move")
+	if err != nil {
+		return err
+	}
+	if _, err := copyTree(src, tmp, CopyOptions{Preserve: true, Verify: true}); err != nil {
+		fsys.RemoveAll(tmp)
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dest, err)
+	}
+
+	old, err := hiddenSibling(src, "moved")
+	if err != nil {
+		fsys.RemoveAll(tmp)
+		return err
+	}
+	if err := fsys.Rename(src, old); err != nil {
+		fsys.RemoveAll(tmp)
+		return fmt.Errorf("failed to remove %s after copying it: %w", src, err)
+	}
+	if err := fsys.Rename(tmp, dest); err != nil {
+		fsys.RemoveAll(tmp)
+		if restoreErr := fsys.Rename(old, src); restoreErr != nil {
+			return fmt.Errorf("failed to move %s into place: %w; the original is kept at %s", dest, err, old)
+		}
+		return err
+	}
+
+	// The move is complete once dest is in place; what is left of the
+	// original is only reported, never used to undo it.
+	if err := fsys.RemoveAll(old); err != nil {
+		return fmt.Errorf("moved %s to %s but failed to delete the original at %s: %w", src, dest, old, err)
+	}
+
+	return nil
+}
+
+// checkMoveTarget fails the way rename would if src cannot replace dest, so
+// nothing is copied for a move that cannot succeed.
+func checkMoveTarget(src, dest string, info fs.FileInfo) error {
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dest, Err: err}
+	}
+
+	if info.IsDir() {
+		within, err := isWithin(src, dest)
+		if err != nil {
+			return err
+		}
+		if within {
+			return fail(syscall.EINVAL)
+		}
+	}
+
+	target, err := fsys.Lstat(dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir() && !target.IsDir():
+		return fail(syscall.ENOTDIR)
+	case !info.IsDir() && target.IsDir():
+		return fail(syscall.EISDIR)
+	case info.IsDir():
+		entries, err := fsys.ReadDir(dest)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fail(syscall.ENOTEMPTY)
+		}
+	}
+
+	return nil
+}
+
+// hiddenSibling returns a random hidden name in the directory of path,
+// derived from its base name and the purpose of the file.
+func hiddenSibling(path, purpose string) (string, error) {
+	name := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, name); err != nil {
+		return "", fmt.Errorf("failed to create random name: %w", err)
+	}
+	base := "." + filepath.Base(path) + "." + purpose + "-" + hex.EncodeToString(name)
+
+	return filepath.Join(filepath.Dir(path), base), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// crossDevice makes renames to names matching dest fail with EXDEV once, as
+// between two mounts, and returns the fault file system doing so.
+func crossDevice(t *testing.T, base FileSystem, dest string) *FaultFileSystem {
+	t.Helper()
+
+	faults := NewFaultFileSystem(base)
+	faults.Inject(Fault{Op: FaultRename, Path: dest, Err: syscall.EXDEV, Times: 1})
+	saved := fsys
+	fsys = faults
+	t.Cleanup(func() { fsys = saved })
+
+	return faults
+}
+
+// assertNoHiddenFiles fails the test if a move left a hidden file in dir.
+func assertNoHiddenFiles(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("hidden file %s left in %s", entry.Name(), dir)
+		}
+	}
+}
+
+func TestMoveDirectoryAcrossDevices(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "data"), []byte("data"), 0640)
+	os.Chtimes(filepath.Join(src, "sub", "data"), mtime, mtime)
+	if err := os.Symlink("sub/data", filepath.Join(src, "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	os.Chmod(filepath.Join(src, "sub"), 0750)
+	os.Chtimes(filepath.Join(src, "sub"), mtime, mtime)
+
+	faults := crossDevice(t, OSFileSystem{}, "dest")
+	dest := filepath.Join(dir, "dest")
+	if err := MoveDirectory(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if faults.faults[0].Injected() != 1 {
+		t.Fatal("the move did not cross devices")
+	}
+
+	if _, err := os.Lstat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("source still exists: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "link"))
+	if err != nil || string(data) != "data" {
+		t.Errorf("moved file through link = %q, %v", data, err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dest, "link")); target != "sub/data" {
+		t.Errorf("link target = %q", target)
+	}
+	for name, perm := range map[string]os.FileMode{"sub": 0750, "sub/data": 0640} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s has mode %v and time %v", name, info.Mode().Perm(), info.ModTime())
+		}
+	}
+	assertNoHiddenFiles(t, dir)
+}
+
+func TestMoveAcrossDevicesRollsBack(t *testing.T) {
+	t.Run("copy fails", func(t *testing.T) {
+		mem := NewMemFileSystem()
+		mem.WriteFile("/src", []byte("data"), 0644)
+		faults := crossDevice(t, mem, "dest")
+		faults.Inject(Fault{Op: FaultWrite, Path: "*.dest.move-*", Err: syscall.ENOSPC})
+
+		if err := FileOpMove("/src", "/dest"); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("move error = %v", err)
+		}
+		assertUnchanged(t, mem, "/src", "data")
+		if _, err := mem.Stat("/dest"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("destination created: %v", err)
+		}
+		assertNoHiddenFiles(t, "/")
+	})
+
+	t.Run("rename into place fails", func(t *testing.T) {
+		mem := NewMemFileSystem()
+		mem.MkdirAll("/src/sub", 0755)
+		mem.WriteFile("/src/sub/data", []byte("data"), 0644)
+		faults := crossDevice(t, mem, "dest")
+		faults.Inject(Fault{Op: FaultRename, Path: "dest", Err: syscall.EIO, After: 1})
+
+		if err := MoveDirectory("/src", "/dest"); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("move error = %v", err)
+		}
+		assertUnchanged(t, mem, "/src/sub/data", "data")
+		assertNoHiddenFiles(t, "/")
+	})
+
+	t.Run("destination not empty", func(t *testing.T) {
+		mem := NewMemFileSystem()
+		mem.MkdirAll("/src", 0755)
+		mem.MkdirAll("/dest", 0755)
+		mem.WriteFile("/dest/keep", []byte("keep"), 0644)
+		crossDevice(t, mem, "dest")
+
+		if err := MoveDirectory("/src", "/dest"); !errors.Is(err, syscall.ENOTEMPTY) {
+			t.Fatalf("move error = %v", err)
+		}
+		assertUnchanged(t, mem, "/dest/keep", "keep")
+		assertNoHiddenFiles(t, "/")
+	})
+}
@@ -7,7 +7,7 @@ import (
 
 // FileOpCreate creates a new file.
 func FileOpCreate(name string) error {
-	file, err := os.Create(name)
+	file, err := fsys.Create(name)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
@@ -19,7 +19,7 @@ func FileOpCreate(name string) error {
 
 // FileOpDelete deletes a file.
 func FileOpDelete(name string) error {
-	err := os.Remove(name)
+	err := fsys.Remove(name)
 	if err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
@@ -30,7 +30,7 @@ func FileOpDelete(name string) error {
 
 // FileOpRename renames a file.
 func FileOpRename(oldName, newName string) error {
-	err := os.Rename(oldName, newName)
+	err := fsys.Rename(oldName, newName)
 	if err != nil {
 		return fmt.Errorf("failed to rename file: %w", err)
 	}
@@ -39,9 +39,10 @@ func FileOpRename(oldName, newName string) error {
 	return nil
 }
 
-// FileOpMove moves a file from source to destination.
+// FileOpMove moves a file from source to destination, copying it if they
+// are on different devices.
 func FileOpMove(src, dest string) error {
-	err := os.Rename(src, dest)
+	err := movePath(src, dest)
 	if err != nil {
 		return fmt.Errorf("failed to move file: %w", err)
 	}
@@ -52,7 +53,7 @@ func FileOpMove(src, dest string) error {
 
 // FileOpRead reads the content of a file and returns it as a string.
 func FileOpRead(name string) (string, error) {
-	data, err := os.ReadFile(name)
+	data, err := fsys.ReadFile(name)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file: %w", err)
 	}
@@ -62,9 +63,9 @@ func FileOpRead(name string) (string, error) {
 
 // FileOpWrite writes a string to a file.
 // If the file does not exist, FileOpWrite creates it.
-// Otherwise, FileOpWrite truncates it before writing.
+// Otherwise, FileOpWrite replaces its content atomically.
 func FileOpWrite(name, content string) error {
-	err := os.WriteFile(name, []byte(content), 0644)
+	err := writeDataAtomic(name, []byte(content), filePerm(name, 0644))
 	if err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
@@ -75,7 +76,7 @@ func FileOpWrite(name, content string) error {
 // FileOpAppend appends a string to a file.
 // If the file does not exist, FileOpAppend creates it.
 func FileOpAppend(name, content string) error {
-	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := fsys.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
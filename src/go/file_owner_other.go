@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// systemOwner returns the owner and group recorded in info. Where they are
+// not available ok is false and ownership is left alone.
+func systemOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// PassphraseEnv is the environment variable GoFiler reads a passphrase from.
+const PassphraseEnv = "GOFILER_PASSPHRASE"
+
+// ReadPassphrase returns the passphrase used to encrypt or decrypt files. It
+// is read from passphraseFile when given, then from the GOFILER_PASSPHRASE
+// environment variable, and otherwise prompted for on the terminal. When
+// confirm is set the prompt asks for the passphrase twice.
+func ReadPassphrase(passphraseFile string, confirm bool) ([]byte, error) {
+	if passphraseFile != "" {
+		data, err := fsys.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return checkPassphrase(bytes.TrimRight(data, "\r\n"))
+	}
+
+	if env, ok := os.LookupEnv(PassphraseEnv); ok {
+		return checkPassphrase([]byte(env))
+	}
+
+	return promptPassphrase(confirm)
+}
+
+// promptPassphrase reads a passphrase from the controlling terminal without
+// echoing it. The terminal is opened directly rather than read through
+// standard input, which may carry the data being encrypted.
+func promptPassphrase(confirm bool) ([]byte, error) {
+	noTerminal := fmt.Errorf("no passphrase given: use -passphrase-file, set %s or run from a terminal", PassphraseEnv)
+	tty, err := openTerminal()
+	if err != nil {
+		return nil, noTerminal
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, noTerminal
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+
+	return checkPassphrase(passphrase)
+}
+
+// checkPassphrase rejects empty passphrases.
+func checkPassphrase(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	return passphrase, nil
+}
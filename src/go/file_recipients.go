@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Prefixes of the text encodings of X25519 keys.
+const (
+	x25519PublicPrefix = "gofiler-x25519-public:"
+	x25519SecretPrefix = "gofiler-x25519-secret:"
+)
+
+// RecipientX25519 identifies recipient stanzas wrapping the file key for an X25519 public key.
+const RecipientX25519 = "x25519"
+
+// x25519WrapInfo is the HKDF info string used when wrapping a file key.
+const x25519WrapInfo = "gofiler x25519 file key"
+
+// fileKeySize is the size of the random key encrypting a container body.
+const fileKeySize = 32
+
+// RecipientsFile is the name of the keyring of recipients inside the GoFiler home directory.
+const RecipientsFile = "recipients"
+
+// DefaultIdentityFile is the private key used for decryption when -identity is not given.
+const DefaultIdentityFile = "identity.key"
+
+// HomeEnv overrides the GoFiler home directory, which defaults to ~/.gofiler.
+const HomeEnv = "GOFILER_HOME"
+
+// ErrNoIdentity is returned when none of the given private keys can unwrap a file key.
+var ErrNoIdentity = errors.New("no matching private key for any recipient of the file")
+
+// Keys holds the key material used to encrypt or decrypt a container.
+// Encryption uses Recipients when any are given, then the active key of
+// Keystore, and Passphrase otherwise; decryption uses whichever the container
+// header asks for.
+type Keys struct {
+	Passphrase []byte
+	Recipients []*ecdh.PublicKey
+	Identities []*ecdh.PrivateKey
+	Keystore   *Keystore
+}
+
+// RecipientStanza wraps the file key for one recipient.
+type RecipientStanza struct {
+	Type       string `json:"type"`
+	Ephemeral  []byte `json:"ephemeral"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// Recipient is a named public key in the local keyring.
+type Recipient struct {
+	Name string
+	Key  *ecdh.PublicKey
+}
+
+// GoFilerHome returns the directory holding GoFiler keys and keyrings.
+func GoFilerHome() (string, error) {
+	if home := os.Getenv(HomeEnv); home != "" {
+		return home, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+
+	return filepath.Join(home, ".gofiler"), nil
+}
+
+// GenerateKeyPair creates an X25519 key pair and writes it to name.key and name.pub.
+func GenerateKeyPair(name string) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if err := writeKeyFile(name+".key", x25519SecretPrefix, key.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := writeKeyFile(name+".pub", x25519PublicPrefix, key.PublicKey().Bytes(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Key pair written to %s.key and %s.pub\n", name, name)
+	fmt.Printf("Public key: %s\n", EncodePublicKey(key.PublicKey()))
+	return nil
+}
+
+// writeKeyFile writes a text-encoded key, refusing to overwrite an existing file.
+func writeKeyFile(path, prefix string, key []byte, perm os.FileMode) error {
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+
+	_, err = fmt.Fprintln(file, encodeKey(prefix, key))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	return nil
+}
+
+// EncodePublicKey returns the text encoding of a public key.
+func EncodePublicKey(key *ecdh.PublicKey) string {
+	return encodeKey(x25519PublicPrefix, key.Bytes())
+}
+
+// encodeKey returns the text encoding of a key with the given prefix.
+func encodeKey(prefix string, key []byte) string {
+	return prefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// decodeKey decodes a text-encoded key with the given prefix.
+func decodeKey(text, prefix string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, prefix) {
+		return nil, fmt.Errorf("not a key of type %s", strings.TrimSuffix(prefix, ":"))
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding: %w", err)
+	}
+
+	return key, nil
+}
+
+// ParsePublicKey parses a text-encoded X25519 public key.
+func ParsePublicKey(text string) (*ecdh.PublicKey, error) {
+	raw, err := decodeKey(text, x25519PublicPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// LoadIdentity reads an X25519 private key written by GenerateKeyPair.
+func LoadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	raw, err := decodeKey(string(data), x25519SecretPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// recipientsPath returns the path of the local keyring of recipients.
+func recipientsPath() (string, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, RecipientsFile), nil
+}
+
+// LoadRecipients reads the local keyring. Each line holds a name and a public key.
+func LoadRecipients() ([]Recipient, error) {
+	path, err := recipientsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fsys.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recipients keyring: %w", err)
+	}
+	defer file.Close()
+
+	var recipients []Recipient
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in recipients keyring: %q", scanner.Text())
+		}
+		key, err := ParsePublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("recipient %s: %w", fields[0], err)
+		}
+		recipients = append(recipients, Recipient{Name: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients keyring: %w", err)
+	}
+
+	return recipients, nil
+}
+
+// saveRecipients writes the local keyring.
+func saveRecipients(recipients []Recipient) error {
+	path, err := recipientsPath()
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create GoFiler home: %w", err)
+	}
+
+	sort.Slice(recipients, func(i, j int) bool { return recipients[i].Name < recipients[j].Name })
+
+	var b strings.Builder
+	for _, r := range recipients {
+		fmt.Fprintf(&b, "%s %s\n", r.Name, EncodePublicKey(r.Key))
+	}
+	if err := writeDataAtomic(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write recipients keyring: %w", err)
+	}
+
+	return nil
+}
+
+// AddRecipient adds a named public key to the keyring. key is either a
+// text-encoded public key or the path of a .pub file.
+func AddRecipient(name, key string) error {
+	if name == "" || strings.ContainsAny(name, " \t,") {
+		return fmt.Errorf("invalid recipient name %q", name)
+	}
+
+	public, err := ParsePublicKey(key)
+	if err != nil {
+		data, readErr := fsys.ReadFile(key)
+		if readErr != nil {
+			return err
+		}
+		if public, err = ParsePublicKey(string(data)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	recipients, err := LoadRecipients()
+	if err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if r.Name == name {
+			return fmt.Errorf("recipient %s already exists", name)
+		}
+	}
+
+	if err := saveRecipients(append(recipients, Recipient{Name: name, Key: public})); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recipient %s added\n", name)
+	return nil
+}
+
+// RemoveRecipient removes a named public key from the keyring.
+func RemoveRecipient(name string) error {
+	recipients, err := LoadRecipients()
+	if err != nil {
+		return err
+	}
+
+	kept := recipients[:0]
+	for _, r := range recipients {
+		if r.Name != name {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(recipients) {
+		return fmt.Errorf("recipient %s not found", name)
+	}
+
+	if err := saveRecipients(kept); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recipient %s removed\n", name)
+	return nil
+}
+
+// ListRecipients prints the keyring.
+func ListRecipients() error {
+	recipients, err := LoadRecipients()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		fmt.Printf("%s %s\n", r.Name, EncodePublicKey(r.Key))
+	}
+
+	return nil
+}
+
+// ResolveRecipients turns recipient names from the keyring, text-encoded
+// public keys or paths of .pub files into public keys.
+func ResolveRecipients(names []string) ([]*ecdh.PublicKey, error) {
+	keyring, err := LoadRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*ecdh.PublicKey
+	for _, name := range names {
+		key, err := resolveRecipient(name, keyring)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// resolveRecipient resolves a single recipient.
+func resolveRecipient(name string, keyring []Recipient) (*ecdh.PublicKey, error) {
+	for _, r := range keyring {
+		if r.Name == name {
+			return r.Key, nil
+		}
+	}
+
+	if key, err := ParsePublicKey(name); err == nil {
+		return key, nil
+	}
+
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown recipient %s: not in the keyring, not a public key and not a readable file", name)
+	}
+
+	return ParsePublicKey(string(data))
+}
+
+// LoadIdentities reads the private keys at the given paths, or the default
+// identity in the GoFiler home when no path is given.
+func LoadIdentities(paths []string) ([]*ecdh.PrivateKey, error) {
+	if len(paths) == 0 {
+		home, err := GoFilerHome()
+		if err != nil {
+			return nil, err
+		}
+		paths = []string{filepath.Join(home, DefaultIdentityFile)}
+	}
+
+	var identities []*ecdh.PrivateKey
+	for _, path := range paths {
+		identity, err := LoadIdentity(path)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// wrapFileKey encrypts the file key to a recipient using an ephemeral X25519 key.
+func wrapFileKey(fileKey []byte, recipient *ecdh.PublicKey) (RecipientStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	gcm, err := wrapAEAD(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	// The wrapping key is unique to this stanza, so a zero nonce is safe.
+	nonce := make([]byte, gcm.NonceSize())
+	return RecipientStanza{
+		Type:       RecipientX25519,
+		Ephemeral:  ephemeral.PublicKey().Bytes(),
+		WrappedKey: gcm.Seal(nil, nonce, fileKey, nil),
+	}, nil
+}
+
+// unwrapFileKey tries every identity against every recipient stanza.
+func unwrapFileKey(stanzas []RecipientStanza, identities []*ecdh.PrivateKey) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != RecipientX25519 {
+			continue
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(stanza.Ephemeral)
+		if err != nil {
+			continue
+		}
+
+		for _, identity := range identities {
+			shared, err := identity.ECDH(ephemeral)
+			if err != nil {
+				continue
+			}
+			gcm, err := wrapAEAD(shared, stanza.Ephemeral, identity.PublicKey().Bytes())
+			if err != nil {
+				return nil, err
+			}
+			nonce := make([]byte, gcm.NonceSize())
+			if fileKey, err := gcm.Open(nil, nonce, stanza.WrappedKey, nil); err == nil && len(fileKey) == fileKeySize {
+				return fileKey, nil
+			}
+		}
+	}
+
+	return nil, ErrNoIdentity
+}
+
+// wrapAEAD derives the key-wrapping cipher from an X25519 shared secret,
+// bound to both the ephemeral and the recipient public key.
+func wrapAEAD(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	key := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519WrapInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %w", err)
+	}
+
+	return newGCM(key)
+}
+
+// newFileKey creates the key encrypting a container body. With recipients it
+// is a random key wrapped to each of them, with a keystore a random key
+// wrapped under the active master key; otherwise it is derived from the
+// passphrase with fresh KDF parameters. The header is updated to match.
+func newFileKey(header *ContainerHeader, keys Keys) ([]byte, error) {
+	if len(keys.Recipients) == 0 && keys.Keystore == nil {
+		kdf, err := newKDFParams()
+		if err != nil {
+			return nil, err
+		}
+		header.KDF = &kdf
+		return deriveKey(keys.Passphrase, kdf)
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, fmt.Errorf("failed to create file key: %w", err)
+	}
+
+	if len(keys.Recipients) == 0 {
+		master, err := keys.Keystore.ActiveKey()
+		if err != nil {
+			return nil, err
+		}
+		header.Envelope, err = master.wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+
+	for _, recipient := range keys.Recipients {
+		stanza, err := wrapFileKey(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		header.Recipients = append(header.Recipients, stanza)
+	}
+
+	return fileKey, nil
+}
+
+// headerFileKey recovers the key encrypting a container body, by unwrapping
+// it with one of the identities or a master key, or by deriving it from the
+// passphrase.
+func headerFileKey(header *ContainerHeader, keys Keys) ([]byte, error) {
+	if len(header.Recipients) > 0 {
+		return unwrapFileKey(header.Recipients, keys.Identities)
+	}
+	if header.Envelope != nil {
+		return unwrapEnvelope(header.Envelope, keys.Keystore)
+	}
+	if header.KDF == nil {
+		return nil, errors.New("container header has neither recipients nor key derivation parameters")
+	}
+
+	return deriveKey(keys.Passphrase, *header.KDF)
+}
+
+// DecryptionKeys returns the keys needed to decrypt the file at path: the
+// identities when it was encrypted to recipients, the passphrase otherwise.
+func DecryptionKeys(path, passphraseFile string, identityFiles []string) (Keys, error) {
+	header, err := PeekContainerHeader(path)
+	if err != nil && !errors.Is(err, ErrNotContainer) {
+		return Keys{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if header != nil && header.Envelope != nil {
+		keystore, err := LoadKeystore()
+		if err != nil {
+			return Keys{}, err
+		}
+		return Keys{Keystore: keystore}, nil
+	}
+	if header != nil && len(header.Recipients) > 0 {
+		identities, err := LoadIdentities(identityFiles)
+		if err != nil {
+			return Keys{}, err
+		}
+		return Keys{Identities: identities}, nil
+	}
+
+	passphrase, err := ReadPassphrase(passphraseFile, false)
+	if err != nil {
+		return Keys{}, err
+	}
+
+	return Keys{Passphrase: passphrase}, nil
+}
+
+// EncryptionKeys returns the keys used to encrypt a file: the named
+// recipients when any are given, the keystore when envelope is set, the
+// passphrase otherwise.
+func EncryptionKeys(passphraseFile string, recipients []string, envelope bool) (Keys, error) {
+	if len(recipients) > 0 {
+		keys, err := ResolveRecipients(recipients)
+		if err != nil {
+			return Keys{}, err
+		}
+		return Keys{Recipients: keys}, nil
+	}
+
+	if envelope {
+		keystore, err := LoadKeystore()
+		if err != nil {
+			return Keys{}, err
+		}
+		if _, err := keystore.ActiveKey(); err != nil {
+			return Keys{}, err
+		}
+		return Keys{Keystore: keystore}, nil
+	}
+
+	passphrase, err := ReadPassphrase(passphraseFile, true)
+	if err != nil {
+		return Keys{}, err
+	}
+
+	return Keys{Passphrase: passphrase}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// newIdentities generates n X25519 private keys.
+func newIdentities(t *testing.T, n int) []*ecdh.PrivateKey {
+	t.Helper()
+
+	var identities []*ecdh.PrivateKey
+	for i := 0; i < n; i++ {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities
+}
+
+// identityKeys returns keys encrypting to a new identity and keys decrypting
+// with it, which is much faster than deriving a key from a passphrase.
+func identityKeys(t *testing.T) (encrypt, decrypt Keys) {
+	t.Helper()
+
+	identity := newIdentities(t, 1)[0]
+	return Keys{Recipients: []*ecdh.PublicKey{identity.PublicKey()}}, Keys{Identities: []*ecdh.PrivateKey{identity}}
+}
+
+// encryptToRecipients encrypts plain to the public keys of identities.
+func encryptToRecipients(t *testing.T, plain []byte, identities ...*ecdh.PrivateKey) []byte {
+	t.Helper()
+
+	var recipients []*ecdh.PublicKey
+	for _, identity := range identities {
+		recipients = append(recipients, identity.PublicKey())
+	}
+
+	var encrypted bytes.Buffer
+	if err := CompressAndEncryptStream(&encrypted, bytes.NewReader(plain), Keys{Recipients: recipients}, CompressionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted.Bytes()
+}
+
+func TestRecipientsEachDecrypt(t *testing.T) {
+	ids := newIdentities(t, 3)
+	alice, bob, carol := ids[0], ids[1], ids[2]
+	encrypted := encryptToRecipients(t, []byte("shared secret"), alice, bob)
+
+	header, _, err := ReadContainerHeader(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 2 || header.KDF != nil {
+		t.Fatalf("header = %+v", header)
+	}
+
+	for name, identities := range map[string][]*ecdh.PrivateKey{
+		"alice":          {alice},
+		"bob":            {bob},
+		"carol then bob": {carol, bob},
+	} {
+		var decrypted bytes.Buffer
+		if err := DecryptAndDecompressStream(&decrypted, bytes.NewReader(encrypted), Keys{Identities: identities}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if decrypted.String() != "shared secret" {
+			t.Errorf("%s decrypted %q", name, decrypted.String())
+		}
+	}
+}
+
+func TestRecipientsRejectWrongIdentity(t *testing.T) {
+	ids := newIdentities(t, 3)
+	encrypted := encryptToRecipients(t, []byte("secret"), ids[0], ids[1])
+
+	for name, keys := range map[string]Keys{
+		"other identity": {Identities: ids[2:]},
+		"no identity":    {},
+		"passphrase":     {Passphrase: []byte("secret")},
+	} {
+		err := DecryptAndDecompressStream(&bytes.Buffer{}, bytes.NewReader(encrypted), keys)
+		if !errors.Is(err, ErrNoIdentity) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+}
+
+func TestUnwrapRejectsTamperedStanza(t *testing.T) {
+	ids := newIdentities(t, 1)
+	fileKey := make([]byte, fileKeySize)
+	rand.Read(fileKey)
+
+	stanza, err := wrapFileKey(fileKey, ids[0].PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unwrapFileKey([]RecipientStanza{stanza}, ids); err != nil || !bytes.Equal(got, fileKey) {
+		t.Fatalf("unwrapFileKey = %x, %v", got, err)
+	}
+
+	tampered := stanza
+	tampered.WrappedKey = append([]byte(nil), stanza.WrappedKey...)
+	tampered.WrappedKey[0] ^= 1
+	swapped := stanza
+	swapped.Ephemeral = newIdentities(t, 1)[0].PublicKey().Bytes()
+	unknown := stanza
+	unknown.Type = "unknown"
+
+	for name, stanza := range map[string]RecipientStanza{"wrapped key": tampered, "ephemeral key": swapped, "type": unknown} {
+		if _, err := unwrapFileKey([]RecipientStanza{stanza}, ids); !errors.Is(err, ErrNoIdentity) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+}
+
+func TestRecipientKeyring(t *testing.T) {
+	mem := useMemFileSystem(t)
+	t.Setenv(HomeEnv, "/home")
+	mem.MkdirAll("/keys", 0755)
+
+	if err := GenerateKeyPair("/keys/alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKeyPair("/keys/alice"); err == nil {
+		t.Error("existing key pair overwritten")
+	}
+	identity, err := LoadIdentity("/keys/alice.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := newIdentities(t, 1)[0]
+
+	if err := AddRecipient("alice", "/keys/alice.pub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRecipient("bob", EncodePublicKey(bob.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRecipient("alice", EncodePublicKey(bob.PublicKey())); err == nil {
+		t.Error("duplicate recipient added")
+	}
+	if err := AddRecipient("eve", "not a key"); err == nil {
+		t.Error("invalid key added")
+	}
+
+	keys, err := ResolveRecipients([]string{"alice", "bob", "/keys/alice.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys[0].Equal(identity.PublicKey()) || !keys[1].Equal(bob.PublicKey()) || !keys[2].Equal(identity.PublicKey()) {
+		t.Error("recipients resolved to the wrong keys")
+	}
+
+	if err := RemoveRecipient("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveRecipients([]string{"alice"}); err == nil {
+		t.Error("removed recipient still resolves")
+	}
+	if err := RemoveRecipient("alice"); err == nil {
+		t.Error("removed a missing recipient")
+	}
+}
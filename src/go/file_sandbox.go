@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxSymlinks is the number of symbolic links followed while resolving a
+// single name before giving up, as the kernel does.
+const maxSymlinks = 40
+
+// SandboxFileSystem confines every name to a root directory of another
+// FileSystem, like chroot. Names are resolved relative to the root whether
+// they are relative or absolute, ".." never climbs above it, and symbolic
+// links are followed within the sandbox: an absolute link target is taken
+// relative to the root, so no link can point outside of it.
+//
+// Names are resolved before each operation, so a link created by someone
+// else between resolving and using a name could still escape; the sandbox
+// protects against crafted arguments, not against concurrent writers.
+type SandboxFileSystem struct {
+	root string // host name of the root directory
+	base FileSystem
+}
+
+// NewSandboxFileSystem returns a FileSystem confined to the directory root of base.
+func NewSandboxFileSystem(root string, base FileSystem) (*SandboxFileSystem, error) {
+	abs, err := base.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the sandbox root: %w", err)
+	}
+	info, err := base.Stat(abs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the sandbox root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("sandbox root %s is not a directory", root)
+	}
+
+	return &SandboxFileSystem{root: abs, base: base}, nil
+}
+
+// host returns the name in the base file system of a clean virtual path.
+func (s *SandboxFileSystem) host(virtual string) string {
+	return filepath.Join(s.root, filepath.FromSlash(virtual))
+}
+
+// splitPath splits a clean virtual path into its components.
+func splitPath(virtual string) []string {
+	if virtual == "/" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimPrefix(virtual, "/"), "/")
+}
+
+// resolve returns the virtual path name refers to, following symbolic links
+// within the sandbox. The last component is only followed if followLast is
+// set, so operations on links themselves, such as Lstat and Remove, act on
+// the link.
+func (s *SandboxFileSystem) resolve(name string, followLast bool) (string, error) {
+	parts := splitPath(path.Clean("/" + filepath.ToSlash(name)))
+	resolved := "/"
+	links := 0
+
+	for i := 0; i < len(parts); i++ {
+		next := path.Join(resolved, parts[i])
+		if i == len(parts)-1 && !followLast {
+			return next, nil
+		}
+
+		info, err := s.base.Lstat(s.host(next))
+		if err != nil {
+			// Nothing below a missing component can be a link.
+			return path.Join(append([]string{next}, parts[i+1:]...)...), nil
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := s.base.Readlink(s.host(next))
+		if err != nil {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: err}
+		}
+		target = filepath.ToSlash(target)
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+
+		// Start over with the target followed by the remaining components.
+		parts = append(splitPath(path.Clean("/"+target)), parts[i+1:]...)
+		resolved = "/"
+		i = -1
+	}
+
+	return resolved, nil
+}
+
+// hostName resolves name to its name in the base file system.
+func (s *SandboxFileSystem) hostName(name string, followLast bool) (string, error) {
+	virtual, err := s.resolve(name, followLast)
+	if err != nil {
+		return "", err
+	}
+
+	return s.host(virtual), nil
+}
+
+// virtualError replaces host names in err with the names given by the
+// caller, so errors do not reveal where the sandbox lives.
+func (s *SandboxFileSystem) virtualError(err error, names ...string) error {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		return &fs.PathError{Op: pathErr.Op, Path: names[0], Err: pathErr.Err}
+	case errors.As(err, &linkErr) && len(names) == 2:
+		return &os.LinkError{Op: linkErr.Op, Old: names[0], New: names[1], Err: linkErr.Err}
+	}
+
+	return err
+}
+
+// sandboxFile is an open file of a SandboxFileSystem. Its name is the
+// virtual name, so it can be passed back to the sandbox.
+type sandboxFile struct {
+	FileHandle
+	name string
+}
+
+func (f *sandboxFile) Name() string { return f.name }
+
+// hostFile returns the operating system file behind handle, looking through
+// the handles of a SandboxFileSystem. It reports false for files the
+// operating system does not hold, such as those of a MemFileSystem.
+func hostFile(handle FileHandle) (*os.File, bool) {
+	for {
+		switch f := handle.(type) {
+		case *os.File:
+			return f, true
+		case *sandboxFile:
+			handle = f.FileHandle
+		default:
+			return nil, false
+		}
+	}
+}
+
+// open resolves name and opens it with openFile.
+func (s *SandboxFileSystem) open(name string, openFile func(string) (FileHandle, error)) (FileHandle, error) {
+	host, err := s.hostName(name, true)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openFile(host)
+	if err != nil {
+		return nil, s.virtualError(err, name)
+	}
+
+	return &sandboxFile{FileHandle: file, name: name}, nil
+}
+
+// Open opens the named file for reading.
+func (s *SandboxFileSystem) Open(name string) (FileHandle, error) {
+	return s.open(name, s.base.Open)
+}
+
+// Create creates or truncates the named file.
+func (s *SandboxFileSystem) Create(name string) (FileHandle, error) {
+	return s.open(name, s.base.Create)
+}
+
+// OpenFile opens the named file with the given flags and permissions.
+func (s *SandboxFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (FileHandle, error) {
+	return s.open(name, func(host string) (FileHandle, error) {
+		return s.base.OpenFile(host, flag, perm)
+	})
+}
+
+// CreateTemp creates a new temporary file in dir, which must be given.
+func (s *SandboxFileSystem) CreateTemp(dir, pattern string) (FileHandle, error) {
+	if dir == "" {
+		return nil, errors.New("temporary files in a sandbox need a directory")
+	}
+	host, err := s.hostName(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.base.CreateTemp(host, pattern)
+	if err != nil {
+		return nil, s.virtualError(err, dir)
+	}
+
+	return &sandboxFile{FileHandle: file, name: filepath.Join(dir, filepath.Base(file.Name()))}, nil
+}
+
+// ReadFile reads the whole named file.
+func (s *SandboxFileSystem) ReadFile(name string) ([]byte, error) {
+	host, err := s.hostName(name, true)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.base.ReadFile(host)
+	if err != nil {
+		return nil, s.virtualError(err, name)
+	}
+
+	return data, nil
+}
+
+// WriteFile writes data to the named file, creating or truncating it.
+func (s *SandboxFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return s.do(name, true, func(host string) error { return s.base.WriteFile(host, data, perm) })
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (s *SandboxFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	host, err := s.hostName(name, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.base.ReadDir(host)
+	if err != nil {
+		return nil, s.virtualError(err, name)
+	}
+
+	return entries, nil
+}
+
+// stat resolves name and returns its file info.
+func (s *SandboxFileSystem) stat(name string, followLast bool) (fs.FileInfo, error) {
+	host, err := s.hostName(name, followLast)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.base.Lstat(host)
+	if err != nil {
+		return nil, s.virtualError(err, name)
+	}
+
+	return info, nil
+}
+
+// Stat returns the file info of the named file, following symbolic links
+// within the sandbox.
+func (s *SandboxFileSystem) Stat(name string) (fs.FileInfo, error) { return s.stat(name, true) }
+
+// Lstat returns the file info of the named file without following a final
+// symbolic link.
+func (s *SandboxFileSystem) Lstat(name string) (fs.FileInfo, error) { return s.stat(name, false) }
+
+// do resolves name and runs op on its host name.
+func (s *SandboxFileSystem) do(name string, followLast bool, op func(host string) error) error {
+	host, err := s.hostName(name, followLast)
+	if err != nil {
+		return err
+	}
+	if err := op(host); err != nil {
+		return s.virtualError(err, name)
+	}
+
+	return nil
+}
+
+// Mkdir creates a directory.
+func (s *SandboxFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return s.do(name, false, func(host string) error { return s.base.Mkdir(host, perm) })
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (s *SandboxFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	return s.do(name, true, func(host string) error { return s.base.MkdirAll(host, perm) })
+}
+
+// Remove removes a file, link or empty directory.
+func (s *SandboxFileSystem) Remove(name string) error {
+	if virtual, _ := s.resolve(name, false); virtual == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	return s.do(name, false, s.base.Remove)
+}
+
+// RemoveAll removes a file or directory and everything it contains. The
+// sandbox root itself cannot be removed.
+func (s *SandboxFileSystem) RemoveAll(name string) error {
+	if virtual, _ := s.resolve(name, false); virtual == "/" {
+		return &fs.PathError{Op: "unlinkat", Path: name, Err: syscall.EBUSY}
+	}
+	return s.do(name, false, s.base.RemoveAll)
+}
+
+// twoNames resolves the names of a rename or link without following final links.
+func (s *SandboxFileSystem) twoNames(oldName, newName string, op func(oldHost, newHost string) error) error {
+	oldHost, err := s.hostName(oldName, false)
+	if err != nil {
+		return err
+	}
+	newHost, err := s.hostName(newName, false)
+	if err != nil {
+		return err
+	}
+	if err := op(oldHost, newHost); err != nil {
+		return s.virtualError(err, oldName, newName)
+	}
+
+	return nil
+}
+
+// Rename renames a file or directory.
+func (s *SandboxFileSystem) Rename(oldName, newName string) error {
+	return s.twoNames(oldName, newName, s.base.Rename)
+}
+
+// Link creates newName as a hard link to oldName.
+func (s *SandboxFileSystem) Link(oldName, newName string) error {
+	return s.twoNames(oldName, newName, s.base.Link)
+}
+
+// Symlink creates name as a symbolic link to target. The target is stored
+// as given, since it is resolved within the sandbox when the link is followed.
+func (s *SandboxFileSystem) Symlink(target, name string) error {
+	host, err := s.hostName(name, false)
+	if err != nil {
+		return err
+	}
+	if err := s.base.Symlink(target, host); err != nil {
+		return s.virtualError(err, target, name)
+	}
+
+	return nil
+}
+
+// Readlink returns the target of a symbolic link, as stored in the link.
+func (s *SandboxFileSystem) Readlink(name string) (string, error) {
+	host, err := s.hostName(name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := s.base.Readlink(host)
+	if err != nil {
+		return "", s.virtualError(err, name)
+	}
+
+	return target, nil
+}
+
+// Chmod changes the mode of the named file.
+func (s *SandboxFileSystem) Chmod(name string, mode fs.FileMode) error {
+	return s.do(name, true, func(host string) error { return s.base.Chmod(host, mode) })
+}
+
+// Chown changes the owner and group of the named file.
+func (s *SandboxFileSystem) Chown(name string, uid, gid int) error {
+	return s.do(name, true, func(host string) error { return s.base.Chown(host, uid, gid) })
+}
+
+// Lchown changes the owner and group of the named file without following a
+// final symbolic link.
+func (s *SandboxFileSystem) Lchown(name string, uid, gid int) error {
+	return s.do(name, false, func(host string) error { return s.base.Lchown(host, uid, gid) })
+}
+
+// Owner returns the owner and group recorded in info by the base file system.
+func (s *SandboxFileSystem) Owner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return s.base.Owner(info)
+}
+
+// SameFile reports whether two file infos describe the same file, as the
+// base file system does.
+func (s *SandboxFileSystem) SameFile(a, b fs.FileInfo) bool {
+	return s.base.SameFile(a, b)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (s *SandboxFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return s.do(name, true, func(host string) error { return s.base.Chtimes(host, atime, mtime) })
+}
+
+// Abs returns the absolute virtual path of name. The working directory of a
+// sandbox is its root.
+func (s *SandboxFileSystem) Abs(name string) (string, error) {
+	return filepath.FromSlash(path.Clean("/" + filepath.ToSlash(name))), nil
+}
+
+// Lock takes an exclusive lock on the named file, as the base file system does.
+func (s *SandboxFileSystem) Lock(name string) (io.Closer, error) {
+	host, err := s.hostName(name, true)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := s.base.Lock(host)
+	if err != nil {
+		return nil, s.virtualError(err, name)
+	}
+
+	return lock, nil
+}
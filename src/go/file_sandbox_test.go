@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandboxConfinesNames(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "secret"), []byte("inside"), 0644)
+	links := map[string]string{
+		"abs":      outside,
+		"rel":      "../outside",
+		"sub/up":   "../../../outside",
+		"rooted":   "/sub",
+		"loop":     "loop",
+		"sub/self": ".",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	sandbox, err := NewSandboxFileSystem(root, OSFileSystem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string // empty if the name must not be readable
+	}{
+		{"../outside/secret", ""},
+		{outside + "/secret", ""},
+		{"abs/secret", ""},
+		{"rel/secret", ""},
+		{"sub/up/secret", ""},
+		{"rooted/secret", "inside"},
+		{"/sub/../sub/secret", "inside"},
+		{"sub/self/self/secret", "inside"},
+		{"../../sub/secret", "inside"},
+	}
+	for _, test := range tests {
+		data, err := sandbox.ReadFile(test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ReadFile(%q) escaped the sandbox and read %q", test.name, data)
+			}
+			continue
+		}
+		if err != nil || string(data) != test.want {
+			t.Errorf("ReadFile(%q) = %q, %v; want %q", test.name, data, err, test.want)
+		}
+	}
+
+	if _, err := sandbox.Stat("loop"); err == nil {
+		t.Error("Stat of a symbolic link loop succeeded")
+	}
+	if err := sandbox.RemoveAll("sub/.."); err == nil {
+		t.Error("removed the sandbox root")
+	}
+
+	// Removing a link removes the link, not its target.
+	if err := sandbox.Remove("abs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("target of a removed link is gone: %v", err)
+	}
+
+	// Errors name the file as given, not where the sandbox lives.
+	_, err = sandbox.Open("missing")
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "missing" {
+		t.Errorf("Open error = %v", err)
+	}
+}
+
+func TestSandboxTempFilesStayInside(t *testing.T) {
+	root := t.TempDir()
+	sandbox, err := NewSandboxFileSystem(root, OSFileSystem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := fsys
+	fsys = sandbox
+	defer func() { fsys = saved }()
+
+	if err := FileOpWrite("/data.txt", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BackupFile("data.txt", BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := FileOpWrite("data.txt", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup("/data.txt", RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "data.txt"))
+	if err != nil || string(data) != "data" {
+		t.Fatalf("restored file = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, BackupDir, CatalogFile)); err != nil {
+		t.Errorf("catalog not stored inside the sandbox: %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// sharePrefix starts the text encoding of a key share.
+const sharePrefix = "gofiler-share:"
+
+// shareVersion is the current version of the key share format.
+const shareVersion = 1
+
+// Kinds of keys that can be split into shares.
+const (
+	ShareMasterKey = 1 // a master key of the keystore
+	ShareVaultKey  = 2 // the key of a vault
+)
+
+// shareSplitIDSize is the size of the random identifier that the shares of
+// one split have in common, used to tell shares of different splits apart.
+const shareSplitIDSize = 8
+
+// shareTagSize is the size of the tag that is split along with the secret.
+// The tag is an HMAC of the split identifier keyed with the secret, so it is
+// only known once the secret is reconstructed and tells a correct
+// reconstruction from one made of damaged shares.
+const shareTagSize = 8
+
+// shareTagContext is authenticated with the tag of every split.
+const shareTagContext = "gofiler share tag v1\x00"
+
+// ErrShareMismatch is returned when shares do not belong to the same split.
+var ErrShareMismatch = errors.New("shares do not belong to the same key")
+
+// Share is one of the shares of a key split with Shamir's secret sharing over
+// GF(256). Any Threshold shares of the same split reconstruct the key; fewer
+// reveal nothing about it.
+type Share struct {
+	Kind      byte
+	KeyID     string
+	Threshold byte
+	X         byte
+	SplitID   []byte // random, the same in every share of the split
+	Y         []byte // shares of the key followed by shares of its tag
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial x^8 + x^4 + x^3 + x + 1.
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a non-zero element of GF(256),
+// computed as a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+
+	return result
+}
+
+// SplitSecret splits secret into n shares, any k of which reconstruct it.
+func SplitSecret(secret []byte, n, k int) ([]Share, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares; need 2 <= threshold <= shares <= 255", k, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+
+	splitID := make([]byte, shareSplitIDSize)
+	if _, err := io.ReadFull(rand.Reader, splitID); err != nil {
+		return nil, fmt.Errorf("failed to create split ID: %w", err)
+	}
+	tagged := append(append([]byte(nil), secret...), shareTag(secret, splitID)...)
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Threshold: byte(k), X: byte(i + 1), SplitID: splitID, Y: make([]byte, len(tagged))}
+	}
+
+	// Every byte of the secret and its tag is the constant term of its own
+	// random polynomial of degree k-1, evaluated at x = 1..n with Horner's
+	// method.
+	coefficients := make([]byte, k)
+	for b, s := range tagged {
+		coefficients[0] = s
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to create random coefficients: %w", err)
+		}
+		for i := range shares {
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, shares[i].X) ^ coefficients[c]
+			}
+			shares[i].Y[b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares reconstructs the secret from at least threshold shares of
+// the same split by Lagrange interpolation at x = 0.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	first := shares[0]
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if share.Kind != first.Kind || share.KeyID != first.KeyID || share.Threshold != first.Threshold ||
+			!bytes.Equal(share.SplitID, first.SplitID) || len(share.Y) != len(first.Y) {
+			return nil, ErrShareMismatch
+		}
+		if share.X == 0 || seen[share.X] {
+			return nil, fmt.Errorf("duplicate or invalid share number %d", share.X)
+		}
+		seen[share.X] = true
+	}
+	if len(first.Y) <= shareTagSize {
+		return nil, errors.New("share is too short")
+	}
+	if len(shares) < int(first.Threshold) {
+		return nil, fmt.Errorf("%d shares given, but %d are needed", len(shares), first.Threshold)
+	}
+	shares = shares[:first.Threshold]
+
+	secret := make([]byte, len(first.Y))
+	for i, share := range shares {
+		// The Lagrange basis polynomial of share i at 0 is the product of
+		// x_j / (x_j - x_i); subtraction is XOR in GF(256).
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other.X, gfInv(other.X^share.X)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share.Y[b], basis)
+		}
+	}
+
+	secret, tag := secret[:len(secret)-shareTagSize], secret[len(secret)-shareTagSize:]
+	if !hmac.Equal(tag, shareTag(secret, first.SplitID)) {
+		return nil, errors.New("reconstructed key does not match its tag; a share is damaged")
+	}
+
+	return secret, nil
+}
+
+// shareTag returns the tag split along with secret.
+func shareTag(secret, splitID []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(shareTagContext))
+	mac.Write(splitID)
+
+	return mac.Sum(nil)[:shareTagSize]
+}
+
+// Encode returns the printable text encoding of the share. A checksum is
+// included so that mistyped shares are detected.
+func (s Share) Encode() string {
+	var buf bytes.Buffer
+	buf.Write([]byte{shareVersion, s.Kind, s.Threshold, s.X, byte(len(s.KeyID))})
+	buf.WriteString(s.KeyID)
+	buf.Write(s.SplitID)
+	buf.Write(s.Y)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:4])
+
+	return encodeKey(sharePrefix, buf.Bytes())
+}
+
+// ParseShare decodes a share from its text encoding. Lines starting with #
+// are ignored, so share files may carry instructions.
+func ParseShare(text string) (Share, error) {
+	var line string
+	for _, l := range strings.Split(text, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			line = l
+			break
+		}
+	}
+
+	data, err := decodeKey(line, sharePrefix)
+	if err != nil {
+		return Share{}, err
+	}
+	if len(data) < 5+4 {
+		return Share{}, errors.New("share is too short")
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if digest := sha256.Sum256(body); !bytes.Equal(digest[:4], sum) {
+		return Share{}, errors.New("share checksum mismatch; check it for typos")
+	}
+	if body[0] != shareVersion {
+		return Share{}, fmt.Errorf("unsupported share version %d", body[0])
+	}
+
+	idLen := int(body[4])
+	if len(body) < 5+idLen+shareSplitIDSize+shareTagSize+1 {
+		return Share{}, errors.New("share is too short")
+	}
+
+	return Share{
+		Kind:      body[1],
+		Threshold: body[2],
+		X:         body[3],
+		KeyID:     string(body[5 : 5+idLen]),
+		SplitID:   body[5+idLen : 5+idLen+shareSplitIDSize],
+		Y:         body[5+idLen+shareSplitIDSize:],
+	}, nil
+}
+
+// kindName returns a description of a kind of shared key.
+func kindName(kind byte) string {
+	switch kind {
+	case ShareMasterKey:
+		return "master key"
+	case ShareVaultKey:
+		return "vault key"
+	}
+
+	return fmt.Sprintf("key of unknown kind %d", kind)
+}
+
+// SplitKey splits a master key of the keystore, or the key of the vault when
+// target is a vault directory, into n shares with threshold k. Every share
+// is written to its own file, readable only by its owner, in the current
+// directory.
+func SplitKey(target string, n, k int, passphrase func() ([]byte, error)) error {
+	var kind byte
+	var id string
+	var secret []byte
+
+	if isDirectory(target) {
+		config, key, err := vaultKey(target, passphrase)
+		if err != nil {
+			return err
+		}
+		kind, id, secret = ShareVaultKey, config.ID, key
+	} else {
+		keystore, err := LoadKeystore()
+		if err != nil {
+			return err
+		}
+		master, err := keystore.Lookup(target)
+		if err != nil {
+			return err
+		}
+		kind, id, secret = ShareMasterKey, master.ID, master.Key
+	}
+
+	shares, err := SplitSecret(secret, n, k)
+	if err != nil {
+		return err
+	}
+
+	for _, share := range shares {
+		share.Kind, share.KeyID = kind, id
+		name := fmt.Sprintf("%s-share-%d-of-%d.txt", id, share.X, n)
+		text := fmt.Sprintf("# GoFiler %s %s, share %d of %d\n# Any %d shares recover the key with -combine-shares.\n# Created %s\n%s\n",
+			kindName(kind), id, share.X, n, k, time.Now().UTC().Format(time.RFC3339), share.Encode())
+
+		file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create share file: %w", err)
+		}
+		_, err = file.WriteString(text)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write share file: %w", err)
+		}
+		fmt.Printf("Share %d written to %s\n", share.X, name)
+	}
+
+	fmt.Printf("Split %s %s into %d shares; any %d of them recover it\n", kindName(kind), id, n, k)
+	return nil
+}
+
+// CombineKeyShares reconstructs a key from share files. A master key is
+// added back to the keystore, so files encrypted under it can be decrypted
+// again. A vault key is given a new passphrase; vaultDir must then be the
+// vault the shares belong to.
+func CombineKeyShares(files []string, vaultDir string, newPassphrase func() ([]byte, error)) error {
+	var shares []Share
+	for _, name := range files {
+		data, err := fsys.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("failed to read share: %w", err)
+		}
+		share, err := ParseShare(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		shares = append(shares, share)
+	}
+
+	secret, err := CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	id := shares[0].KeyID
+
+	switch shares[0].Kind {
+	case ShareMasterKey:
+		lock, err := lockKeystore()
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+
+		keystore, err := LoadKeystore()
+		if err != nil {
+			return err
+		}
+		if _, err := keystore.Lookup(id); err == nil {
+			fmt.Printf("Master key %s recovered; it is already in the keystore\n", id)
+			return nil
+		}
+		keystore.Keys = append(keystore.Keys, MasterKey{ID: id, Key: secret, CreatedAt: time.Now().UTC()})
+		if keystore.Active == "" {
+			keystore.Active = id
+		}
+		if err := keystore.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Master key %s recovered and added to the keystore\n", id)
+		return nil
+
+	case ShareVaultKey:
+		if vaultDir == "" {
+			return fmt.Errorf("shares hold the key of vault %s; name the vault with -vault", id)
+		}
+		config, err := loadVaultConfig(vaultDir)
+		if err != nil {
+			return err
+		}
+		if config.ID != id {
+			return fmt.Errorf("shares hold the key of vault %s, not of %s (vault %s)", id, vaultDir, config.ID)
+		}
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		return ResetVaultPassphrase(vaultDir, secret, passphrase)
+	}
+
+	return fmt.Errorf("cannot recover a %s", kindName(shares[0].Kind))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"testing"
+)
+
+// splitTestSecret splits a random 32-byte secret into n shares with threshold k.
+func splitTestSecret(t *testing.T, n, k int) ([]byte, []Share) {
+	t.Helper()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	shares, err := SplitSecret(secret, n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range shares {
+		shares[i].Kind, shares[i].KeyID = ShareMasterKey, "test-key"
+	}
+
+	return secret, shares
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%d * inverse = %d", a, p)
+		}
+	}
+}
+
+func TestCombineSharesThreshold(t *testing.T) {
+	const n, k = 5, 3
+	secret, shares := splitTestSecret(t, n, k)
+
+	// Every subset of the shares, in every order given by the mask.
+	for mask := 1; mask < 1<<n; mask++ {
+		var subset []Share
+		for i := n - 1; i >= 0; i-- {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, shares[i])
+			}
+		}
+
+		got, err := CombineShares(subset)
+		if bits.OnesCount(uint(mask)) < k {
+			if err == nil {
+				t.Errorf("shares %05b: %d shares recovered a secret", mask, len(subset))
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("shares %05b: %x, %v", mask, got, err)
+		}
+	}
+}
+
+func TestShareRevealsNothingAboutSecret(t *testing.T) {
+	secret, shares := splitTestSecret(t, 3, 2)
+	again, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in a share that is the same for every split of a secret could
+	// be used to confirm a guess of it.
+	digest := sha256.Sum256(secret)
+	for i, share := range shares {
+		if bytes.Equal(share.SplitID, again[i].SplitID) || bytes.Equal(share.Y, again[i].Y) {
+			t.Errorf("share %d is the same in two splits of the secret", share.X)
+		}
+		encoded, _ := decodeKey(share.Encode(), sharePrefix)
+		if bytes.Contains(encoded, digest[:4]) {
+			t.Errorf("share %d holds the digest of the secret", share.X)
+		}
+	}
+}
+
+func TestSplitSecretRejectsInvalidParameters(t *testing.T) {
+	tests := []struct {
+		n, k   int
+		secret []byte
+	}{
+		{n: 3, k: 1, secret: []byte("s")},
+		{n: 2, k: 3, secret: []byte("s")},
+		{n: 256, k: 2, secret: []byte("s")},
+		{n: 3, k: 2},
+	}
+
+	for _, tt := range tests {
+		if _, err := SplitSecret(tt.secret, tt.n, tt.k); err == nil {
+			t.Errorf("split into %d shares with threshold %d, secret %q", tt.n, tt.k, tt.secret)
+		}
+	}
+}
+
+func TestCombineSharesRejectsBadShares(t *testing.T) {
+	_, shares := splitTestSecret(t, 4, 2)
+	_, otherSplit := splitTestSecret(t, 4, 2)
+
+	tests := []struct {
+		name    string
+		shares  func() []Share
+		wantErr error // nil when any error will do
+	}{
+		{"none", func() []Share { return nil }, nil},
+		{"duplicate", func() []Share { return []Share{shares[0], shares[0]} }, nil},
+		{"invalid number", func() []Share {
+			zero := shares[1]
+			zero.X = 0
+			return []Share{shares[0], zero}
+		}, nil},
+		{"other key", func() []Share {
+			other := shares[1]
+			other.KeyID = "other-key"
+			return []Share{shares[0], other}
+		}, ErrShareMismatch},
+		{"other kind", func() []Share {
+			other := shares[1]
+			other.Kind = ShareVaultKey
+			return []Share{shares[0], other}
+		}, ErrShareMismatch},
+		{"other threshold", func() []Share {
+			other := shares[1]
+			other.Threshold = 3
+			return []Share{shares[0], other}
+		}, ErrShareMismatch},
+		{"other split", func() []Share { return []Share{shares[0], otherSplit[1]} }, ErrShareMismatch},
+		{"corrupted", func() []Share {
+			corrupted := shares[1]
+			corrupted.Y = append([]byte(nil), corrupted.Y...)
+			corrupted.Y[0] ^= 1
+			return []Share{shares[0], corrupted}
+		}, nil},
+		{"shorter", func() []Share {
+			short := shares[1]
+			short.Y = short.Y[:len(short.Y)-1]
+			return []Share{shares[0], short}
+		}, ErrShareMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := CombineShares(tt.shares())
+			if err == nil {
+				t.Fatalf("recovered %x", secret)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	_, shares := splitTestSecret(t, 3, 2)
+	share := shares[2]
+	text := share.Encode()
+
+	parsed, err := ParseShare("# GoFiler master key test-key, share 3 of 3\n\n" + text + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Kind != share.Kind || parsed.KeyID != share.KeyID || parsed.Threshold != share.Threshold ||
+		parsed.X != share.X || !bytes.Equal(parsed.SplitID, share.SplitID) || !bytes.Equal(parsed.Y, share.Y) {
+		t.Errorf("parsed %+v, want %+v", parsed, share)
+	}
+	if again := parsed.Encode(); again != text {
+		t.Errorf("encoding changed: %s", again)
+	}
+
+	// A typo anywhere in the encoded share is caught by its checksum.
+	body := strings.TrimPrefix(text, sharePrefix)
+	for i := 0; i < len(body); i++ {
+		typo := []byte(body)
+		if typo[i] == 'A' {
+			typo[i] = 'B'
+		} else {
+			typo[i] = 'A'
+		}
+		if _, err := ParseShare(sharePrefix + string(typo)); err == nil {
+			t.Errorf("typo at %d accepted", i)
+		}
+	}
+
+	for _, bad := range []string{"", "# only a comment", "gofiler-share:", text[:len(text)-8], strings.Replace(text, sharePrefix, ed25519PublicPrefix, 1)} {
+		if _, err := ParseShare(bad); err == nil {
+			t.Errorf("ParseShare(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCombineKeyShares(t *testing.T) {
+	mem := useKeystore(t)
+	encryptUnderEnvelope(t, mem, "/file", "secret")
+	old, _ := LoadKeystore()
+
+	if err := SplitKey(old.Active, 3, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveMasterKey(old.Active); err != nil {
+		t.Fatal(err)
+	}
+
+	share := func(x int) string { return fmt.Sprintf("/%s-share-%d-of-3.txt", old.Active, x) }
+	if err := CombineKeyShares([]string{share(3)}, "", nil); err == nil {
+		t.Error("key recovered from a single share")
+	}
+	if err := CombineKeyShares([]string{share(3), share(1)}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := envelopeDecrypt(mem, "/file"); err != nil || got != "secret" {
+		t.Errorf("after recovery: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// DefaultShredPasses is the number of times -shred overwrites a file.
+const DefaultShredPasses = 3
+
+// shredBufferSize is the size of the writes used to overwrite a file.
+const shredBufferSize = 64 * 1024
+
+// shredPendingInfix marks the hard link under which ShredReplaced keeps the
+// original content of a file until it is shredded.
+const shredPendingInfix = ".shred-"
+
+// shredPending matches the links ShredReplaced creates; the submatch is the
+// name of the file the link belongs to.
+var shredPending = regexp.MustCompile(`^\.(.+)\.shred-[0-9a-f]{16}$`)
+
+// shredChecked records the file systems already inspected, so each is
+// warned about once.
+var (
+	shredCheckedMu sync.Mutex
+	shredChecked   = make(map[string]bool)
+)
+
+// warnShredUnreliable prints a warning if overwriting files at path may not
+// destroy their old contents. The file system is inspected through a handle
+// opened with fsys, so a path in a sandbox is checked where it is on the
+// host. Files the operating system does not hold, such as those of a
+// MemFileSystem, are not checked.
+func warnShredUnreliable(path string) {
+	info, err := fsys.Lstat(path)
+	if err != nil || !(info.Mode().IsRegular() || info.IsDir()) {
+		return
+	}
+	handle, err := fsys.Open(path)
+	if err != nil {
+		return
+	}
+	defer handle.Close()
+	file, ok := hostFile(handle)
+	if !ok {
+		return
+	}
+
+	key, reason := shredCaveat(file)
+	if key == "" {
+		return
+	}
+
+	shredCheckedMu.Lock()
+	defer shredCheckedMu.Unlock()
+	if shredChecked[key] {
+		return
+	}
+	shredChecked[key] = true
+	if reason == "" {
+		return
+	}
+	fmt.Printf("Warning: %s: %s; old copies of the data may survive shredding\n", path, reason)
+}
+
+// ShredPath overwrites the contents of a file passes times with random data
+// before removing it. Directories are shredded recursively. Symbolic links
+// are removed without touching their targets.
+func ShredPath(path string, passes int) error {
+	if passes < 1 {
+		return fmt.Errorf("invalid number of passes %d", passes)
+	}
+
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if abs, err := fsys.Abs(path); err == nil && filepath.Dir(abs) == abs {
+		return fmt.Errorf("refusing to shred the root directory %s", path)
+	}
+	warnShredUnreliable(path)
+
+	if !info.IsDir() {
+		if err := shredFile(path, passes); err != nil {
+			return err
+		}
+		fmt.Printf("File %s shredded (%d passes)\n", path, passes)
+		return nil
+	}
+
+	count := 0
+	err = walkDir(fsys, path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			if err := shredFile(p, passes); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to shred %s: %w", path, err)
+	}
+
+	// Only directories, links and special files are left.
+	if err := fsys.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to delete directory: %w", err)
+	}
+
+	fmt.Printf("Directory %s shredded (%d files, %d passes)\n", path, count, passes)
+	return nil
+}
+
+// shredFile overwrites a single file and removes it. The file is renamed to
+// a random name before it is removed, so its name does not linger in the
+// directory either.
+func shredFile(path string, passes int) error {
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		return nil
+	}
+
+	if err := overwriteFile(path, info.Size(), passes); err != nil {
+		return err
+	}
+
+	name := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, name); err != nil {
+		return fmt.Errorf("failed to create random name: %w", err)
+	}
+	hidden := filepath.Join(filepath.Dir(path), "."+hex.EncodeToString(name))
+	if err := fsys.Rename(path, hidden); err != nil {
+		hidden = path
+	}
+	if err := fsys.Remove(hidden); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// overwriteFile writes size bytes of random data over the file passes times,
+// syncing after every pass, and then truncates it.
+func overwriteFile(path string, size int64, passes int) error {
+	file, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, shredBufferSize)
+	for pass := 0; pass < passes; pass++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+		for written := int64(0); written < size; {
+			n := int64(len(buf))
+			if size-written < n {
+				n = size - written
+			}
+			if _, err := io.ReadFull(rand.Reader, buf[:n]); err != nil {
+				return fmt.Errorf("failed to create random data: %w", err)
+			}
+			if _, err := file.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to overwrite file: %w", err)
+			}
+			written += n
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
+		}
+	}
+
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// ShredReplaced runs replace, which replaces or copies the file at path, for
+// instance by encrypting it, and then shreds the original contents. Since
+// replacing a file by renaming over it only unlinks the old data, the
+// original is kept under a hidden hard link until replace has succeeded.
+func ShredReplaced(path string, passes int, replace func() error) error {
+	if path == StdioPath {
+		return errors.New("standard input cannot be shredded")
+	}
+
+	before, err := fsys.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if !before.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	warnShredUnreliable(path)
+
+	name := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, name); err != nil {
+		return fmt.Errorf("failed to create random name: %w", err)
+	}
+	original := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+shredPendingInfix+hex.EncodeToString(name))
+	if err := fsys.Link(path, original); err != nil {
+		return fmt.Errorf("failed to keep the original for shredding: %w", err)
+	}
+
+	if err := replace(); err != nil {
+		fsys.Remove(original)
+		return err
+	}
+
+	if err := shredFile(original, passes); err != nil {
+		return err
+	}
+	// If path was not replaced, it still names the now shredded data.
+	if after, err := fsys.Lstat(path); err == nil && fsys.SameFile(before, after) {
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+
+	fmt.Printf("Original contents of %s shredded (%d passes)\n", path, passes)
+	return nil
+}
+
+// resumeShred deals with a link left by an interrupted ShredReplaced and
+// reports whether it is gone. If the file the link belongs to was never
+// replaced, the link is just a second name for it and is removed. Otherwise
+// it holds the only copy of the original content, which is shredded with
+// passes, or left in place when passes is 0.
+func resumeShred(link string, passes int) (bool, error) {
+	m := shredPending.FindStringSubmatch(filepath.Base(link))
+	if m == nil {
+		return false, fmt.Errorf("%s was not left by -shred", link)
+	}
+
+	info, err := fsys.Lstat(link)
+	if err != nil {
+		return false, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if current, err := fsys.Lstat(filepath.Join(filepath.Dir(link), m[1])); err == nil && fsys.SameFile(info, current) {
+		if err := fsys.Remove(link); err != nil {
+			return false, fmt.Errorf("failed to delete file: %w", err)
+		}
+		return true, nil
+	}
+	if passes < 1 {
+		return false, nil
+	}
+
+	if err := shredFile(link, passes); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// File system magic numbers from statfs(2) for which overwriting a file in
+// place does not reliably overwrite the blocks that held its old contents.
+var unreliableShredFilesystems = map[uint32]string{
+	0x9123683e: "btrfs is copy-on-write",
+	0x2fc12fc1: "ZFS is copy-on-write",
+	0xf2f52010: "F2FS is log-structured",
+	0x794c7630: "overlayfs keeps the original in its lower layer",
+	0x6969:     "NFS storage may cache or snapshot data",
+	0xff534d42: "CIFS storage may cache or snapshot data",
+	0xfe534d42: "SMB storage may cache or snapshot data",
+}
+
+// shredCaveat returns why overwriting the open file may be unreliable, or an
+// empty reason. key identifies the file system, so callers can warn once.
+func shredCaveat(file *os.File) (key, reason string) {
+	var fsStat syscall.Statfs_t
+	if err := syscall.Fstatfs(int(file.Fd()), &fsStat); err != nil {
+		return "", ""
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &stat); err != nil {
+		return "", ""
+	}
+	key = fmt.Sprint(stat.Dev)
+
+	if reason, ok := unreliableShredFilesystems[uint32(fsStat.Type)]; ok {
+		return key, reason
+	}
+	if isSolidState(uint64(stat.Dev)) {
+		return key, "the device is an SSD, whose wear leveling writes to new blocks"
+	}
+
+	return key, ""
+}
+
+// isSolidState reports whether the block device dev is known to be non-rotational.
+func isSolidState(dev uint64) bool {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	base := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+
+	// Partitions have no queue of their own; it belongs to the parent disk.
+	for _, path := range []string{base + "/queue/rotational", base + "/../queue/rotational"} {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(data)) == "0"
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// shredCaveat returns why overwriting the open file may be unreliable. The
+// file system cannot be inspected on this platform, so no reason is given.
+func shredCaveat(file *os.File) (key, reason string) {
+	return "", ""
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// assertEmptyDir fails the test unless dir exists and is empty.
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s left in %s", entry.Name(), dir)
+	}
+}
+
+func TestShredPathFile(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/data", 0755)
+	mem.WriteFile("/data/secret", []byte("top secret"), 0600)
+	// A second name for the file shows what became of its content.
+	mem.Link("/data/secret", "/witness")
+
+	if err := ShredPath("/data/secret", 2); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, "/data")
+	assertUnchanged(t, mem, "/witness", "")
+}
+
+func TestShredPathDirectory(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/data/sub", 0755)
+	mem.WriteFile("/data/a", []byte("a"), 0600)
+	mem.WriteFile("/data/sub/b", []byte("b"), 0600)
+	mem.WriteFile("/outside", []byte("not shredded"), 0600)
+	mem.Symlink("/outside", "/data/sub/link")
+	mem.Link("/data/sub/b", "/witness")
+
+	if err := ShredPath("/data", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Lstat("/data"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("directory kept: %v", err)
+	}
+	assertUnchanged(t, mem, "/outside", "not shredded")
+	assertUnchanged(t, mem, "/witness", "")
+}
+
+func TestShredPathRejects(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.WriteFile("/file", []byte("kept"), 0600)
+
+	if err := ShredPath("/file", 0); err == nil {
+		t.Error("shredded with 0 passes")
+	}
+	if err := ShredPath("/", 1); err == nil {
+		t.Error("root directory shredded")
+	}
+	if err := ShredPath("/missing", 1); err == nil {
+		t.Error("missing file shredded")
+	}
+	assertUnchanged(t, mem, "/file", "kept")
+}
+
+func TestShredReplaced(t *testing.T) {
+	replaceWith := func(content string) func() error {
+		return func() error {
+			return writeFileAtomic("/data/file", 0600, func(w io.Writer) error {
+				_, err := io.WriteString(w, content)
+				return err
+			})
+		}
+	}
+
+	t.Run("replaced", func(t *testing.T) {
+		mem := useMemFileSystem(t)
+		mem.MkdirAll("/data", 0755)
+		mem.WriteFile("/data/file", []byte("plaintext"), 0600)
+		mem.Link("/data/file", "/witness")
+
+		if err := ShredReplaced("/data/file", 1, replaceWith("ciphertext")); err != nil {
+			t.Fatal(err)
+		}
+		assertUnchanged(t, mem, "/data/file", "ciphertext")
+		assertUnchanged(t, mem, "/witness", "")
+		if entries, _ := mem.ReadDir("/data"); len(entries) != 1 {
+			t.Errorf("/data holds %d entries", len(entries))
+		}
+	})
+
+	t.Run("copied", func(t *testing.T) {
+		mem := useMemFileSystem(t)
+		mem.MkdirAll("/data", 0755)
+		mem.WriteFile("/data/file", []byte("plaintext"), 0600)
+
+		err := ShredReplaced("/data/file", 1, func() error {
+			return mem.WriteFile("/copy", []byte("ciphertext"), 0600)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEmptyDir(t, "/data")
+	})
+
+	t.Run("replace fails", func(t *testing.T) {
+		mem := useMemFileSystem(t)
+		mem.MkdirAll("/data", 0755)
+		mem.WriteFile("/data/file", []byte("plaintext"), 0600)
+		failure := errors.New("encryption failed")
+
+		if err := ShredReplaced("/data/file", 1, func() error { return failure }); !errors.Is(err, failure) {
+			t.Fatalf("error = %v", err)
+		}
+		assertUnchanged(t, mem, "/data/file", "plaintext")
+		if entries, _ := mem.ReadDir("/data"); len(entries) != 1 {
+			t.Errorf("/data holds %d entries", len(entries))
+		}
+	})
+
+	t.Run("not a file", func(t *testing.T) {
+		mem := useMemFileSystem(t)
+		mem.MkdirAll("/data", 0755)
+		if err := ShredReplaced("/data", 1, func() error { return nil }); err == nil {
+			t.Error("directory accepted")
+		}
+		if err := ShredReplaced(StdioPath, 1, func() error { return nil }); err == nil {
+			t.Error("standard input accepted")
+		}
+	})
+}
+
+func TestShredInSandbox(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "secret"), []byte("top secret"), 0600)
+	os.WriteFile(filepath.Join(root, "replaced"), []byte("plaintext"), 0600)
+	sandbox, err := NewSandboxFileSystem(root, OSFileSystem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedChecked := fsys, shredChecked
+	fsys, shredChecked = sandbox, make(map[string]bool)
+	t.Cleanup(func() { fsys, shredChecked = saved, savedChecked })
+
+	// Virtual paths are shredded, and their file system inspected, on the host.
+	if err := ShredPath("/secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && len(shredChecked) == 0 {
+		t.Error("file system of a sandboxed file not inspected")
+	}
+	err = ShredReplaced("/replaced", 1, func() error {
+		return writeFileAtomic("/replaced", 0600, func(w io.Writer) error {
+			_, err := io.WriteString(w, "ciphertext")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || entries[0].Name() != "replaced" {
+		t.Errorf("host directory holds %v", entries)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "replaced")); string(data) != "ciphertext" {
+		t.Errorf("replaced = %q", data)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefixes of the text encodings of ed25519 keys.
+const (
+	ed25519PublicPrefix = "gofiler-ed25519-public:"
+	ed25519SecretPrefix = "gofiler-ed25519-secret:"
+)
+
+// Key types accepted by -keyType.
+const (
+	KeyTypeX25519  = "x25519"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// SignatureSuffix is appended to a file name to name its detached signature.
+const SignatureSuffix = ".sig"
+
+// signatureVersion is the current version of the detached signature format.
+const signatureVersion = 1
+
+// Context strings signed together with the data, so a signature over a file
+// can never be mistaken for a signature over a backup manifest or vice versa.
+const (
+	fileSignatureContext     = "gofiler file signature v1\x00"
+	manifestSignatureContext = "gofiler backup manifest v1\x00"
+)
+
+// TrustedSignersFile lists, in the GoFiler home, the ed25519 public keys
+// trusted when -require-signature is used without -signer.
+const TrustedSignersFile = "trusted-signers"
+
+// ErrBadSignature is returned when a signature does not verify.
+var ErrBadSignature = errors.New("signature verification failed")
+
+// ErrNoTrustedSigners is returned when signatures are required but no key is
+// trusted to make them. Checking a signature only against the key recorded
+// next to it would accept an altered entry signed with a fresh key.
+var ErrNoTrustedSigners = errors.New("signatures are required but no signer is trusted: use -signer or list keys in " + TrustedSignersFile + " in the GoFiler home")
+
+// Signature is a detached signature over the SHA-256 digest of a file.
+type Signature struct {
+	Version   int       `json:"version"`
+	Algorithm string    `json:"algorithm"`
+	PublicKey []byte    `json:"public_key"`
+	SHA256    string    `json:"sha256"`
+	SignedAt  time.Time `json:"signed_at"`
+	Signature []byte    `json:"signature"`
+}
+
+// GenerateSigningKeyPair creates an ed25519 key pair and writes it to name.key and name.pub.
+func GenerateSigningKeyPair(name string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if err := writeKeyFile(name+".key", ed25519SecretPrefix, private.Seed(), 0600); err != nil {
+		return err
+	}
+	if err := writeKeyFile(name+".pub", ed25519PublicPrefix, public, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Signing key pair written to %s.key and %s.pub\n", name, name)
+	fmt.Printf("Public key: %s\n", EncodeSigningKey(public))
+	return nil
+}
+
+// EncodeSigningKey returns the text encoding of an ed25519 public key.
+func EncodeSigningKey(key ed25519.PublicKey) string {
+	return encodeKey(ed25519PublicPrefix, key)
+}
+
+// LoadSigningKey reads an ed25519 private key written by GenerateSigningKeyPair.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	seed, err := decodeKey(string(data), ed25519SecretPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid ed25519 key size %d", path, len(seed))
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LoadVerifyingKey reads an ed25519 public key given either as text or as
+// the path of a .pub file.
+func LoadVerifyingKey(key string) (ed25519.PublicKey, error) {
+	raw, err := decodeKey(key, ed25519PublicPrefix)
+	if err != nil {
+		data, readErr := fsys.ReadFile(key)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", readErr)
+		}
+		if raw, err = decodeKey(string(data), ed25519PublicPrefix); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key size %d", len(raw))
+	}
+
+	return ed25519.PublicKey(raw), nil
+}
+
+// hashFile returns the SHA-256 digest of the file at path.
+func hashFile(path string) ([]byte, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// SignFile writes a detached signature of the file at path to sigPath, or to
+// path+SignatureSuffix when sigPath is empty.
+func SignFile(path, sigPath string, key ed25519.PrivateKey) error {
+	if sigPath == "" {
+		sigPath = path + SignatureSuffix
+	}
+
+	digest, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	sig := Signature{
+		Version:   signatureVersion,
+		Algorithm: KeyTypeEd25519,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		SHA256:    fmt.Sprintf("%x", digest),
+		SignedAt:  time.Now().UTC(),
+		Signature: ed25519.Sign(key, append([]byte(fileSignatureContext), digest...)),
+	}
+	if err := writeJSONFile(sigPath, sig); err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+
+	fmt.Printf("Signature of %s written to %s\n", path, sigPath)
+	return nil
+}
+
+// VerifyFileSignature checks the detached signature of the file at path. The
+// signature is read from sigPath, or from path+SignatureSuffix when sigPath is
+// empty. When signers are given the signature must have been made by one of them.
+func VerifyFileSignature(path, sigPath string, signers []ed25519.PublicKey) error {
+	if sigPath == "" {
+		sigPath = path + SignatureSuffix
+	}
+
+	data, err := fsys.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	var sig Signature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return fmt.Errorf("failed to parse signature: %w", err)
+	}
+	if sig.Version != signatureVersion || sig.Algorithm != KeyTypeEd25519 || len(sig.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("unsupported signature version %d or algorithm %q", sig.Version, sig.Algorithm)
+	}
+	if len(signers) > 0 && !isTrustedKey(sig.PublicKey, signers) {
+		return fmt.Errorf("%s: %w: signed by untrusted key %s", path, ErrBadSignature, EncodeSigningKey(sig.PublicKey))
+	}
+
+	digest, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(sig.PublicKey, append([]byte(fileSignatureContext), digest...), sig.Signature) {
+		return fmt.Errorf("%s: %w", path, ErrBadSignature)
+	}
+
+	fmt.Printf("Good signature on %s from %s, made %s\n", path, EncodeSigningKey(sig.PublicKey), sig.SignedAt.Format(time.RFC3339))
+	if len(signers) == 0 {
+		fmt.Println("The signing key was not checked against an expected key; use -signer to do so.")
+	}
+	return nil
+}
+
+// BackupSignature is an ed25519 signature over the manifest of a backup.
+type BackupSignature struct {
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// backupManifest is the part of a catalog entry covered by its signature.
+// The object name is left out, since importing a backup may store its
+// content under another name; the content itself is covered by SHA256.
+type backupManifest struct {
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// manifestMessage returns the bytes signed for a backup entry.
+func (e BackupEntry) manifestMessage() []byte {
+	data, _ := json.Marshal(backupManifest{
+		ID:        e.ID,
+		Source:    e.Source,
+		Size:      e.Size,
+		SHA256:    e.SHA256,
+		CreatedAt: e.CreatedAt.UTC(),
+	})
+
+	return append([]byte(manifestSignatureContext), data...)
+}
+
+// signManifest signs the manifest of the entry with key.
+func (e *BackupEntry) signManifest(key ed25519.PrivateKey) {
+	e.Signature = &BackupSignature{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, e.manifestMessage()),
+	}
+}
+
+// verifyManifest checks the signature of the entry's manifest. With trusted
+// keys given, the signature must also have been made by one of them.
+func (e BackupEntry) verifyManifest(trusted []ed25519.PublicKey) error {
+	if e.Signature == nil {
+		return fmt.Errorf("backup %s is not signed", e.ID)
+	}
+	if len(e.Signature.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(e.Signature.PublicKey, e.manifestMessage(), e.Signature.Signature) {
+		return fmt.Errorf("backup %s: %w: the catalog entry was altered", e.ID, ErrBadSignature)
+	}
+	if len(trusted) > 0 && !isTrustedKey(e.Signature.PublicKey, trusted) {
+		return fmt.Errorf("backup %s: %w: signed by untrusted key %s", e.ID, ErrBadSignature, EncodeSigningKey(e.Signature.PublicKey))
+	}
+
+	return nil
+}
+
+// isTrustedKey reports whether key is one of trusted.
+func isTrustedKey(key []byte, trusted []ed25519.PublicKey) bool {
+	for _, t := range trusted {
+		if bytes.Equal(key, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadTrustedSigners reads the public keys listed in TrustedSignersFile, one
+// per line, skipping blank lines and lines starting with #. A missing file
+// trusts no key.
+func LoadTrustedSigners() ([]ed25519.PublicKey, error) {
+	home, err := GoFilerHome()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fsys.ReadFile(filepath.Join(home, TrustedSignersFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted signers: %w", err)
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+
+	return LoadVerifyingKeys(keys)
+}
+
+// LoadVerifyingKeys reads several ed25519 public keys with LoadVerifyingKey.
+func LoadVerifyingKeys(keys []string) ([]ed25519.PublicKey, error) {
+	var loaded []ed25519.PublicKey
+	for _, key := range keys {
+		public, err := LoadVerifyingKey(key)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, public)
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newSigningKey generates an ed25519 key pair.
+func newSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return public, private
+}
+
+func TestSignAndVerifyFile(t *testing.T) {
+	mem := useMemFileSystem(t)
+	mem.MkdirAll("/keys", 0755)
+	mem.WriteFile("/report", []byte("quarterly report"), 0644)
+
+	if err := GenerateSigningKeyPair("/keys/alice"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSigningKey("/keys/alice.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := LoadVerifyingKey("/keys/alice.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, _ := newSigningKey(t)
+
+	if err := SignFile("/report", "", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFileSignature("/report", "", []ed25519.PublicKey{alice}); err != nil {
+		t.Errorf("good signature rejected: %v", err)
+	}
+	if err := VerifyFileSignature("/report", "", []ed25519.PublicKey{mallory}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("untrusted signer: error = %v", err)
+	}
+
+	mem.WriteFile("/report", []byte("quarterly report, altered"), 0644)
+	if err := VerifyFileSignature("/report", "", nil); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("altered file: error = %v", err)
+	}
+}
+
+// signedBackup backs up /file signed with key and returns the catalog.
+func signedBackup(t *testing.T, mem *MemFileSystem, key ed25519.PrivateKey) *BackupCatalog {
+	t.Helper()
+
+	mem.WriteFile("/file", []byte("backed up"), 0644)
+	if err := BackupFile("/file", BackupOptions{SigningKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	mem.WriteFile("/file", []byte("changed"), 0644)
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return catalog
+}
+
+func TestRestoreVerifiesSignatures(t *testing.T) {
+	alice, aliceKey := newSigningKey(t)
+	_, malloryKey := newSigningKey(t)
+	trusted := []ed25519.PublicKey{alice}
+
+	tests := []struct {
+		name    string
+		key     ed25519.PrivateKey
+		tamper  func(entry *BackupEntry)
+		opts    RestoreOptions
+		wantErr string // part of the expected error, empty for success
+	}{
+		{name: "signed by trusted key", key: aliceKey, opts: RestoreOptions{RequireSignature: true, TrustedKeys: trusted}},
+		{name: "signed without requirement", key: aliceKey},
+		{name: "unsigned without requirement"},
+		{
+			name:    "unsigned",
+			opts:    RestoreOptions{RequireSignature: true, TrustedKeys: trusted},
+			wantErr: "is not signed",
+		},
+		{
+			name:    "required without trusted keys",
+			key:     aliceKey,
+			opts:    RestoreOptions{RequireSignature: true},
+			wantErr: ErrNoTrustedSigners.Error(),
+		},
+		{
+			name:    "signed by untrusted key",
+			key:     malloryKey,
+			opts:    RestoreOptions{TrustedKeys: trusted},
+			wantErr: ErrBadSignature.Error(),
+		},
+		{
+			name:    "altered entry",
+			key:     aliceKey,
+			tamper:  func(entry *BackupEntry) { entry.Size++ },
+			wantErr: ErrBadSignature.Error(),
+		},
+		{
+			name: "altered entry signed again",
+			key:  aliceKey,
+			tamper: func(entry *BackupEntry) {
+				entry.Size++
+				entry.signManifest(malloryKey)
+			},
+			opts:    RestoreOptions{RequireSignature: true, TrustedKeys: trusted},
+			wantErr: ErrBadSignature.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := useMemFileSystem(t)
+			catalog := signedBackup(t, mem, tt.key)
+			if tt.tamper != nil {
+				tt.tamper(&catalog.Backups[0])
+				if err := catalog.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := RestoreBackup("/file", tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertUnchanged(t, mem, "/file", "backed up")
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			assertUnchanged(t, mem, "/file", "changed")
+		})
+	}
+}
+
+func TestLoadTrustedSigners(t *testing.T) {
+	mem := useMemFileSystem(t)
+	t.Setenv(HomeEnv, "/home")
+
+	if keys, err := LoadTrustedSigners(); err != nil || len(keys) != 0 {
+		t.Fatalf("without a file: %v, %v", keys, err)
+	}
+
+	alice, _ := newSigningKey(t)
+	bob, _ := newSigningKey(t)
+	mem.MkdirAll("/home", 0700)
+	mem.WriteFile("/home/"+TrustedSignersFile, []byte("# release keys\n"+EncodeSigningKey(alice)+"\n\n  "+EncodeSigningKey(bob)+"\n"), 0644)
+
+	keys, err := LoadTrustedSigners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !alice.Equal(keys[0]) || !bob.Equal(keys[1]) {
+		t.Errorf("loaded %d keys", len(keys))
+	}
+
+	mem.WriteFile("/home/"+TrustedSignersFile, []byte("not a key\n"), 0644)
+	if _, err := LoadTrustedSigners(); err == nil {
+		t.Error("invalid key accepted")
+	}
+}
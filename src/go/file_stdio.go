@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bufio"
+	"os"
+)
+
+// StdioPath stands for standard input or standard output in place of a file path.
+const StdioPath = "-"
+
+// stdin buffers standard input so the start of it can be examined before it is read.
+var stdin *bufio.Reader
+
+// stdinReader returns the buffered standard input. The buffer is large
+// enough to peek at a complete container header.
+func stdinReader() *bufio.Reader {
+	if stdin == nil {
+		stdin = bufio.NewReaderSize(os.Stdin, len(containerMagic)+1+4+maxHeaderSize)
+	}
+
+	return stdin
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamChunkSize is the amount of plaintext sealed in every chunk of an encrypted stream.
+const streamChunkSize = 64 * 1024
+
+// streamNoncePrefixSize is the size of the random nonce prefix stored in the
+// header. The rest of each 12-byte nonce is a 4-byte chunk counter and a
+// 1-byte flag marking the final chunk.
+const streamNoncePrefixSize = 7
+
+// maxStreamChunkSize bounds the chunk size accepted when reading a container.
+const maxStreamChunkSize = 16 * 1024 * 1024
+
+// streamNonce builds the nonce of the chunk with the given index.
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+
+	return append(nonce, 0)
+}
+
+// streamWriter encrypts everything written to it as a sequence of AEAD
+// chunks. Every chunk except the last holds exactly chunkSize bytes of
+// plaintext; the last one is sealed with the final flag set in its nonce, so
+// a reader can tell a complete stream from a truncated one. Close must be
+// called to write the final chunk.
+type streamWriter struct {
+	aead      cipher.AEAD
+	w         io.Writer
+	ad        []byte
+	prefix    []byte
+	counter   uint32
+	chunkSize int
+	buf       []byte
+	out       []byte
+	closed    bool
+}
+
+// newStreamWriter returns a writer that encrypts into w. Every chunk is
+// authenticated together with ad.
+func newStreamWriter(w io.Writer, aead cipher.AEAD, prefix, ad []byte, chunkSize int) *streamWriter {
+	return &streamWriter{
+		aead:      aead,
+		w:         w,
+		ad:        ad,
+		prefix:    prefix,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+		out:       make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+}
+
+// Write buffers p and seals every full chunk once more data follows it.
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed encrypted stream")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(s.buf) == s.chunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):s.chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+		n += k
+	}
+
+	return n, nil
+}
+
+// Close seals the buffered plaintext as the final chunk.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	return s.flush(true)
+}
+
+// flush seals the buffered plaintext as the next chunk.
+func (s *streamWriter) flush(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("encrypted stream is too long")
+	}
+
+	s.out = s.aead.Seal(s.out[:0], streamNonce(s.prefix, s.counter, last), s.buf, s.ad)
+	if _, err := s.w.Write(s.out); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+
+	s.counter++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// streamReader decrypts a stream written by streamWriter. It returns
+// ErrWrongPassphrase if the first chunk cannot be authenticated and an error
+// if any later chunk is damaged, missing or followed by extra data.
+type streamReader struct {
+	aead      cipher.AEAD
+	r         io.Reader
+	ad        []byte
+	prefix    []byte
+	counter   uint32
+	chunkSize int
+	in        []byte
+	pending   int
+	plain     []byte
+	buf       []byte
+	done      bool
+}
+
+// newStreamReader returns a reader that decrypts r.
+func newStreamReader(r io.Reader, aead cipher.AEAD, prefix, ad []byte, chunkSize int) *streamReader {
+	return &streamReader{
+		aead:      aead,
+		r:         r,
+		ad:        ad,
+		prefix:    prefix,
+		chunkSize: chunkSize,
+		in:        make([]byte, chunkSize+aead.Overhead()+1),
+		buf:       make([]byte, 0, chunkSize),
+	}
+}
+
+// Read returns decrypted plaintext.
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk. One byte past a full chunk is read
+// ahead to learn whether the chunk is the last one.
+func (s *streamReader) next() error {
+	full := s.chunkSize + s.aead.Overhead()
+
+	n, err := io.ReadFull(s.r, s.in[s.pending:])
+	n += s.pending
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+
+	last := n <= full
+	size := n
+	if !last {
+		size = full
+	}
+
+	plain, err := s.aead.Open(s.buf[:0], streamNonce(s.prefix, s.counter, last), s.in[:size], s.ad)
+	if err != nil {
+		if s.counter == 0 {
+			return ErrWrongPassphrase
+		}
+		return fmt.Errorf("encrypted data is corrupted or truncated at chunk %d", s.counter)
+	}
+
+	if last {
+		s.done = true
+	} else {
+		s.in[0] = s.in[full]
+		s.pending = 1
+	}
+	s.counter++
+	s.plain = plain
+	return nil
+}
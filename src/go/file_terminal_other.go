@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openTerminal fails on systems without a known terminal device.
+func openTerminal() (*os.File, error) {
+	return nil, errors.New("no terminal device")
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// openTerminal opens the console input of the process.
+func openTerminal() (*os.File, error) {
+	return os.OpenFile("CONIN$", os.O_RDWR, 0)
+}
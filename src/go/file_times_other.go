@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the last access time recorded in info. Where it is not
+// available the modification time is used instead.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
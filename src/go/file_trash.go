@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The trash follows the FreeDesktop.org Trash specification, so items
+// deleted by GoFiler show up in the trash of desktop file managers and the
+// other way around. Deleted items live in the files directory of the trash
+// and each has a .trashinfo file in its info directory recording where it
+// came from and when it was deleted.
+const (
+	trashInfoSuffix = ".trashinfo"
+	trashInfoHeader = "[Trash Info]"
+	trashDateFormat = "2006-01-02T15:04:05"
+)
+
+// TrashEntry is an item in the trash.
+type TrashEntry struct {
+	Name      string    // name in the trash
+	Path      string    // absolute path the item was deleted from
+	DeletedAt time.Time // local time of the deletion
+}
+
+// TrashDir returns the home trash: $XDG_DATA_HOME/Trash, which defaults to
+// ~/.local/share/Trash.
+func TrashDir() (string, error) {
+	if data := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(data) {
+		return filepath.Join(data, "Trash"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+
+	return filepath.Join(home, ".local", "share", "Trash"), nil
+}
+
+// openTrash returns the home trash, creating its directories if needed.
+func openTrash() (string, error) {
+	trash, err := TrashDir()
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range []string{"files", "info"} {
+		if err := fsys.MkdirAll(filepath.Join(trash, dir), 0700); err != nil {
+			return "", fmt.Errorf("failed to create trash: %w", err)
+		}
+	}
+
+	return trash, nil
+}
+
+// MoveToTrash moves the file or directory at path into the trash. Items on
+// another file system than the trash are copied into it and then deleted.
+func MoveToTrash(path string) (TrashEntry, error) {
+	abs, err := fsys.Abs(path)
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+	if _, err := fsys.Lstat(abs); err != nil {
+		return TrashEntry{}, fmt.Errorf("failed to move to the trash: %w", err)
+	}
+
+	trash, err := openTrash()
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if within, err := isWithin(abs, trash); err != nil || within {
+		return TrashEntry{}, fmt.Errorf("refusing to move %s to the trash, which it contains", path)
+	}
+
+	entry, err := reserveTrashName(trash, abs, time.Now())
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if err := movePath(abs, filepath.Join(trash, "files", entry.Name)); err != nil {
+		fsys.Remove(trashInfoPath(trash, entry.Name))
+		return TrashEntry{}, fmt.Errorf("failed to move to the trash: %w", err)
+	}
+
+	fmt.Printf("Moved %s to the trash as %s\n", path, entry.Name)
+	return entry, nil
+}
+
+// reserveTrashName picks a name in the trash for the item at path and
+// claims it by creating its info file, which fails if another process got
+// there first. Taken names get a numeric suffix.
+func reserveTrashName(trash, path string, deletedAt time.Time) (TrashEntry, error) {
+	entry := TrashEntry{Path: path, DeletedAt: deletedAt}
+	info := entry.encodeInfo()
+	base := filepath.Base(path)
+
+	for n := 1; ; n++ {
+		entry.Name = base
+		if n > 1 {
+			entry.Name = base + "." + strconv.Itoa(n)
+		}
+		if _, err := fsys.Lstat(filepath.Join(trash, "files", entry.Name)); err == nil {
+			continue
+		}
+
+		file, err := fsys.OpenFile(trashInfoPath(trash, entry.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return TrashEntry{}, fmt.Errorf("failed to create trash info: %w", err)
+		}
+		_, err = file.Write(info)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fsys.Remove(file.Name())
+			return TrashEntry{}, fmt.Errorf("failed to write trash info: %w", err)
+		}
+
+		return entry, nil
+	}
+}
+
+// trashInfoPath returns the info file of the named trash item.
+func trashInfoPath(trash, name string) string {
+	return filepath.Join(trash, "info", name+trashInfoSuffix)
+}
+
+// encodeInfo returns the .trashinfo content for the entry. The path is
+// escaped like a URL path, as the specification requires.
+func (e TrashEntry) encodeInfo() []byte {
+	path := (&url.URL{Path: filepath.ToSlash(e.Path)}).EscapedPath()
+
+	return []byte(fmt.Sprintf("%s\nPath=%s\nDeletionDate=%s\n", trashInfoHeader, path, e.DeletedAt.Format(trashDateFormat)))
+}
+
+// parseTrashInfo parses the .trashinfo file of the named trash item.
+func parseTrashInfo(name string, data []byte) (TrashEntry, error) {
+	entry := TrashEntry{Name: name}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != trashInfoHeader {
+		return entry, fmt.Errorf("trash info of %s has no %s header", name, trashInfoHeader)
+	}
+
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			path, err := url.PathUnescape(value)
+			if err != nil {
+				return entry, fmt.Errorf("trash info of %s has an invalid path: %w", name, err)
+			}
+			entry.Path = filepath.FromSlash(path)
+		case "DeletionDate":
+			// A missing or invalid date leaves the zero time, which sorts first.
+			entry.DeletedAt, _ = time.ParseInLocation(trashDateFormat, value, time.Local)
+		}
+	}
+	if entry.Path == "" {
+		return entry, fmt.Errorf("trash info of %s has no path", name)
+	}
+
+	return entry, nil
+}
+
+// trashEntries returns the items in the trash, oldest first. Info files
+// that cannot be parsed are skipped with a warning.
+func trashEntries(trash string) ([]TrashEntry, error) {
+	infos, err := fsys.ReadDir(filepath.Join(trash, "info"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trash: %w", err)
+	}
+
+	var entries []TrashEntry
+	for _, info := range infos {
+		name, ok := strings.CutSuffix(info.Name(), trashInfoSuffix)
+		if !ok || info.IsDir() {
+			continue
+		}
+		data, err := fsys.ReadFile(filepath.Join(trash, "info", info.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trash info: %w", err)
+		}
+		entry, err := parseTrashInfo(name, data)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	// Deletion dates only have seconds; within a second, the numeric
+	// suffixes of reused names tell the order.
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.DeletedAt.Equal(b.DeletedAt) {
+			return a.DeletedAt.Before(b.DeletedAt)
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		return a.Name < b.Name
+	})
+
+	return entries, nil
+}
+
+// ListTrash prints the items in the trash, oldest first.
+func ListTrash() error {
+	trash, err := TrashDir()
+	if err != nil {
+		return err
+	}
+	entries, err := trashEntries(trash)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("The trash is empty.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDELETED\tSIZE\tPATH")
+	for _, entry := range entries {
+		size := "-"
+		if info, err := fsys.Lstat(filepath.Join(trash, "files", entry.Name)); err == nil && !info.IsDir() {
+			size = strconv.FormatInt(info.Size(), 10)
+		} else if err == nil {
+			size = "dir"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Name, entry.DeletedAt.Format(trashDateFormat), size, entry.Path)
+	}
+
+	return w.Flush()
+}
+
+// RestoreFromTrash moves an item out of the trash back to where it was
+// deleted from. item is either the name of the item in the trash or its
+// original path, in which case the most recently deleted item from that
+// path is restored. An existing file at the original path is never replaced.
+// The restored item is returned.
+func RestoreFromTrash(item string) (TrashEntry, error) {
+	trash, err := TrashDir()
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	entries, err := trashEntries(trash)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	abs, err := fsys.Abs(item)
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("failed to resolve the file path: %w", err)
+	}
+
+	var found *TrashEntry
+	for i := range entries {
+		if entries[i].Name == item || entries[i].Path == abs {
+			found = &entries[i]
+		}
+	}
+	if found == nil {
+		return TrashEntry{}, fmt.Errorf("%s is not in the trash", item)
+	}
+
+	if err := restoreTrashEntry(trash, *found); err != nil {
+		return TrashEntry{}, err
+	}
+
+	fmt.Printf("Restored %s from the trash to %s\n", found.Name, found.Path)
+	return *found, nil
+}
+
+// restoreTrashEntry moves a trash item back to its original path,
+// recreating missing parent directories.
+func restoreTrashEntry(trash string, entry TrashEntry) error {
+	if _, err := fsys.Lstat(entry.Path); err == nil {
+		return fmt.Errorf("cannot restore %s: %s already exists", entry.Name, entry.Path)
+	}
+	if err := fsys.MkdirAll(filepath.Dir(entry.Path), 0755); err != nil {
+		return fmt.Errorf("failed to recreate the parent directory: %w", err)
+	}
+	if err := movePath(filepath.Join(trash, "files", entry.Name), entry.Path); err != nil {
+		return fmt.Errorf("failed to restore from the trash: %w", err)
+	}
+	if err := fsys.Remove(trashInfoPath(trash, entry.Name)); err != nil {
+		return fmt.Errorf("failed to remove trash info: %w", err)
+	}
+
+	return nil
+}
+
+// EmptyTrash permanently deletes the items in the trash deleted before
+// olderThan, or every item if olderThan is zero.
+func EmptyTrash(olderThan time.Time) error {
+	trash, err := TrashDir()
+	if err != nil {
+		return err
+	}
+	entries, err := trashEntries(trash)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !olderThan.IsZero() && !entry.DeletedAt.Before(olderThan) {
+			continue
+		}
+		// The item goes first, so a failure never leaves an item without its info.
+		if err := fsys.RemoveAll(filepath.Join(trash, "files", entry.Name)); err != nil {
+			return fmt.Errorf("failed to delete %s from the trash: %w", entry.Name, err)
+		}
+		if err := fsys.Remove(trashInfoPath(trash, entry.Name)); err != nil {
+			return fmt.Errorf("failed to remove trash info: %w", err)
+		}
+		removed++
+	}
+
+	fmt.Printf("Deleted %d items from the trash\n", removed)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// useTrash points the trash at /Trash of a new in-memory file system.
+func useTrash(t *testing.T) *MemFileSystem {
+	t.Helper()
+
+	t.Setenv("XDG_DATA_HOME", "/")
+	return useMemFileSystem(t)
+}
+
+func TestTrashInfoRoundTrip(t *testing.T) {
+	deleted := time.Date(2024, 2, 3, 4, 5, 6, 0, time.Local)
+	entry := TrashEntry{Name: "a b%.txt", Path: "/home/me/a b%.txt", DeletedAt: deleted}
+
+	info := string(entry.encodeInfo())
+	want := "[Trash Info]\nPath=/home/me/a%20b%25.txt\nDeletionDate=2024-02-03T04:05:06\n"
+	if info != want {
+		t.Fatalf("info = %q, want %q", info, want)
+	}
+
+	parsed, err := parseTrashInfo(entry.Name, []byte(info))
+	if err != nil || parsed != entry {
+		t.Errorf("parsed %+v, %v; want %+v", parsed, err, entry)
+	}
+	if _, err := parseTrashInfo("x", []byte("Path=/x\n")); err == nil {
+		t.Error("parsed info without a header")
+	}
+}
+
+func TestTrashMoveAndRestore(t *testing.T) {
+	mem := useTrash(t)
+	mem.MkdirAll("/work/dir", 0755)
+	mem.WriteFile("/work/dir/inner", []byte("inner"), 0644)
+
+	for _, content := range []string{"first", "second"} {
+		mem.WriteFile("/work/notes", []byte(content), 0644)
+		if _, err := MoveToTrash("/work/notes"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteDirectory("/work/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/work/notes"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("deleted file still exists: %v", err)
+	}
+
+	entries, err := trashEntries("/Trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("trash holds %+v", entries)
+	}
+
+	// The most recently deleted file comes back first, and never over another.
+	if _, err := RestoreFromTrash("/work/notes"); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/notes", "second")
+	if _, err := RestoreFromTrash("notes"); err == nil {
+		t.Error("restore replaced an existing file")
+	}
+
+	if _, err := RestoreFromTrash("dir"); err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, mem, "/work/dir/inner", "inner")
+
+	if _, err := MoveToTrash("/"); err == nil {
+		t.Error("moved the trash into itself")
+	}
+}
+
+func TestEmptyTrashOlderThan(t *testing.T) {
+	mem := useTrash(t)
+	for _, name := range []string{"/old", "/new"} {
+		mem.WriteFile(name, []byte(name), 0644)
+		if _, err := MoveToTrash(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := TrashEntry{Path: "/old", DeletedAt: time.Now().AddDate(0, 0, -40)}
+	mem.WriteFile(trashInfoPath("/Trash", "old"), old.encodeInfo(), 0600)
+
+	cutoff, err := parseSince("30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EmptyTrash(cutoff); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := trashEntries("/Trash")
+	if len(entries) != 1 || entries[0].Name != "new" {
+		t.Fatalf("trash holds %+v", entries)
+	}
+	if _, err := mem.Stat("/Trash/files/old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("emptied item still exists: %v", err)
+	}
+
+	if err := EmptyTrash(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := trashEntries("/Trash"); len(entries) != 0 {
+		t.Errorf("trash not empty: %+v", entries)
+	}
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// VaultConfigFile is the unencrypted configuration stored at the root of a vault.
+const VaultConfigFile = "gofiler-vault.json"
+
+// vaultVersion is the current version of the vault format.
+const vaultVersion = 1
+
+// vaultKeySize is the size of the random vault key from which the name and
+// content keys are derived.
+const vaultKeySize = 32
+
+// vaultSIVSize is the size of the synthetic IV prefixed to every encrypted name.
+const vaultSIVSize = 16
+
+// maxVaultNameSize bounds plaintext names so their encrypted form fits in the
+// 255-byte name limit of common file systems.
+const maxVaultNameSize = 170
+
+// VaultSessionDir is the directory inside the GoFiler home holding the keys of unlocked vaults.
+const VaultSessionDir = "vault-sessions"
+
+// VaultSessionEnv holds the session token that the keys of unlocked vaults
+// are sealed with. Without it the files in VaultSessionDir are useless.
+const VaultSessionEnv = "GOFILER_VAULT_SESSION"
+
+// vaultSessionContext is authenticated together with a sealed session key.
+const vaultSessionContext = "gofiler vault session v1\x00"
+
+// Names at the root of a vault used while a rename is in progress: the
+// record of the rename, and the name a renamed file or directory has while
+// it is rebound to its new path. Neither can be an encrypted name.
+const (
+	vaultRenameFile  = "gofiler-vault-rename"
+	vaultStagingName = "gofiler-vault-staging"
+)
+
+// DefaultVaultTTL is how long a vault stays unlocked.
+const DefaultVaultTTL = 15 * time.Minute
+
+// vaultVerifier is sealed with the passphrase key to detect a wrong passphrase.
+const vaultVerifier = "gofiler vault v1"
+
+// ErrVaultLocked is returned when a vault is neither unlocked nor given a passphrase.
+var ErrVaultLocked = errors.New("vault is locked")
+
+// VaultConfig describes a vault. The vault key is stored wrapped with a key
+// derived from the passphrase.
+type VaultConfig struct {
+	Version    int       `json:"version"`
+	ID         string    `json:"id"`
+	KDF        KDFParams `json:"kdf"`
+	Nonce      []byte    `json:"nonce"`
+	WrappedKey []byte    `json:"wrapped_key"`
+}
+
+// vaultSession is the key of an unlocked vault, sealed with the session
+// token. The expiry time is authenticated with it, so a session cannot be
+// extended by editing the file.
+type vaultSession struct {
+	ID        string    `json:"id"`
+	Expires   time.Time `json:"expires"`
+	Nonce     []byte    `json:"nonce"`
+	SealedKey []byte    `json:"sealed_key"`
+}
+
+// additionalData returns the data authenticated with the sealed key.
+func (s *vaultSession) additionalData() []byte {
+	return []byte(vaultSessionContext + s.ID + "\x00" + s.Expires.UTC().Format(time.RFC3339Nano))
+}
+
+// vaultRename is the record of a rename in progress, kept sealed at the root
+// of the vault so it does not reveal the names.
+type vaultRename struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Vault is an unlocked vault directory. File names are encrypted
+// deterministically with an SIV construction: the IV of a name is an HMAC of
+// the name and its plaintext parent path, and the name is encrypted with
+// AES-CTR under that IV. Equal names in the same directory therefore encrypt
+// equally, so a file can be found by name, while nothing about names leaks
+// across directories. Contents are GoFiler containers whose data keys are
+// wrapped under a key derived from the vault's content key and the plaintext
+// path of the file, so a file moved or swapped on disk fails to decrypt.
+type Vault struct {
+	Root       string
+	ID         string
+	encKey     []byte
+	macKey     []byte
+	contentKey []byte
+	renameKey  []byte
+}
+
+// InitVault creates an empty vault in dir, protected by passphrase.
+func InitVault(dir string, passphrase []byte) error {
+	if err := fsys.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create vault directory: %w", err)
+	}
+	configPath := filepath.Join(dir, VaultConfigFile)
+	if _, err := fsys.Stat(configPath); err == nil {
+		return fmt.Errorf("%s is already a vault", dir)
+	}
+
+	key := make([]byte, vaultKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return fmt.Errorf("failed to create vault key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return fmt.Errorf("failed to create vault ID: %w", err)
+	}
+
+	config := &VaultConfig{Version: vaultVersion, ID: hex.EncodeToString(id)}
+	if err := config.wrapVaultKey(key, passphrase); err != nil {
+		return err
+	}
+	if err := writeJSONFile(configPath, config); err != nil {
+		return fmt.Errorf("failed to write vault configuration: %w", err)
+	}
+
+	fmt.Printf("Vault %s created in %s\n", config.ID, dir)
+	return nil
+}
+
+// loadVaultConfig reads the configuration of the vault in dir.
+func loadVaultConfig(dir string) (*VaultConfig, error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, VaultConfigFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not a vault; create one with -vault-init", dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault configuration: %w", err)
+	}
+
+	config := &VaultConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse vault configuration: %w", err)
+	}
+	if config.Version != vaultVersion {
+		return nil, fmt.Errorf("unsupported vault version %d", config.Version)
+	}
+
+	return config, nil
+}
+
+// wrapVaultKey stores the vault key wrapped with a key derived from the passphrase.
+func (c *VaultConfig) wrapVaultKey(key, passphrase []byte) error {
+	kdf, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	kek, err := deriveKey(passphrase, kdf)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	c.KDF = kdf
+	c.Nonce = nonce
+	c.WrappedKey = gcm.Seal(nil, nonce, key, []byte(vaultVerifier))
+	return nil
+}
+
+// ResetVaultPassphrase protects the vault in dir with a new passphrase,
+// given its vault key, e.g. one recovered from key shares.
+func ResetVaultPassphrase(dir string, key, passphrase []byte) error {
+	config, err := loadVaultConfig(dir)
+	if err != nil {
+		return err
+	}
+	if len(key) != vaultKeySize {
+		return fmt.Errorf("invalid vault key size %d", len(key))
+	}
+	if err := config.wrapVaultKey(key, passphrase); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, VaultConfigFile), config); err != nil {
+		return fmt.Errorf("failed to write vault configuration: %w", err)
+	}
+
+	fmt.Printf("Vault %s has a new passphrase\n", dir)
+	return nil
+}
+
+// unwrapVaultKey recovers the vault key with the passphrase.
+func (c *VaultConfig) unwrapVaultKey(passphrase []byte) ([]byte, error) {
+	kek, err := deriveKey(passphrase, c.KDF)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(c.Nonce))
+	}
+
+	key, err := gcm.Open(nil, c.Nonce, c.WrappedKey, []byte(vaultVerifier))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return key, nil
+}
+
+// newVault derives the name, content and rename record keys from the vault key.
+func newVault(dir string, config *VaultConfig, key []byte) (*Vault, error) {
+	derived := make([]byte, 4*32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, []byte(config.ID), []byte("gofiler vault keys")), derived); err != nil {
+		return nil, fmt.Errorf("failed to derive vault keys: %w", err)
+	}
+
+	return &Vault{
+		Root:       dir,
+		ID:         config.ID,
+		encKey:     derived[:32],
+		macKey:     derived[32:64],
+		contentKey: derived[64:96],
+		renameKey:  derived[96:],
+	}, nil
+}
+
+// sessionPath returns the file holding the key of the vault while it is unlocked.
+func sessionPath(dir string) (string, error) {
+	abs, err := fsys.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the vault path: %w", err)
+	}
+	home, err := GoFilerHome()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(home, VaultSessionDir, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// UnlockVault checks the passphrase of the vault in dir and keeps its key in
+// the GoFiler home for ttl, so later commands can use the vault without it.
+func UnlockVault(dir string, passphrase []byte, ttl time.Duration) error {
+	config, err := loadVaultConfig(dir)
+	if err != nil {
+		return err
+	}
+	key, err := config.unwrapVaultKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	path, err := sessionPath(dir)
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+	sweepVaultSessions()
+
+	token, isNew, err := vaultSessionToken()
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(token)
+	if err != nil {
+		return err
+	}
+	session := vaultSession{ID: config.ID, Expires: time.Now().Add(ttl).UTC(), Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := io.ReadFull(rand.Reader, session.Nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+	session.SealedKey = gcm.Seal(nil, session.Nonce, key, session.additionalData())
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode vault session: %w", err)
+	}
+	err = writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save vault session: %w", err)
+	}
+
+	fmt.Printf("Vault %s unlocked for %s\n", dir, ttl)
+	if isNew {
+		fmt.Printf("Set %s=%s in the environment of the commands that use it\n", VaultSessionEnv, base64.RawURLEncoding.EncodeToString(token))
+	}
+	return nil
+}
+
+// vaultSessionToken returns the session token from VaultSessionEnv, or a new
+// one, and reports whether it is new.
+func vaultSessionToken() ([]byte, bool, error) {
+	if token, ok := sessionTokenFromEnv(); ok {
+		return token, false, nil
+	}
+
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return nil, false, fmt.Errorf("failed to create session token: %w", err)
+	}
+
+	return token, true, nil
+}
+
+// sessionTokenFromEnv returns the session token set in VaultSessionEnv.
+func sessionTokenFromEnv() ([]byte, bool) {
+	token, err := base64.RawURLEncoding.DecodeString(os.Getenv(VaultSessionEnv))
+	if err != nil || len(token) != 32 {
+		return nil, false
+	}
+
+	return token, true
+}
+
+// sweepVaultSessions removes the sessions of every vault that have expired,
+// not only of the vault at hand. Errors are ignored: an expired session
+// cannot be opened anyway.
+func sweepVaultSessions() {
+	home, err := GoFilerHome()
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(home, VaultSessionDir)
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		data, err := fsys.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var session vaultSession
+		if json.Unmarshal(data, &session) == nil && time.Now().After(session.Expires) {
+			fsys.Remove(path)
+		}
+	}
+}
+
+// LockVault forgets the key of an unlocked vault.
+func LockVault(dir string) error {
+	path, err := sessionPath(dir)
+	if err != nil {
+		return err
+	}
+	if err := fsys.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to lock vault: %w", err)
+	}
+	sweepVaultSessions()
+
+	fmt.Printf("Vault %s locked\n", dir)
+	return nil
+}
+
+// OpenVault opens the vault in dir with the key of an unlocked session, or
+// else with the passphrase returned by passphrase. A rename interrupted
+// earlier is finished first.
+func OpenVault(dir string, passphrase func() ([]byte, error)) (*Vault, error) {
+	config, key, err := vaultKey(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	vault, err := newVault(dir, config, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := vault.resumeRename(); err != nil {
+		return nil, err
+	}
+
+	return vault, nil
+}
+
+// vaultKey returns the configuration and key of the vault in dir, taking the
+// key from an unlocked session or else unwrapping it with the passphrase.
+func vaultKey(dir string, passphrase func() ([]byte, error)) (*VaultConfig, []byte, error) {
+	config, err := loadVaultConfig(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sweepVaultSessions()
+	if key, ok := loadVaultSession(dir, config.ID); ok {
+		return config, key, nil
+	}
+	if passphrase == nil {
+		return nil, nil, fmt.Errorf("%s: %w; unlock it with -vault-unlock", dir, ErrVaultLocked)
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := config.unwrapVaultKey(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, key, nil
+}
+
+// loadVaultSession returns the key of the vault if it is unlocked and the
+// session token is set. Expired sessions are removed.
+func loadVaultSession(dir, id string) ([]byte, bool) {
+	path, err := sessionPath(dir)
+	if err != nil {
+		return nil, false
+	}
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var session vaultSession
+	if json.Unmarshal(data, &session) != nil || session.ID != id {
+		return nil, false
+	}
+	if time.Now().After(session.Expires) {
+		fsys.Remove(path)
+		return nil, false
+	}
+
+	token, ok := sessionTokenFromEnv()
+	if !ok {
+		return nil, false
+	}
+	gcm, err := newGCM(token)
+	if err != nil || len(session.Nonce) != gcm.NonceSize() {
+		return nil, false
+	}
+	key, err := gcm.Open(nil, session.Nonce, session.SealedKey, session.additionalData())
+	if err != nil {
+		return nil, false
+	}
+
+	return key, true
+}
+
+// encryptName encrypts one name of the plaintext directory parent.
+func (v *Vault) encryptName(parent, name string) (string, error) {
+	if len(name) > maxVaultNameSize {
+		return "", fmt.Errorf("name %q is too long for a vault (at most %d bytes)", name, maxVaultNameSize)
+	}
+
+	mac := hmac.New(sha256.New, v.macKey)
+	mac.Write([]byte(parent))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:vaultSIVSize]
+
+	block, err := aes.NewCipher(v.encKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+	out := make([]byte, vaultSIVSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[vaultSIVSize:], []byte(name))
+
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// decryptName decrypts one encrypted name of the plaintext directory parent
+// and checks its synthetic IV.
+func (v *Vault) decryptName(parent, encrypted string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < vaultSIVSize {
+		return "", fmt.Errorf("invalid encrypted name %q", encrypted)
+	}
+
+	block, err := aes.NewCipher(v.encKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+	iv := data[:vaultSIVSize]
+	name := make([]byte, len(data)-vaultSIVSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, data[vaultSIVSize:])
+
+	mac := hmac.New(sha256.New, v.macKey)
+	mac.Write([]byte(parent))
+	mac.Write([]byte{0})
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:vaultSIVSize], iv) {
+		return "", fmt.Errorf("encrypted name %q does not belong in this directory or was altered", encrypted)
+	}
+
+	return string(name), nil
+}
+
+// cleanVaultPath turns a path inside the vault into its canonical slash-separated form.
+func cleanVaultPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))[1:]
+}
+
+// isVaultMetadata reports whether name, at the root of a vault, is one of
+// the vault's own files rather than an encrypted name.
+func isVaultMetadata(name string) bool {
+	return name == VaultConfigFile || name == vaultRenameFile || name == vaultStagingName
+}
+
+// fileKey returns the key wrapping the data keys of the file at the plaintext
+// path name inside the vault.
+func (v *Vault) fileKey(name string) (*MasterKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, v.contentKey, []byte(cleanVaultPath(name)), []byte("gofiler vault file key")), key); err != nil {
+		return nil, fmt.Errorf("failed to derive file key: %w", err)
+	}
+
+	return &MasterKey{ID: v.ID, Key: key}, nil
+}
+
+// fileKeystore returns a keystore holding only the key of the file at name.
+func (v *Vault) fileKeystore(name string) (*Keystore, error) {
+	key, err := v.fileKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keystore{Version: keystoreVersion, Active: key.ID, Keys: []MasterKey{*key}}, nil
+}
+
+// DiskPath returns the on-disk path of a plaintext path inside the vault.
+func (v *Vault) DiskPath(name string) (string, error) {
+	clean := cleanVaultPath(name)
+	if clean == "" {
+		return v.Root, nil
+	}
+
+	disk := v.Root
+	parent := ""
+	for _, part := range strings.Split(clean, "/") {
+		encrypted, err := v.encryptName(parent, part)
+		if err != nil {
+			return "", err
+		}
+		disk = filepath.Join(disk, encrypted)
+		parent = path.Join(parent, part)
+	}
+
+	return disk, nil
+}
+
+// List prints the decrypted names in a directory of the vault.
+func (v *Vault) List(dir string) error {
+	clean := cleanVaultPath(dir)
+	disk, err := v.DiskPath(clean)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fsys.ReadDir(disk)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if clean == "" && isVaultMetadata(entry.Name()) {
+			continue
+		}
+		name, err := v.decryptName(clean, entry.Name())
+		if err != nil {
+			fmt.Printf("? %s (%v)\n", entry.Name(), err)
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+
+	return nil
+}
+
+// Read returns the decrypted content of a file in the vault.
+func (v *Vault) Read(name string) ([]byte, error) {
+	disk, err := v.DiskPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	keystore, err := v.fileKeystore(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fsys.Open(disk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	if err := DecryptAndDecompressStream(&buf, file, Keys{Keystore: keystore}); err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s, or it was moved there from another path: %w", name, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Write encrypts data into a file of the vault, creating its directories.
+func (v *Vault) Write(name string, data []byte) error {
+	clean := cleanVaultPath(name)
+	if clean == "" {
+		return errors.New("cannot write to the vault root")
+	}
+
+	dirDisk, err := v.DiskPath(path.Dir(clean))
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(dirDisk, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	disk, err := v.DiskPath(clean)
+	if err != nil {
+		return err
+	}
+	keystore, err := v.fileKeystore(clean)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(disk, 0600, func(w io.Writer) error {
+		return CompressAndEncryptStream(w, bytes.NewReader(data), Keys{Keystore: keystore}, CompressionOptions{Auto: true})
+	})
+}
+
+// Delete removes a file or an empty directory from the vault.
+func (v *Vault) Delete(name string) error {
+	disk, err := v.DiskPath(name)
+	if err != nil {
+		return err
+	}
+	if disk == v.Root {
+		return errors.New("cannot delete the vault root")
+	}
+
+	if err := fsys.Remove(disk); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// Rename renames a file or directory of the vault. Since names and file keys
+// are bound to the path, everything below a renamed directory is rebound as
+// well. The rename is recorded first and carried out by finishRename, so an
+// interrupted rename is finished the next time the vault is opened.
+func (v *Vault) Rename(oldName, newName string) error {
+	oldClean := cleanVaultPath(oldName)
+	newClean := cleanVaultPath(newName)
+	if oldClean == "" || newClean == "" {
+		return errors.New("cannot rename the vault root")
+	}
+	if newClean == oldClean || strings.HasPrefix(newClean, oldClean+"/") {
+		return fmt.Errorf("cannot move %s into itself", oldClean)
+	}
+
+	oldDisk, err := v.DiskPath(oldClean)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.Lstat(oldDisk); err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	newDisk, err := v.DiskPath(newClean)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.Lstat(newDisk); err == nil {
+		return fmt.Errorf("%s already exists in the vault", newClean)
+	}
+
+	newDir, err := v.DiskPath(path.Dir(newClean))
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(newDir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	rename := vaultRename{Old: oldClean, New: newClean}
+	if err := v.saveRename(rename); err != nil {
+		return err
+	}
+
+	return v.finishRename(rename)
+}
+
+// finishRename carries out a recorded rename. The file or directory is
+// moved to the staging name, rebound to its new path there, where neither
+// path shows it half done, and only then moved to its new name. Every step
+// can be repeated, so a rename interrupted at any point is finished by
+// calling finishRename again.
+func (v *Vault) finishRename(rename vaultRename) error {
+	oldDisk, err := v.DiskPath(rename.Old)
+	if err != nil {
+		return err
+	}
+	newDisk, err := v.DiskPath(rename.New)
+	if err != nil {
+		return err
+	}
+	staging := filepath.Join(v.Root, vaultStagingName)
+
+	if _, err := fsys.Lstat(oldDisk); err == nil {
+		if err := fsys.Rename(oldDisk, staging); err != nil {
+			return fmt.Errorf("failed to rename file: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if _, err := fsys.Lstat(staging); err == nil {
+		if err := v.rebind(staging, rename.Old, rename.New); err != nil {
+			return err
+		}
+		if err := fsys.Rename(staging, newDisk); err != nil {
+			return fmt.Errorf("failed to rename file: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	if err := fsys.Remove(filepath.Join(v.Root, vaultRenameFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove the rename record: %w", err)
+	}
+
+	return nil
+}
+
+// rebind binds the file or directory at disk, which moved from the plaintext
+// path oldName to newName, to its new path: the data key of a file is
+// rewrapped, and the names in a directory are re-encrypted. Whatever an
+// interrupted run already rebound is recognised and left as it is.
+func (v *Vault) rebind(disk, oldName, newName string) error {
+	info, err := fsys.Lstat(disk)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if !info.IsDir() {
+		return v.rewrapFile(disk, oldName, newName)
+	}
+
+	entries, err := fsys.ReadDir(disk)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		current := filepath.Join(disk, entry.Name())
+		name, err := v.decryptName(newName, entry.Name())
+		if err != nil {
+			if name, err = v.decryptName(oldName, entry.Name()); err != nil {
+				return err
+			}
+			encrypted, err := v.encryptName(newName, name)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(disk, encrypted)
+			if err := fsys.Rename(current, target); err != nil {
+				return fmt.Errorf("failed to rename file: %w", err)
+			}
+			current = target
+		}
+		if err := v.rebind(current, path.Join(oldName, name), path.Join(newName, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrapFile rewraps the data key of the vault file at disk from the key of
+// the path oldName to the key of newName, unless that was already done.
+func (v *Vault) rewrapFile(disk, oldName, newName string) error {
+	header, err := PeekContainerHeader(disk)
+	if err != nil {
+		return fmt.Errorf("%s: %w", oldName, err)
+	}
+	if header.Envelope == nil {
+		return fmt.Errorf("%s is not a vault file", oldName)
+	}
+
+	newKey, err := v.fileKey(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := newKey.unwrap(header.Envelope); err == nil {
+		return nil
+	}
+	oldKeystore, err := v.fileKeystore(oldName)
+	if err != nil {
+		return err
+	}
+
+	return replaceEnvelope(disk, oldKeystore, newKey)
+}
+
+// saveRename writes the record of a rename, sealed with the rename key.
+func (v *Vault) saveRename(rename vaultRename) error {
+	data, err := json.Marshal(rename)
+	if err != nil {
+		return fmt.Errorf("failed to encode rename record: %w", err)
+	}
+	gcm, err := newGCM(v.renameKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, data, []byte(v.ID))
+	err = writeFileAtomic(filepath.Join(v.Root, vaultRenameFile), 0600, func(w io.Writer) error {
+		_, err := w.Write(sealed)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write rename record: %w", err)
+	}
+
+	return nil
+}
+
+// resumeRename finishes a rename that was recorded but interrupted.
+func (v *Vault) resumeRename() error {
+	sealed, err := fsys.ReadFile(filepath.Join(v.Root, vaultRenameFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read rename record: %w", err)
+	}
+
+	gcm, err := newGCM(v.renameKey)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return errors.New("rename record is truncated")
+	}
+	data, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(v.ID))
+	if err != nil {
+		return errors.New("rename record does not belong to this vault or was altered")
+	}
+	var rename vaultRename
+	if err := json.Unmarshal(data, &rename); err != nil {
+		return fmt.Errorf("failed to parse rename record: %w", err)
+	}
+
+	fmt.Printf("Finishing the interrupted rename of %s to %s\n", rename.Old, rename.New)
+	return v.finishRename(rename)
+}
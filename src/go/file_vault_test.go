@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestVault returns a vault in /vault with a random key, without the
+// argon2id cost of InitVault.
+func newTestVault(t *testing.T) *Vault {
+	t.Helper()
+
+	if err := fsys.MkdirAll("/vault", 0700); err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, vaultKeySize)
+	rand.Read(key)
+	vault, err := newVault("/vault", &VaultConfig{Version: vaultVersion, ID: "0123456789abcdef"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return vault
+}
+
+// writeVaultFiles writes every file of files into the vault.
+func writeVaultFiles(t *testing.T, vault *Vault, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		if err := vault.Write(name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assertVaultFiles checks that every file of files reads back from the vault.
+func assertVaultFiles(t *testing.T, vault *Vault, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		if data, err := vault.Read(name); err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, content)
+		}
+	}
+}
+
+func TestVaultNames(t *testing.T) {
+	useMemFileSystem(t)
+	vault := newTestVault(t)
+
+	encrypted, err := vault.encryptName("docs", "report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := vault.encryptName("docs", "report.txt"); again != encrypted {
+		t.Error("name encryption is not deterministic")
+	}
+	if other, _ := vault.encryptName("mail", "report.txt"); other == encrypted {
+		t.Error("equal names in different directories encrypt equally")
+	}
+	if name, err := vault.decryptName("docs", encrypted); err != nil || name != "report.txt" {
+		t.Errorf("decryptName = %q, %v", name, err)
+	}
+	if _, err := vault.decryptName("mail", encrypted); err == nil {
+		t.Error("name decrypted in another directory")
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(encrypted)
+	data[len(data)-1] ^= 1
+	if _, err := vault.decryptName("docs", base64.RawURLEncoding.EncodeToString(data)); err == nil {
+		t.Error("altered name decrypted")
+	}
+	if _, err := vault.encryptName("", strings.Repeat("n", maxVaultNameSize+1)); err == nil {
+		t.Error("overlong name encrypted")
+	}
+}
+
+func TestVaultFiles(t *testing.T) {
+	mem := useMemFileSystem(t)
+	vault := newTestVault(t)
+	files := map[string]string{"notes.txt": "first", "docs/report.txt": "second", "docs/old/draft.txt": "third"}
+	writeVaultFiles(t, vault, files)
+	assertVaultFiles(t, vault, files)
+
+	// Neither names nor contents appear on disk.
+	walkDir(mem, "/vault", func(path string, d fs.DirEntry, err error) error {
+		for _, word := range []string{"notes", "docs", "report", "draft", "old"} {
+			if strings.Contains(d.Name(), word) {
+				t.Errorf("%s reveals a name", path)
+			}
+		}
+		if data, _ := mem.ReadFile(path); bytes.Contains(data, []byte("second")) {
+			t.Errorf("%s reveals its content", path)
+		}
+		return nil
+	})
+
+	if err := vault.List("docs"); err != nil {
+		t.Error(err)
+	}
+	if err := vault.Write("notes.txt", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	assertVaultFiles(t, vault, map[string]string{"notes.txt": "changed"})
+
+	if err := vault.Delete("docs"); err == nil {
+		t.Error("directory that is not empty deleted")
+	}
+	if err := vault.Delete("docs/old/draft.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vault.Read("docs/old/draft.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleted file: error = %v", err)
+	}
+	if err := vault.Delete(""); err == nil {
+		t.Error("vault root deleted")
+	}
+}
+
+func TestVaultDetectsSwappedFiles(t *testing.T) {
+	mem := useMemFileSystem(t)
+	vault := newTestVault(t)
+	writeVaultFiles(t, vault, map[string]string{"a": "pay alice", "b": "pay bob"})
+
+	a, _ := vault.DiskPath("a")
+	b, _ := vault.DiskPath("b")
+	dataA, _ := mem.ReadFile(a)
+	dataB, _ := mem.ReadFile(b)
+	mem.WriteFile(a, dataB, 0600)
+	mem.WriteFile(b, dataA, 0600)
+
+	for _, name := range []string{"a", "b"} {
+		if data, err := vault.Read(name); err == nil {
+			t.Errorf("%s read as %q after swapping", name, data)
+		}
+	}
+}
+
+func TestVaultRename(t *testing.T) {
+	useMemFileSystem(t)
+	vault := newTestVault(t)
+	writeVaultFiles(t, vault, map[string]string{"a.txt": "a", "dir/b.txt": "b", "dir/sub/c.txt": "c"})
+
+	if err := vault.Rename("a.txt", "moved/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vault.Rename("dir", "other/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	assertVaultFiles(t, vault, map[string]string{"moved/a.txt": "a", "other/renamed/b.txt": "b", "other/renamed/sub/c.txt": "c"})
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		if _, err := vault.Read(name); err == nil {
+			t.Errorf("%s still exists", name)
+		}
+	}
+
+	if err := vault.Rename("other", "other/inside"); err == nil {
+		t.Error("directory moved into itself")
+	}
+	if err := vault.Rename("moved/a.txt", "other/renamed/b.txt"); err == nil {
+		t.Error("rename replaced an existing file")
+	}
+	if _, err := fsys.Lstat(filepath.Join("/vault", vaultRenameFile)); err == nil {
+		t.Error("rename record left behind")
+	}
+}
+
+func TestVaultRenameResumesAfterFailure(t *testing.T) {
+	before := map[string]string{"dir/b.txt": "b", "dir/sub/c.txt": "c", "dir/sub/d.txt": "d"}
+	after := map[string]string{"new/b.txt": "b", "new/sub/c.txt": "c", "new/sub/d.txt": "d"}
+
+	// Fail every call the rename makes in turn, as a crash there would.
+	for call := 0; ; call++ {
+		faults, _ := useFaultFileSystem(t)
+		vault := newTestVault(t)
+		writeVaultFiles(t, vault, before)
+
+		fault := faults.Inject(Fault{Op: FaultAny, After: call, Times: 1, Err: syscall.EIO})
+		err := vault.Rename("dir", "new")
+		faults.Reset()
+		if fault.Injected() == 0 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+
+		// Opening the vault again finishes the rename, unless it failed
+		// before it was recorded.
+		if err := vault.resumeRename(); err != nil {
+			t.Fatalf("call %d: %v", call, err)
+		}
+		if _, err := vault.Read("new/b.txt"); err != nil {
+			assertVaultFiles(t, vault, before)
+		} else {
+			assertVaultFiles(t, vault, after)
+		}
+		if _, err := fsys.Lstat(filepath.Join("/vault", vaultStagingName)); err == nil {
+			t.Errorf("call %d: staging directory left behind", call)
+		}
+	}
+}
+
+func TestVaultSessions(t *testing.T) {
+	mem := useMemFileSystem(t)
+	t.Setenv(HomeEnv, "/home")
+	t.Setenv(VaultSessionEnv, "")
+	passphrase := []byte("vault passphrase")
+	if err := InitVault("/vault", passphrase); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := loadVaultConfig("/vault")
+	key, _ := config.unwrapVaultKey(passphrase)
+
+	token := make([]byte, 32)
+	rand.Read(token)
+	t.Setenv(VaultSessionEnv, base64.RawURLEncoding.EncodeToString(token))
+	if err := UnlockVault("/vault", passphrase, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	session, _ := sessionPath("/vault")
+	data, err := mem.ReadFile(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString(key))) {
+		t.Error("session stores the vault key in the clear")
+	}
+
+	if _, err := OpenVault("/vault", nil); err != nil {
+		t.Fatalf("unlocked vault: %v", err)
+	}
+
+	// Without the token, or with another, the session cannot be used.
+	t.Setenv(VaultSessionEnv, "")
+	if _, err := OpenVault("/vault", nil); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("without token: error = %v", err)
+	}
+	other := make([]byte, 32)
+	rand.Read(other)
+	t.Setenv(VaultSessionEnv, base64.RawURLEncoding.EncodeToString(other))
+	if _, err := OpenVault("/vault", nil); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("with another token: error = %v", err)
+	}
+	t.Setenv(VaultSessionEnv, base64.RawURLEncoding.EncodeToString(token))
+
+	// Extending the session by editing the file breaks its seal.
+	var s vaultSession
+	json.Unmarshal(data, &s)
+	s.Expires = s.Expires.Add(24 * time.Hour)
+	extended, _ := json.Marshal(s)
+	mem.WriteFile(session, extended, 0600)
+	if _, err := OpenVault("/vault", nil); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("extended session: error = %v", err)
+	}
+
+	// Expired sessions of any vault are removed by the next vault command.
+	s.Expires = time.Now().Add(-time.Minute)
+	expired, _ := json.Marshal(s)
+	stale := filepath.Join(filepath.Dir(session), "other.json")
+	mem.WriteFile(stale, expired, 0600)
+	if err := UnlockVault("/vault", passphrase, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(stale); err == nil {
+		t.Error("expired session kept")
+	}
+
+	if err := LockVault("/vault"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenVault("/vault", nil); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("locked vault: error = %v", err)
+	}
+}
@@ -1,3 +1,14 @@
 module GoFiler
 
 go 1.20
+
+require (
+	github.com/klauspost/compress v1.17.4
+	github.com/klauspost/reedsolomon v1.11.8
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/term v0.15.0
+)
+
+require github.com/klauspost/cpuid/v2 v2.1.1 // indirect
@@ -22,29 +22,131 @@ func validateInput(input []string, expectedLen int, message string) {
 	}
 }
 
+// isDirectory reports whether path names an existing directory.
+func isDirectory(path string) bool {
+	info, err := fsys.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// outputPath returns where the result of processing input goes: out when
+// given, standard output for standard input, and the input itself otherwise.
+func outputPath(input, out string) string {
+	if out != "" {
+		return out
+	}
+	if input == StdioPath {
+		return StdioPath
+	}
+
+	return input
+}
+
+// journalOutput runs an operation that writes the file output and records
+// it, unless the output is standard output.
+func journalOutput(op, output string, run func() error) error {
+	if output == StdioPath {
+		return run()
+	}
+
+	return JournalChange(op, output, run)
+}
+
 func help() {
 	fmt.Println(`
 Usage: 
+  daemon -schedule='file' [-status='file'] [-root='dir'] : Run scheduled backups until stopped with SIGTERM
+  -root='directory'                   : Resolve every path inside this directory, as under chroot; '..' and
+                                        symbolic links cannot leave it
   -create='filename'                  : Create a new file with specified name
   -read='filename'                    : Read a file with specified name
   -write='filename' -data='data'      : Write to a file
   -append='filename' -data='data'     : Append to a file
-  -delete='filename'                  : Delete a file with specified name
+  -delete='filename'                  : Move a file or directory to the trash
+      -permanent                      : Delete it permanently instead, with -delete or -deleteFile
+  -trash list                         : List the items in the trash
+  -trash restore 'name|path'          : Restore an item, given by its trash name or original path
+  -trash empty [-older-than=30d]      : Permanently delete the items in the trash, or only older ones
+  -undo [-steps=N]                    : Undo the last N file operations (default 1)
+  -history                            : List the recorded file operations
+  -shred [-passes=N]                  : With -delete or -deleteFile, overwrite files N times (default 3) before
+                                        deleting them, recursively for directories; with -compressEncrypt,
+                                        shred the plaintext once it is encrypted
   -rename='oldname,newname'           : Rename a file
-  -move='src,dest'                    : Move a file
+  -move='src,dest'                    : Move a file or directory, copying it across file systems
+  -copy='src,dest'                    : Copy a file or directory tree; into dest if it is a directory
+      -preserve                       : Keep times, ownership and special mode bits with -copy
+      -follow-symlinks                : Copy what symbolic links point to instead of the links
+      -existing='overwrite|skip|update' : What -copy does with existing files (default overwrite);
+                                        update only replaces files older than the source
+      -verify                         : Compare the SHA-256 of every copied file with its source
   -backup='filename'                  : Backup a file with specified name
   -restore='filename'                 : Restore a file from backup with specified name
-  -listBackups='path'                 : List backups for a file with specified path
+  -listBackups='path'                 : List backups for a file with specified path ('*' for all files)
+      -format='table|json'            : Output format for -listBackups
+      -sort='time|size|source|id'     : Sort order for -listBackups
+      -reverse                        : Reverse the sort order for -listBackups
+      -since='24h|2006-01-02T15:04:05Z' : Only list backups created since a duration ago or a time
+  -tags='tag1,tag2'                   : Tags to attach with -backup, or to filter -listBackups
+  -parity=N                           : Store N Reed-Solomon parity shards per stripe with -backup
+  -dataShards=N                       : Data shards per parity stripe with -backup (default 10)
+  -signingKey='file.key'              : Sign the catalog entry of the backup with -backup
+  -require-signature                  : With -restore, refuse backups that are not signed by -signer
+                                        or a key listed in ~/.gofiler/trusted-signers
+  -signer='a.pub,b.pub'               : With -restore, only accept backups signed by these keys
+  -export='archive' [-ids='id1,id2'] : Export backups (all by default) into a portable archive
+  -import='archive'                   : Import backups from an archive created with -export
   -checkintegrity='filename,backupfilename' : Check file integrity
+  -verify-backups                     : Re-hash every stored backup against its recorded checksum
   -user='username,role'               : Specify a user
   -edit='filename' -data='data' -user='username,role' : Edit a file
   -save='filename'                    : Save a file with specified name
   -loadVersion='filename,version'     : Load a specific version of a file
   -printChanges='filename'            : Print changes of a file with specified name
   -assignRole='filename' -user='username,role' : Assign a role to a user for a file
-  -compressEncrypt='filename'         : Compress and encrypt a file
-  -decompressDecrypt='filename'       : Decompress and decrypt a file
+  -compressEncrypt='filename'         : Compress and encrypt a file ('-' reads standard input)
+  -decompressDecrypt='filename'       : Decompress and decrypt a file ('-' reads standard input)
+  -compressEncrypt='directory'        : Encrypt every file in a directory tree that is not encrypted yet;
+  -decompressDecrypt='directory'        -decompressDecrypt decrypts every encrypted file. Rerun to resume
+      -include='*.txt,docs/*'         : Only process files matching these globs
+      -exclude='*.log,tmp'            : Skip files and directories matching these globs
+      -workers=N                      : Files processed in parallel (default 4)
+  -out='filename'                     : Write -compressEncrypt or -decompressDecrypt output to a file instead
+                                        of replacing the input; use '-' for standard output
+  -inspect='filename'                 : Show the container header of an encrypted file
+  -passphrase-file='file'             : Read the encryption passphrase from a file
+                                        (otherwise GOFILER_PASSPHRASE or a terminal prompt is used)
+  -compression='gzip|zlib|zstd|xz|none' : Compression codec for -compressEncrypt (default gzip)
+  -level=N                            : Compression level for -compression (default: the codec's default)
+  -auto                               : Store already-compressed content uncompressed with -compressEncrypt
+  -recipients='alice,bob'             : Encrypt with -compressEncrypt to keyring names or .pub files
+  -identity='file.key'                : Private key for -decompressDecrypt (default ~/.gofiler/identity.key)
+  -legacy                             : Read a file encrypted by GoFiler before passphrases existed:
+                                        -decompressDecrypt decrypts it, -compressEncrypt re-encrypts it
+  -envelope                           : Encrypt with -compressEncrypt under the active master key instead of a passphrase
+  -new-master-key                     : Add a master key to the keystore and make it active
+  -list-master-keys                   : List the master keys in the keystore
+  -rotate-keys='directory'            : Rewrap data keys of envelope-encrypted files under the active master key
+  -remove-master-key='id'             : Remove a retired master key from the keystore
+  -split-key='id|vault-directory'     : Split a master key or a vault key into share files
+      -shares=N -threshold=K          : Number of shares, and how many recover the key (default 3 of 5)
+  -combine-shares='a.txt,b.txt'       : Recover a master key into the keystore, or with -vault='directory'
+                                        give the vault a new passphrase
+  -keygen='name' [-keyType='x25519|ed25519'] : Generate an encryption (x25519) or signing (ed25519)
+                                        key pair as name.key and name.pub
+  -sign='filename' -signingKey='file.key' : Write a detached ed25519 signature to filename.sig
+  -verify-signature='filename' [-signer='file.pub'] : Check the detached signature of a file
+  -signature='file.sig'               : Signature file for -sign or -verify-signature (default filename.sig)
+  -addRecipient='name,key.pub'        : Add a public key to the recipient keyring
+  -removeRecipient='name'             : Remove a public key from the recipient keyring
+  -listRecipients                     : List the recipient keyring
   -listFiles='directory'              : List all files in a directory
+  -vault-init='directory'             : Create an encrypted vault with encrypted file names
+  -vault-unlock='directory'           : Keep the vault key for -vault-ttl so commands need no passphrase;
+                                        they need the GOFILER_VAULT_SESSION token it prints
+      -vault-ttl=15m                  : How long -vault-unlock keeps the vault unlocked
+  -vault-lock='directory'             : Forget the key of an unlocked vault
+  -vault='directory'                  : Run -listFiles, -read, -write, -delete and -rename on plaintext
+                                        paths inside the vault
   -getPermissions='filename'          : Get permissions of a file
   -setPermissions='filename,mode'     : Set permissions of a file
   -info='filename'                    : Get metadata of a file or directory`)
@@ -52,6 +154,12 @@ Usage:
 
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		handleError(RunDaemon(os.Args[2:]))
+		return
+	}
+
+	rootPtr := flag.String("root", "", "Confine every path to a directory, as if it were the root of the file system. Use in the format -root='directory'")
 	createPtr := flag.String("create", "", "Create a new file with specified name")
 	readPtr := flag.String("read", "", "Read a file with specified name")
 	writePtr := flag.String("write", "", "Write to a file. Use in the format -write='filename' -data='data to write'")
@@ -59,11 +167,35 @@ func main() {
 	deletePtr := flag.String("delete", "", "Delete a file with specified name")
 	renamePtr := flag.String("rename", "", "Rename a file. Use in the format -rename='oldname,newname'")
 	movePtr := flag.String("move", "", "Move a file. Use in the format -move='src,dest'")
+	copyPtr := flag.String("copy", "", "Copy a file or directory tree. Use in the format -copy='src,dest'")
+	preservePtr := flag.Bool("preserve", false, "Keep times, ownership and special mode bits with -copy")
+	followSymlinksPtr := flag.Bool("follow-symlinks", false, "Copy what symbolic links point to instead of the links with -copy")
+	existingPtr := flag.String("existing", ExistingOverwrite, "What -copy does with existing files: overwrite, skip or update")
+	verifyPtr := flag.Bool("verify", false, "Compare the SHA-256 of every file copied by -copy with its source")
+	permanentPtr := flag.Bool("permanent", false, "Delete files with -delete or -deleteFile permanently instead of moving them to the trash")
+	trashPtr := flag.String("trash", "", "Manage the trash: list, restore 'name' or empty")
+	undoPtr := flag.Bool("undo", false, "Undo the last file operation, or the last -steps operations")
+	stepsPtr := flag.Int("steps", 1, "Number of operations -undo reverses")
+	historyPtr := flag.Bool("history", false, "List the recorded file operations")
+	olderThanPtr := flag.String("older-than", "", "With -trash empty, only delete items deleted longer ago than this (e.g. '30d') or before an RFC 3339 time")
+	shredPtr := flag.Bool("shred", false, "Overwrite file contents before deleting them with -delete or -deleteFile, or the plaintext after -compressEncrypt")
+	passesPtr := flag.Int("passes", DefaultShredPasses, "Number of times -shred overwrites a file")
 	dataPtr := flag.String("data", "", "Data to write or append to file")
 	backupPtr := flag.String("backup", "", "Backup a file with specified name")
 	restorePtr := flag.String("restore", "", "Restore a file from backup with specified name")
-	listBackupsPtr := flag.String("listBackups", "", "List backups for a file with specified path")
+	listBackupsPtr := flag.String("listBackups", "", "List backups for a file with specified path. Use '*' to list backups of all files")
+	formatPtr := flag.String("format", "table", "Output format for -listBackups. Use 'table' or 'json'")
+	sortPtr := flag.String("sort", "time", "Sort order for -listBackups. Use 'time', 'size', 'source' or 'id'")
+	reversePtr := flag.Bool("reverse", false, "Reverse the sort order for -listBackups")
+	sincePtr := flag.String("since", "", "Only list backups created since a duration ago (e.g. '24h') or an RFC 3339 time")
+	parityPtr := flag.Int("parity", 0, "Number of Reed-Solomon parity shards per stripe to store with -backup. 0 disables parity")
+	dataShardsPtr := flag.Int("dataShards", DefaultDataShards, "Number of data shards per parity stripe with -backup")
+	tagsPtr := flag.String("tags", "", "Comma-separated tags to attach with -backup, or to filter -listBackups")
 	checkIntegrityPtr := flag.String("checkintegrity", "", "Check file integrity. Use in the format -checkintegrity='filename,backupfilename'")
+	exportPtr := flag.String("export", "", "Export backups into a portable archive. Use in the format -export='archive.tar.gz' [-ids='id1,id2']")
+	idsPtr := flag.String("ids", "", "Comma-separated backup IDs to export with -export. Defaults to every backup matching -tags and -since")
+	importPtr := flag.String("import", "", "Import backups from an archive created with -export")
+	verifyBackupsPtr := flag.Bool("verify-backups", false, "Re-hash every stored backup and report corrupt or missing backups")
 	userPtr := flag.String("user", "", "Specify a user. Use in the format -user='username,role'")
 	editPtr := flag.String("edit", "", "Edit a file. Use in the format -edit='filename' -data='data to append' -user='username,role'")
 	savePtr := flag.String("save", "", "Save a file with specified name")
@@ -72,11 +204,48 @@ func main() {
 	assignRolePtr := flag.String("assignRole", "", "Assign a role to a user for a file. Use in the format -assignRole='filename' -user='username,role'")
 	compressEncryptPtr := flag.String("compressEncrypt", "", "Compress and encrypt a file. Use in the format -compressEncrypt='filename'")
 	decompressDecryptPtr := flag.String("decompressDecrypt", "", "Decompress and decrypt a file. Use in the format -decompressDecrypt='filename'")
+	includePtr := flag.String("include", "", "Comma-separated glob patterns of files to process when encrypting or decrypting a directory")
+	excludePtr := flag.String("exclude", "", "Comma-separated glob patterns of files and directories to skip when encrypting or decrypting a directory")
+	workersPtr := flag.Int("workers", DefaultWorkers, "Number of files encrypted or decrypted in parallel in a directory")
+	outPtr := flag.String("out", "", "Write -compressEncrypt or -decompressDecrypt output to a file, or '-' for standard output, instead of replacing the input")
+	inspectPtr := flag.String("inspect", "", "Show the container header of an encrypted file. Use in the format -inspect='filename'")
+	passphraseFilePtr := flag.String("passphrase-file", "", "Read the encryption passphrase from a file instead of GOFILER_PASSPHRASE or a prompt")
+	compressionPtr := flag.String("compression", CompressionGzip, "Compression codec used by -compressEncrypt: "+strings.Join(CodecNames(), ", "))
+	levelPtr := flag.Int("level", DefaultLevel, "Compression level used by -compressEncrypt. 0 selects the codec's default")
+	autoPtr := flag.Bool("auto", false, "Skip compression with -compressEncrypt when the content already looks compressed")
+	recipientsPtr := flag.String("recipients", "", "Encrypt to public keys instead of a passphrase. Use in the format -recipients='alice,bob'")
+	identityPtr := flag.String("identity", "", "Private keys used to decrypt files encrypted to recipients. Use in the format -identity='file.key'")
+	legacyPtr := flag.Bool("legacy", false, "Read a file encrypted by an older GoFiler version with its built-in key: -decompressDecrypt decrypts it, -compressEncrypt re-encrypts it with the current keys")
+	envelopePtr := flag.Bool("envelope", false, "Encrypt with -compressEncrypt under the active master key of the keystore instead of a passphrase")
+	newMasterKeyPtr := flag.Bool("new-master-key", false, "Add a new master key to the keystore and make it active")
+	listMasterKeysPtr := flag.Bool("list-master-keys", false, "List the master keys in the keystore")
+	removeMasterKeyPtr := flag.String("remove-master-key", "", "Remove a retired master key from the keystore. Use in the format -remove-master-key='id'")
+	rotateKeysPtr := flag.String("rotate-keys", "", "Rewrap the data keys of envelope-encrypted files under the active master key. Use in the format -rotate-keys='directory'")
+	splitKeyPtr := flag.String("split-key", "", "Split a master key or the key of a vault into shares. Use in the format -split-key='id|vault-directory' -shares=N -threshold=K")
+	sharesPtr := flag.Int("shares", 5, "Number of shares created by -split-key")
+	thresholdPtr := flag.Int("threshold", 3, "Number of shares needed to recover a key split with -split-key")
+	combineSharesPtr := flag.String("combine-shares", "", "Recover a key from share files. Use in the format -combine-shares='a.txt,b.txt,c.txt' [-vault='directory']")
+	keygenPtr := flag.String("keygen", "", "Generate a key pair. Use in the format -keygen='name' [-keyType='x25519|ed25519']")
+	keyTypePtr := flag.String("keyType", KeyTypeX25519, "Type of key pair generated by -keygen: 'x25519' for encryption or 'ed25519' for signing")
+	signPtr := flag.String("sign", "", "Write a detached signature of a file. Use in the format -sign='filename' -signingKey='file.key'")
+	verifySignaturePtr := flag.String("verify-signature", "", "Check the detached signature of a file. Use in the format -verify-signature='filename' [-signer='file.pub']")
+	signaturePtr := flag.String("signature", "", "Signature file for -sign or -verify-signature. Defaults to the file name with .sig appended")
+	signingKeyPtr := flag.String("signingKey", "", "ed25519 private key used by -sign and to sign backups created with -backup")
+	signerPtr := flag.String("signer", "", "Comma-separated ed25519 public keys trusted by -verify-signature and -restore")
+	requireSignaturePtr := flag.Bool("require-signature", false, "With -restore, refuse backups that are not signed by -signer or a key in the trusted-signers file")
+	addRecipientPtr := flag.String("addRecipient", "", "Add a public key to the recipient keyring. Use in the format -addRecipient='name,key.pub'")
+	removeRecipientPtr := flag.String("removeRecipient", "", "Remove a public key from the recipient keyring. Use in the format -removeRecipient='name'")
+	listRecipientsPtr := flag.Bool("listRecipients", false, "List the recipient keyring")
 	createFilePtr := flag.String("createFile", "", "Create a file. Use in the format -createFile='filename'")
 	deleteFilePtr := flag.String("deleteFile", "", "Delete a file. Use in the format -deleteFile='filename'")
 	renameFilePtr := flag.String("renameFile", "", "Rename a file. Use in the format -renameFile='oldname,newname'")
 	moveFilePtr := flag.String("moveFile", "", "Move a file. Use in the format -moveFile='src,dest'")
 	listFilesPtr := flag.String("listFiles", "", "List all files in a directory. Use in the format -listFiles='directory'")
+	vaultPtr := flag.String("vault", "", "Run -listFiles, -read, -write, -delete and -rename inside an encrypted vault. Use in the format -vault='directory'")
+	vaultInitPtr := flag.String("vault-init", "", "Create an encrypted vault. Use in the format -vault-init='directory'")
+	vaultUnlockPtr := flag.String("vault-unlock", "", "Unlock a vault for -vault-ttl. Use in the format -vault-unlock='directory'")
+	vaultLockPtr := flag.String("vault-lock", "", "Lock an unlocked vault. Use in the format -vault-lock='directory'")
+	vaultTTLPtr := flag.Duration("vault-ttl", DefaultVaultTTL, "How long -vault-unlock keeps a vault unlocked")
 	getPermissionsPtr := flag.String("getPermissions", "", "Get permissions of a file. Use in the format -getPermissions='filename'")
 	setPermissionsPtr := flag.String("setPermissions", "", "Set permissions of a file. Use in the format -setPermissions='filename,mode'")
 	infoPtr := flag.String("info", "", "Get metadata of a file or directory")
@@ -90,28 +259,77 @@ func main() {
 	// Parse the flags
 	flag.Parse()
 
+	if *rootPtr != "" {
+		sandbox, err := NewSandboxFileSystem(*rootPtr, fsys)
+		handleError(err)
+		fsys = sandbox
+	}
+
+	var vault *Vault
+	if *vaultPtr != "" && (*listFilesPtr != "" || *readPtr != "" || *writePtr != "" || *deletePtr != "" || *renamePtr != "") {
+		var err error
+		vault, err = OpenVault(*vaultPtr, func() ([]byte, error) {
+			return ReadPassphrase(*passphraseFilePtr, false)
+		})
+		handleError(err)
+	}
+
 	if *createPtr != "" {
-    handleError(FileOpCreate(*createPtr))
+		handleError(JournalChange("create", *createPtr, func() error {
+			return FileOpCreate(*createPtr)
+		}))
 	}
 
-	if *readPtr != "" {
+	if *readPtr != "" && vault != nil {
+		data, err := vault.Read(*readPtr)
+		handleError(err)
+		fmt.Println(string(data))
+	} else if *readPtr != "" {
 		data, err := FileOpRead(*readPtr)
 		handleError(err)
 		fmt.Println(data)
 	}
 
-	if *writePtr != "" {
-		err := FileOpWrite(*writePtr, *dataPtr)
+	if *writePtr != "" && vault != nil {
+		disk, err := vault.DiskPath(*writePtr)
+		handleError(err)
+		err = JournalChange("vault-write", disk, func() error {
+			return vault.Write(*writePtr, []byte(*dataPtr))
+		})
+		handleError(err)
+	} else if *writePtr != "" {
+		err := JournalChange("write", *writePtr, func() error {
+			return FileOpWrite(*writePtr, *dataPtr)
+		})
 		handleError(err)
 	}
 	
 	if *appendPtr != "" {
-		err := FileOpAppend(*appendPtr, *dataPtr)
+		err := JournalChange("append", *appendPtr, func() error {
+			return FileOpAppend(*appendPtr, *dataPtr)
+		})
 		handleError(err)
 	}
 	
-	if *deletePtr != "" {
-		err := FileOpDelete(*deletePtr)
+	if *deletePtr != "" && vault != nil {
+		disk, err := vault.DiskPath(*deletePtr)
+		handleError(err)
+		err = JournalChange("vault-delete", disk, func() error {
+			return vault.Delete(*deletePtr)
+		})
+		handleError(err)
+	} else if *deletePtr != "" && *shredPtr {
+		err := JournalFinal("shred", *deletePtr, func() error {
+			return ShredPath(*deletePtr, *passesPtr)
+		})
+		handleError(err)
+	} else if *deletePtr != "" && *permanentPtr {
+		err := JournalFinal("permanent-delete", *deletePtr, func() error {
+			return FileOpDelete(*deletePtr)
+		})
+		handleError(err)
+	} else if *deletePtr != "" {
+		err := JournalTrash(*deletePtr)
 		handleError(err)
 	}
 	
@@ -121,8 +339,19 @@ func main() {
 			fmt.Println("Invalid rename format. Use -rename='oldname,newname'")
 			os.Exit(1)
 		}
-		err := FileOpRename(names[0], names[1])
-		handleError(err)
+		if vault != nil {
+			// The names and keys below a renamed directory are bound to
+			// its path, so the rename can only be undone by another one.
+			disk, err := vault.DiskPath(names[0])
+			handleError(err)
+			handleError(JournalFinal("vault-rename", disk, func() error {
+				return vault.Rename(names[0], names[1])
+			}))
+		} else {
+			handleError(JournalMove("rename", names[0], names[1], func() error {
+				return FileOpRename(names[0], names[1])
+			}))
+		}
 	}
 	
 	if *movePtr != "" {
@@ -131,17 +360,51 @@ func main() {
 			fmt.Println("Invalid move format. Use -move='src,dest'")
 			os.Exit(1)
 		}
-		err := FileOpMove(paths[0], paths[1])
+		err := JournalMove("move", paths[0], paths[1], func() error {
+			return FileOpMove(paths[0], paths[1])
+		})
 		handleError(err)
 	}	
 
+	if *copyPtr != "" {
+		paths := strings.Split(*copyPtr, ",")
+		validateInput(paths, 2, "Invalid format. Use -copy='src,dest'")
+		err := JournalChange("copy", copyTarget(paths[0], paths[1]), func() error {
+			return CopyPath(paths[0], paths[1], CopyOptions{
+				Preserve:       *preservePtr,
+				FollowSymlinks: *followSymlinksPtr,
+				Existing:       *existingPtr,
+				Verify:         *verifyPtr,
+			})
+		})
+		handleError(err)
+	}
+
 	if *backupPtr != "" {
-		err := BackupFile(*backupPtr)
+		opts := BackupOptions{
+			Tags:         splitList(*tagsPtr),
+			ParityShards: *parityPtr,
+			DataShards:   *dataShardsPtr,
+		}
+		if *signingKeyPtr != "" {
+			key, err := LoadSigningKey(*signingKeyPtr)
+			handleError(err)
+			opts.SigningKey = key
+		}
+		err := BackupFile(*backupPtr, opts)
 		handleError(err)
 	}
 	
 	if *listBackupsPtr != "" {
-		err := ListBackups(*listBackupsPtr)
+		since, err := parseSince(*sincePtr)
+		handleError(err)
+		err = ListBackups(*listBackupsPtr, ListOptions{
+			Format:  *formatPtr,
+			SortBy:  *sortPtr,
+			Reverse: *reversePtr,
+			Tags:    splitList(*tagsPtr),
+			Since:   since,
+		})
 		handleError(err)
 	}
 	
@@ -152,7 +415,15 @@ func main() {
 	}
 	
 	if *restorePtr != "" {
-		err := RestoreBackup(*restorePtr)
+		signers, err := LoadVerifyingKeys(splitList(*signerPtr))
+		handleError(err)
+		if *requireSignaturePtr && len(signers) == 0 {
+			signers, err = LoadTrustedSigners()
+			handleError(err)
+		}
+		err = JournalChange("restore", *restorePtr, func() error {
+			return RestoreBackup(*restorePtr, RestoreOptions{RequireSignature: *requireSignaturePtr, TrustedKeys: signers})
+		})
 		handleError(err)
 	}	
 
@@ -163,6 +434,23 @@ func main() {
 		handleError(err)
 	}
 	
+	if *exportPtr != "" {
+		since, err := parseSince(*sincePtr)
+		handleError(err)
+		err = ExportBackups(*exportPtr, splitList(*idsPtr), ListOptions{Tags: splitList(*tagsPtr), Since: since})
+		handleError(err)
+	}
+
+	if *importPtr != "" {
+		err := ImportBackups(*importPtr)
+		handleError(err)
+	}
+
+	if *verifyBackupsPtr {
+		err := VerifyBackups()
+		handleError(err)
+	}
+
 	var user *User
 	if *userPtr != "" {
 		userDetails := strings.Split(*userPtr, ",")
@@ -178,7 +466,7 @@ func main() {
 	
 	if *savePtr != "" {
 		file := NewFile(*savePtr)
-		err := file.Save()
+		err := JournalChange("save", *savePtr, file.Save)
 		handleError(err)
 	}
 	
@@ -204,45 +492,256 @@ func main() {
 		file.AssignRole(*user, user.Role)
 	}
 
+	if *newMasterKeyPtr {
+		err := NewMasterKey()
+		handleError(err)
+	}
+
+	if *listMasterKeysPtr {
+		err := ListMasterKeys()
+		handleError(err)
+	}
+
+	if *rotateKeysPtr != "" {
+		err := RotateKeys(*rotateKeysPtr)
+		handleError(err)
+	}
+
+	if *splitKeyPtr != "" {
+		err := SplitKey(*splitKeyPtr, *sharesPtr, *thresholdPtr, func() ([]byte, error) {
+			return ReadPassphrase(*passphraseFilePtr, false)
+		})
+		handleError(err)
+	}
+
+	if *combineSharesPtr != "" {
+		err := CombineKeyShares(splitList(*combineSharesPtr), *vaultPtr, func() ([]byte, error) {
+			return ReadPassphrase(*passphraseFilePtr, true)
+		})
+		handleError(err)
+	}
+
+	if *removeMasterKeyPtr != "" {
+		err := RemoveMasterKey(*removeMasterKeyPtr)
+		handleError(err)
+	}
+
+	if *keygenPtr != "" {
+		var err error
+		switch *keyTypePtr {
+		case KeyTypeX25519:
+			err = GenerateKeyPair(*keygenPtr)
+		case KeyTypeEd25519:
+			err = GenerateSigningKeyPair(*keygenPtr)
+		default:
+			err = fmt.Errorf("unknown key type %q: use %s or %s", *keyTypePtr, KeyTypeX25519, KeyTypeEd25519)
+		}
+		handleError(err)
+	}
+
+	if *signPtr != "" {
+		if *signingKeyPtr == "" {
+			fmt.Println("Invalid format. Use -sign='filename' -signingKey='file.key'")
+			os.Exit(1)
+		}
+		key, err := LoadSigningKey(*signingKeyPtr)
+		handleError(err)
+		err = SignFile(*signPtr, *signaturePtr, key)
+		handleError(err)
+	}
+
+	if *verifySignaturePtr != "" {
+		signers, err := LoadVerifyingKeys(splitList(*signerPtr))
+		handleError(err)
+		err = VerifyFileSignature(*verifySignaturePtr, *signaturePtr, signers)
+		handleError(err)
+	}
+
+	if *addRecipientPtr != "" {
+		parts := strings.Split(*addRecipientPtr, ",")
+		validateInput(parts, 2, "Invalid format. Use -addRecipient='name,key.pub'")
+		err := AddRecipient(parts[0], parts[1])
+		handleError(err)
+	}
+
+	if *removeRecipientPtr != "" {
+		err := RemoveRecipient(*removeRecipientPtr)
+		handleError(err)
+	}
+
+	if *listRecipientsPtr {
+		err := ListRecipients()
+		handleError(err)
+	}
+
 	if *compressEncryptPtr != "" {
-		err := CompressAndEncryptFile(*compressEncryptPtr)
+		keys, err := EncryptionKeys(*passphraseFilePtr, splitList(*recipientsPtr), *envelopePtr)
+		handleError(err)
+		opts := CompressionOptions{Codec: *compressionPtr, Level: *levelPtr, Auto: *autoPtr}
+		shredPasses := 0
+		if *shredPtr {
+			shredPasses = *passesPtr
+		}
+		encrypt := func() error {
+			if *legacyPtr {
+				return MigrateLegacyFileTo(*compressEncryptPtr, outputPath(*compressEncryptPtr, *outPtr), keys, opts)
+			}
+			return CompressAndEncryptFileTo(*compressEncryptPtr, outputPath(*compressEncryptPtr, *outPtr), keys, opts)
+		}
+		output := outputPath(*compressEncryptPtr, *outPtr)
+		if isDirectory(*compressEncryptPtr) && *legacyPtr {
+			err = fmt.Errorf("-legacy works on single files, not directories")
+		} else if isDirectory(*compressEncryptPtr) {
+			err = JournalFinal("encrypt", *compressEncryptPtr, func() error {
+				return ProcessTree(*compressEncryptPtr, TreeEncrypt, TreeOptions{
+					Include:     splitList(*includePtr),
+					Exclude:     splitList(*excludePtr),
+					Workers:     *workersPtr,
+					Keys:        keys,
+					Compression: opts,
+					ShredPasses: shredPasses,
+				})
+			})
+		} else if shredPasses > 0 {
+			err = JournalFinal("encrypt", *compressEncryptPtr, func() error {
+				return ShredReplaced(*compressEncryptPtr, shredPasses, encrypt)
+			})
+		} else if output == *compressEncryptPtr && output != StdioPath {
+			// Keeping the plaintext for undo would defeat the encryption.
+			err = JournalFinal("encrypt", output, encrypt)
+		} else {
+			err = journalOutput("encrypt", output, encrypt)
+		}
 		handleError(err)
 	}
 
 	if *decompressDecryptPtr != "" {
-		err := DecryptAndDecompressFile(*decompressDecryptPtr)
+		if *legacyPtr {
+			if isDirectory(*decompressDecryptPtr) {
+				handleError(fmt.Errorf("-legacy works on single files, not directories"))
+			}
+			err := journalOutput("decrypt", outputPath(*decompressDecryptPtr, *outPtr), func() error {
+				return DecryptLegacyFileTo(*decompressDecryptPtr, outputPath(*decompressDecryptPtr, *outPtr))
+			})
+			handleError(err)
+		} else if isDirectory(*decompressDecryptPtr) {
+			keys, err := TreeDecryptionKeys(*decompressDecryptPtr, *passphraseFilePtr, splitList(*identityPtr))
+			handleError(err)
+			err = JournalChange("decrypt", *decompressDecryptPtr, func() error {
+				return ProcessTree(*decompressDecryptPtr, TreeDecrypt, TreeOptions{
+					Include: splitList(*includePtr),
+					Exclude: splitList(*excludePtr),
+					Workers: *workersPtr,
+					Keys:    keys,
+				})
+			})
+			handleError(err)
+		} else {
+			keys, err := DecryptionKeys(*decompressDecryptPtr, *passphraseFilePtr, splitList(*identityPtr))
+			handleError(err)
+			err = journalOutput("decrypt", outputPath(*decompressDecryptPtr, *outPtr), func() error {
+				return DecryptAndDecompressFileTo(*decompressDecryptPtr, outputPath(*decompressDecryptPtr, *outPtr), keys)
+			})
+			handleError(err)
+		}
+	}
+
+	if *inspectPtr != "" {
+		err := InspectFile(*inspectPtr)
 		handleError(err)
 	}
 
 	if *createFilePtr != "" {
-		err := CreateFile(*createFilePtr)
+		err := JournalChange("create", *createFilePtr, func() error {
+			return CreateFile(*createFilePtr)
+		})
 		handleError(err)
 	}
 
-	if *deleteFilePtr != "" {
-		err := DeleteFile(*deleteFilePtr)
+	if *deleteFilePtr != "" && *shredPtr {
+		err := JournalFinal("shred", *deleteFilePtr, func() error {
+			return ShredPath(*deleteFilePtr, *passesPtr)
+		})
+		handleError(err)
+	} else if *deleteFilePtr != "" && *permanentPtr {
+		err := JournalFinal("permanent-delete", *deleteFilePtr, func() error {
+			return DeleteFile(*deleteFilePtr)
+		})
+		handleError(err)
+	} else if *deleteFilePtr != "" {
+		err := JournalTrash(*deleteFilePtr)
+		handleError(err)
+	}
+
+	switch *trashPtr {
+	case "":
+	case "list":
+		handleError(ListTrash())
+	case "restore":
+		if flag.NArg() != 1 {
+			fmt.Println("Invalid format. Use -trash restore 'name or original path'")
+			os.Exit(1)
+		}
+		handleError(JournalUntrash(flag.Arg(0)))
+	case "empty":
+		olderThan, err := parseSince(*olderThanPtr)
 		handleError(err)
+		handleError(EmptyTrash(olderThan))
+	default:
+		fmt.Println("Invalid trash command. Use -trash list, -trash restore 'name' or -trash empty [-older-than=30d]")
+		os.Exit(1)
+	}
+
+	if *undoPtr {
+		handleError(Undo(*stepsPtr))
+	}
+
+	if *historyPtr {
+		handleError(History())
 	}
 
 	if *renameFilePtr != "" {
 		files := strings.Split(*renameFilePtr, ",")
 		validateInput(files, 2, "Invalid format. Use -renameFile='oldname,newname'")
-		err := RenameFile(files[0], files[1])
+		err := JournalMove("rename", files[0], files[1], func() error {
+			return RenameFile(files[0], files[1])
+		})
 		handleError(err)
 	}
 
 	if *moveFilePtr != "" {
 		files := strings.Split(*moveFilePtr, ",")
 		validateInput(files, 2, "Invalid format. Use -moveFile='src,dest'")
-		err := MoveFile(files[0], files[1])
+		err := JournalMove("move", files[0], files[1], func() error {
+			return MoveFile(files[0], files[1])
+		})
 		handleError(err)
 	}
 
-	if *listFilesPtr != "" {
+	if *listFilesPtr != "" && vault != nil {
+		err := vault.List(*listFilesPtr)
+		handleError(err)
+	} else if *listFilesPtr != "" {
 		err := ListFiles(*listFilesPtr)
 		handleError(err)
 	}
 
+	if *vaultInitPtr != "" {
+		passphrase, err := ReadPassphrase(*passphraseFilePtr, true)
+		handleError(err)
+		handleError(InitVault(*vaultInitPtr, passphrase))
+	}
+
+	if *vaultUnlockPtr != "" {
+		passphrase, err := ReadPassphrase(*passphraseFilePtr, false)
+		handleError(err)
+		handleError(UnlockVault(*vaultUnlockPtr, passphrase, *vaultTTLPtr))
+	}
+
+	if *vaultLockPtr != "" {
+		handleError(LockVault(*vaultLockPtr))
+	}
+
 	if *getPermissionsPtr != "" {
 		err := GetPermissions(*getPermissionsPtr)
 		handleError(err)
@@ -253,7 +752,9 @@ func main() {
 		validateInput(args, 2, "Invalid format. Use -setPermissions='filename,mode'")
 		mode, err := strconv.ParseUint(args[1], 8, 32)
 		handleError(err)
-		err = SetPermissions(args[0], os.FileMode(mode))
+		err = JournalChmod(args[0], func() error {
+			return SetPermissions(args[0], os.FileMode(mode))
+		})
 		handleError(err)
 	}
 